@@ -1,28 +1,459 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/lbajolet/atm_service/pkg/api"
+	"github.com/lbajolet/atm_service/pkg/events"
 	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/lbajolet/atm_service/pkg/version"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// listenAddr is the address the service listens on
+const listenAddr = "0.0.0.0:8080"
+
 var rootCmd = cobra.Command{
-	RunE: doMain,
-	Use:  "atm: run the ATM service",
+	RunE:    doMain,
+	Use:     "atm: run the ATM service",
+	Version: version.Version,
+}
+
+var apiConfig = api.DefaultConfig()
+
+var dbConfig = persistence.DefaultConfig()
+
+// persistenceMode selects the persistence layer: "sqlite", or "memory" to
+// load test the service without a database
+var persistenceMode = "sqlite"
+
+var noDBLock bool
+
+// idempotencyStore selects where the responses to requests made with an
+// Idempotency-Key are kept: "memory", or "db" to share them between instances
+// using the same database
+var idempotencyStore = "memory"
+
+var trustedProxies []string
+
+var routeTimeouts map[string]string
+
+// natsURL is the NATS server transaction events are published to, events are
+// not published if empty
+var natsURL string
+
+var natsSubject = "atm.transactions"
+
+// maxHeaderBytes bounds the size of request headers, 16 KiB by default, which
+// is plenty for the few headers of the API; larger headers are rejected with
+// 431 by net/http
+var maxHeaderBytes = 16 << 10
+
+// tlsCert and tlsKey are the certificate and key the service is served with
+// over TLS, and HTTP/2; the service is served in cleartext if empty
+var tlsCert, tlsKey string
+
+// serveH2C serves HTTP/2 in cleartext, along with HTTP/1.1, when not using
+// TLS
+var serveH2C bool
+
+// businessHours and businessHoursTimezone are the window withdrawals above
+// the business hours threshold are restricted to, and its time zone
+var businessHours = "09:00-17:00"
+
+var businessHoursTimezone = "UTC"
+
+var businessHoursThreshold int64
+
+// drainDelay is how long new requests are refused with 503 at shutdown
+// before the listener is closed, so load balancers stop routing requests to
+// the service
+var drainDelay time.Duration
+
+// shutdownTimeout is how long the requests being served are given to
+// complete at shutdown, before their connections are closed
+var shutdownTimeout = 30 * time.Second
+
+func init() {
+	rootCmd.SetVersionTemplate(fmt.Sprintf(
+		"version: %s\ncommit: %s\nbuild date: %s\n",
+		version.Version, version.Commit, version.BuildDate,
+	))
+
+	flags := rootCmd.Flags()
+	flags.IntVar(&apiConfig.MaxBatchRecipients, "max-batch-recipients", apiConfig.MaxBatchRecipients,
+		"maximum number of accounts credited by a batch transfer")
+	flags.IntVar(&apiConfig.MaxBalanceLookups, "max-balance-lookups", apiConfig.MaxBalanceLookups,
+		"maximum number of accounts whose balance can be looked up at once by administrators")
+	flags.IntVar(&apiConfig.DefaultPageSize, "default-page-size", apiConfig.DefaultPageSize,
+		"number of items returned by list routes when no limit is requested")
+	flags.IntVar(&apiConfig.MaxPageSize, "max-page-size", apiConfig.MaxPageSize,
+		"maximum number of items returned by list routes")
+	flags.DurationVar(&apiConfig.TransactionRetention, "transaction-retention", apiConfig.TransactionRetention,
+		"how long transactions are kept before they can be purged, 0 to only purge up to an explicit time")
+	flags.DurationVar(&apiConfig.RouteTimeout, "route-timeout", apiConfig.RouteTimeout,
+		"maximum time to serve a request, 0 for no maximum")
+	flags.StringToStringVar(&routeTimeouts, "route-timeouts", routeTimeouts,
+		"maximum time to serve the requests of given routes, e.g. /statement=5m")
+	flags.DurationVar(&apiConfig.MaxRequestTimeout, "max-request-timeout", apiConfig.MaxRequestTimeout,
+		"maximum timeout clients can set on their requests with X-Request-Timeout, 0 for no maximum")
+	flags.BoolVar(&apiConfig.PlaintextLogin, "plaintext-login", apiConfig.PlaintextLogin,
+		"allow logging in with the PIN itself, rather than only with the answer to a login challenge")
+	flags.DurationVar(&apiConfig.LoginChallengeLifetime, "login-challenge-lifetime", apiConfig.LoginChallengeLifetime,
+		"time during which a login challenge can be answered")
+	flags.IntVar(&apiConfig.MaxLoginChallenges, "max-login-challenges", apiConfig.MaxLoginChallenges,
+		"maximum number of login challenges pending at once, 0 for no maximum")
+	flags.DurationVar(&apiConfig.FreshAuthWindow, "fresh-auth-window", apiConfig.FreshAuthWindow,
+		"time after the PIN was checked during which a session can change the PIN, close the account or make large transfers, 0 to never require it")
+	flags.Int64Var(&apiConfig.LargeTransferAmount, "large-transfer-amount", apiConfig.LargeTransferAmount,
+		"total from which batch transfers require a fresh authentication, 0 to never require it")
+	flags.DurationVar(&apiConfig.IdempotencyTTL, "idempotency-ttl", apiConfig.IdempotencyTTL,
+		"time during which the response to a request made with an Idempotency-Key is replayed to its retries")
+	flags.StringVar(&idempotencyStore, "idempotency-store", idempotencyStore,
+		"where responses to requests made with an Idempotency-Key are kept, memory or db")
+	flags.StringVar(&apiConfig.AdminKey, "admin-key", apiConfig.AdminKey,
+		"API key for the /admin routes, admin routes are disabled if empty")
+	flags.StringVar(&apiConfig.Banner, "banner", apiConfig.Banner,
+		"service name reported on GET /")
+	flags.Var(&apiConfig.SessionMode, "session-mode",
+		"whether sessions are renewed on use (sliding) or expire at a fixed deadline (fixed)")
+	flags.DurationVar(&apiConfig.SessionGrace, "session-grace", apiConfig.SessionGrace,
+		"how long expired sliding sessions can still be used, being renewed when they are")
+	flags.DurationVar(&apiConfig.SessionClockSkew, "session-clock-skew", apiConfig.SessionClockSkew,
+		"clock drift tolerated between instances, sessions being honored until that long after they expire")
+	flags.DurationVar(&apiConfig.SessionSweepInterval, "session-sweep-interval", apiConfig.SessionSweepInterval,
+		"period at which expired sessions are removed, 0 to never remove them")
+	flags.BoolVar(&apiConfig.RevokeSessionsOnPINChange, "revoke-sessions-on-pin-change", apiConfig.RevokeSessionsOnPINChange,
+		"invalidate the other sessions of an account when its PIN is changed")
+	flags.BoolVar(&apiConfig.KeepSessionOnPINChange, "keep-session-on-pin-change", apiConfig.KeepSessionOnPINChange,
+		"keep the session the PIN was changed with when revoking sessions")
+	flags.StringVar(&apiConfig.SessionSnapshotPath, "session-snapshot", apiConfig.SessionSnapshotPath,
+		"file sessions are periodically saved to and restored from on startup, sessions are not saved if empty")
+	flags.DurationVar(&apiConfig.SessionSnapshotInterval, "session-snapshot-interval", apiConfig.SessionSnapshotInterval,
+		"period at which sessions are saved to the snapshot file")
+	flags.Int64SliceVar(&apiConfig.Denominations, "denominations", apiConfig.Denominations,
+		"values of the bills dispensed by the ATM")
+	flags.StringVar(&apiConfig.Currency, "currency", apiConfig.Currency,
+		"ISO 4217 code of the currency amounts are counted in, one of CAD, CHF, EUR, GBP, JPY or USD")
+	flags.Int64Var(&dbConfig.MaxWithdrawal, "max-withdrawal", dbConfig.MaxWithdrawal,
+		"default maximum amount of a single withdrawal, 0 for no maximum")
+	flags.Int64Var(&dbConfig.DailyWithdrawalLimit, "daily-withdrawal-limit", dbConfig.DailyWithdrawalLimit,
+		"default maximum total withdrawn, transferred and held from an account over the last 24 hours, 0 for no limit")
+	flags.IntVar(&apiConfig.MaxInFlightPerAccount, "max-in-flight-per-account", apiConfig.MaxInFlightPerAccount,
+		"maximum number of concurrent transactions per account, 0 for no maximum")
+	flags.IntVar(&apiConfig.MaxConcurrentRequests, "max-concurrent-requests", apiConfig.MaxConcurrentRequests,
+		"maximum number of requests served concurrently, further ones are rejected with 503; 0 for no maximum")
+	flags.BoolVar(&apiConfig.StrictDecoding, "strict-json", apiConfig.StrictDecoding,
+		"reject request bodies with unknown fields")
+	flags.StringVar(&apiConfig.ReceiptSecret, "receipt-secret", apiConfig.ReceiptSecret,
+		"key transaction receipts are signed with, receipts are not available if empty")
+	flags.BoolVar(&apiConfig.NoSniff, "no-sniff", apiConfig.NoSniff,
+		"send X-Content-Type-Options: nosniff on all responses")
+	flags.BoolVar(&apiConfig.NoStore, "no-store", apiConfig.NoStore,
+		"send Cache-Control: no-store on authenticated and admin responses")
+	flags.DurationVar(&apiConfig.HSTSMaxAge, "hsts-max-age", apiConfig.HSTSMaxAge,
+		"max-age of the Strict-Transport-Security header on TLS requests, 0 to disable")
+	flags.StringSliceVar(&trustedProxies, "trusted-proxies", trustedProxies,
+		"CIDRs of the reverse proxies trusted to report client addresses in X-Forwarded-For and X-Real-IP")
+	flags.StringVar(&tlsCert, "tls-cert", tlsCert,
+		"certificate file to serve over TLS and HTTP/2, with --tls-key")
+	flags.StringVar(&tlsKey, "tls-key", tlsKey,
+		"private key file of --tls-cert")
+	flags.BoolVar(&serveH2C, "h2c", serveH2C,
+		"serve HTTP/2 in cleartext (h2c) along with HTTP/1.1, when not serving over TLS")
+	flags.IntVar(&maxHeaderBytes, "max-header-bytes", maxHeaderBytes,
+		"maximum size of request headers, in bytes")
+	flags.DurationVar(&drainDelay, "drain-delay", drainDelay,
+		"time during which new requests are refused with 503 at shutdown, before the listener is closed")
+	flags.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout,
+		"time given to the requests being served to complete at shutdown")
+	flags.IntVar(&apiConfig.MaxHeaderCount, "max-header-count", apiConfig.MaxHeaderCount,
+		"maximum number of request headers, 0 for no maximum")
+	flags.StringVar(&natsURL, "nats-url", natsURL,
+		"URL of the NATS server transaction events are published to, events are not published if empty")
+	flags.StringVar(&natsSubject, "nats-subject", natsSubject,
+		"NATS subject transaction events are published on")
+	flags.StringVar(&persistenceMode, "persistence", persistenceMode,
+		"persistence layer, sqlite or memory; memory keeps everything in memory, for load tests")
+	flags.DurationVar(&dbConfig.SimulatedLatency, "simulated-latency", dbConfig.SimulatedLatency,
+		"delay added to every operation of the memory persistence layer, to mimic a database")
+	flags.StringVar(&dbConfig.Path, "db", dbConfig.Path,
+		"path to the SQLite database")
+	flags.DurationVar(&dbConfig.StartupTimeout, "db-startup-timeout", dbConfig.StartupTimeout,
+		"time to wait for the database to be ready on startup, with its schema created, 0 to not wait")
+	flags.BoolVar(&noDBLock, "no-db-lock", noDBLock,
+		"do not lock the database against use by other instances, for setups guarding it externally")
+	flags.Int64Var(&dbConfig.MinOpeningDeposit, "min-opening-deposit", dbConfig.MinOpeningDeposit,
+		"minimum initial balance of new accounts")
+	flags.IntVar(&dbConfig.BusyAttempts, "db-busy-attempts", dbConfig.BusyAttempts,
+		"number of attempts of a transaction when the database is busy")
+	flags.DurationVar(&dbConfig.BusyBackoff, "db-busy-backoff", dbConfig.BusyBackoff,
+		"delay before retrying a transaction on a busy database, doubled on every retry")
+	flags.DurationVar(&dbConfig.TempPINLifetime, "temp-pin-lifetime", dbConfig.TempPINLifetime,
+		"time during which a temporary PIN can be used")
+	flags.DurationVar(&dbConfig.HoldLifetime, "hold-lifetime", dbConfig.HoldLifetime,
+		"time after which uncaptured holds are released")
+	flags.DurationVar(&dbConfig.QueryTimeout, "db-query-timeout", dbConfig.QueryTimeout,
+		"maximum duration of a database operation, 0 for no maximum")
+	flags.IntVar(&dbConfig.BreakerThreshold, "db-breaker-threshold", dbConfig.BreakerThreshold,
+		"consecutive database failures after which requests fail fast, 0 to never fail fast")
+	flags.DurationVar(&dbConfig.BreakerCooldown, "db-breaker-cooldown", dbConfig.BreakerCooldown,
+		"time requests fail fast for before the database is probed again")
+	flags.Int64Var(&dbConfig.MinActiveBalance, "min-active-balance", dbConfig.MinActiveBalance,
+		"balance below which open accounts are flagged once they stay below it for --low-balance-period, 0 to never flag them")
+	flags.DurationVar(&dbConfig.LowBalancePeriod, "low-balance-period", dbConfig.LowBalancePeriod,
+		"time an account must stay below --min-active-balance to be flagged")
+	flags.DurationVar(&dbConfig.LowBalanceCheckInterval, "low-balance-check-interval", dbConfig.LowBalanceCheckInterval,
+		"interval at which accounts below --min-active-balance are checked, 0 to never check them automatically")
+	flags.DurationVar(&dbConfig.MaintenanceInterval, "db-maintenance-interval", dbConfig.MaintenanceInterval,
+		"interval at which the database is vacuumed and analyzed, 0 to never do it automatically")
+	flags.Int64Var(&businessHoursThreshold, "business-hours-threshold", businessHoursThreshold,
+		"amount above which withdrawals are only allowed during --business-hours, 0 to allow them at any time")
+	flags.StringVar(&businessHours, "business-hours", businessHours,
+		"daily window large withdrawals are allowed in, as HH:MM-HH:MM")
+	flags.StringVar(&businessHoursTimezone, "business-hours-timezone", businessHoursTimezone,
+		"time zone of --business-hours, e.g. Europe/Paris")
+	flags.DurationVar(&dbConfig.WithdrawalCooldown, "withdrawal-cooldown", dbConfig.WithdrawalCooldown,
+		"default minimum time between two withdrawals, transfers or holds from an account")
+	flags.StringSliceVar(&dbConfig.WeakPINs, "weak-pins", dbConfig.WeakPINs,
+		"PINs rejected as too weak when set on accounts, empty to accept any PIN")
+	flags.IntSliceVar(&dbConfig.AllowedAccounts, "allowed-accounts", dbConfig.AllowedAccounts,
+		"accounts allowed to log in, all accounts are allowed if empty")
 }
 
 func main() {
-	rootCmd.Execute()
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
 func doMain(cmd *cobra.Command, args []string) error {
-	db, err := persistence.NewDB()
+	proxies, err := api.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	apiConfig.TrustedProxies = proxies
+
+	apiConfig.RouteTimeouts, err = api.ParseRouteTimeouts(routeTimeouts)
+	if err != nil {
+		return fmt.Errorf("invalid route timeouts: %w", err)
+	}
+
+	apiConfig.Currency, err = api.ParseCurrency(apiConfig.Currency)
 	if err != nil {
 		return err
 	}
 
-	srv := api.NewServer(db)
-	return http.ListenAndServe("0.0.0.0:8080", srv)
+	if (tlsCert == "") != (tlsKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+
+	if serveH2C && tlsCert != "" {
+		return fmt.Errorf("--h2c cannot be used with TLS, which negotiates HTTP/2 itself")
+	}
+
+	if businessHoursThreshold > 0 {
+		dbConfig.BusinessHours, err = persistence.ParseBusinessHours(businessHours, businessHoursTimezone, businessHoursThreshold)
+		if err != nil {
+			return err
+		}
+	}
+
+	if persistenceMode != "sqlite" && persistenceMode != "memory" {
+		return fmt.Errorf("invalid persistence %q, expected sqlite or memory", persistenceMode)
+	}
+
+	if idempotencyStore != "memory" && idempotencyStore != "db" {
+		return fmt.Errorf("invalid idempotency store %q, expected memory or db", idempotencyStore)
+	}
+
+	if idempotencyStore == "db" && persistenceMode != "sqlite" {
+		return fmt.Errorf("--idempotency-store=db requires the sqlite persistence")
+	}
+
+	if persistenceMode == "sqlite" && !noDBLock {
+		unlock, err := persistence.LockDB(dbConfig.Path)
+		if err != nil {
+			return fmt.Errorf("failed to lock database %s, is another instance running? %w", dbConfig.Path, err)
+		}
+		defer unlock()
+	}
+
+	if natsURL != "" {
+		publisher, err := events.NewNATSPublisher(natsURL, natsSubject)
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS server: %w", err)
+		}
+		defer publisher.Close()
+
+		dbConfig.Events = publisher
+	}
+
+	deps := api.Deps{}
+	if persistenceMode == "memory" {
+		log.Warn().Msg("using the memory persistence layer, data will be lost on exit")
+		deps.Store = persistence.NewMemory(dbConfig)
+	} else {
+		db, err := persistence.NewDB(dbConfig)
+		if err != nil {
+			return err
+		}
+		if dbConfig.StartupTimeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), dbConfig.StartupTimeout)
+			err = db.WaitReady(ctx)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("database %s: %w", dbConfig.Path, err)
+			}
+		}
+		deps.Store = db
+		if idempotencyStore == "db" {
+			deps.Idempotency = db
+		}
+
+		if dbConfig.MaintenanceInterval > 0 {
+			go db.MaintainEvery(dbConfig.MaintenanceInterval)
+		}
+		if dbConfig.MinActiveBalance > 0 && dbConfig.LowBalanceCheckInterval > 0 {
+			go db.FlagLowBalancesEvery(dbConfig.LowBalanceCheckInterval)
+		}
+	}
+
+	srv := api.NewServerWithDeps(deps, apiConfig)
+	err = srv.RestoreSessions()
+	if err != nil {
+		return fmt.Errorf("failed to restore sessions: %w", err)
+	}
+
+	logConfig()
+
+	var handler http.Handler = srv
+	if serveH2C {
+		// The limits of httpSrv, like MaxHeaderBytes, apply to HTTP/2
+		// connections as well
+		handler = h2c.NewHandler(srv, &http2.Server{})
+	}
+
+	httpSrv := &http.Server{
+		Addr:           listenAddr,
+		Handler:        handler,
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsCert != "" {
+			serveErr <- httpSrv.ListenAndServeTLS(tlsCert, tlsKey)
+			return
+		}
+		serveErr <- httpSrv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Info().Stringer("signal", sig).Msg("shutting down")
+	}
+
+	return shutdown(srv, httpSrv)
+}
+
+// shutdown drains `srv', refusing new requests for drainDelay, then stops
+// `httpSrv' once the requests being served complete, or cuts them off after
+// shutdownTimeout
+func shutdown(srv *api.Server, httpSrv *http.Server) error {
+	srv.Drain()
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := httpSrv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Warn().Dur("shutdown_timeout", shutdownTimeout).Msg("requests still in progress at shutdown, closing connections")
+		return httpSrv.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msg("shut down")
+	return nil
+}
+
+// redacted stands for the value of a secret setting
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "[redacted]"
+}
+
+// logConfig logs the effective configuration of the service, without its
+// secrets
+func logConfig() {
+	log.Info().
+		Str("version", version.Version).
+		Str("addr", listenAddr).
+		Str("persistence", persistenceMode).
+		Dur("simulated_latency", dbConfig.SimulatedLatency).
+		Str("db_path", dbConfig.Path).
+		Bool("db_lock", !noDBLock).
+		Dur("db_query_timeout", dbConfig.QueryTimeout).
+		Dur("db_startup_timeout", dbConfig.StartupTimeout).
+		Int("db_busy_attempts", dbConfig.BusyAttempts).
+		Int("db_breaker_threshold", dbConfig.BreakerThreshold).
+		Dur("db_maintenance_interval", dbConfig.MaintenanceInterval).
+		Int64("min_active_balance", dbConfig.MinActiveBalance).
+		Dur("low_balance_period", dbConfig.LowBalancePeriod).
+		Dur("low_balance_check_interval", dbConfig.LowBalanceCheckInterval).
+		Bool("plaintext_login", apiConfig.PlaintextLogin).
+		Int("max_login_challenges", apiConfig.MaxLoginChallenges).
+		Dur("fresh_auth_window", apiConfig.FreshAuthWindow).
+		Int64("large_transfer_amount", apiConfig.LargeTransferAmount).
+		Str("idempotency_store", idempotencyStore).
+		Dur("idempotency_ttl", apiConfig.IdempotencyTTL).
+		Dur("session_lifetime", api.SessionLifetime).
+		Stringer("session_mode", apiConfig.SessionMode).
+		Dur("session_grace", apiConfig.SessionGrace).
+		Dur("session_clock_skew", apiConfig.SessionClockSkew).
+		Str("session_snapshot", apiConfig.SessionSnapshotPath).
+		Int64("min_opening_deposit", dbConfig.MinOpeningDeposit).
+		Int64("max_withdrawal", dbConfig.MaxWithdrawal).
+		Int64("daily_withdrawal_limit", dbConfig.DailyWithdrawalLimit).
+		Int64("business_hours_threshold", businessHoursThreshold).
+		Str("business_hours", businessHours).
+		Str("business_hours_timezone", businessHoursTimezone).
+		Ints64("denominations", apiConfig.Denominations).
+		Str("currency", apiConfig.Currency).
+		Dur("withdrawal_cooldown", dbConfig.WithdrawalCooldown).
+		Int("max_batch_recipients", apiConfig.MaxBatchRecipients).
+		Int("max_in_flight_per_account", apiConfig.MaxInFlightPerAccount).
+		Int("max_concurrent_requests", apiConfig.MaxConcurrentRequests).
+		Ints("allowed_accounts", dbConfig.AllowedAccounts).
+		Bool("tls", tlsCert != "").
+		Bool("h2c", serveH2C).
+		Int("max_header_bytes", maxHeaderBytes).
+		Dur("drain_delay", drainDelay).
+		Dur("shutdown_timeout", shutdownTimeout).
+		Bool("events", natsURL != "").
+		Str("nats_subject", natsSubject).
+		Int("max_header_count", apiConfig.MaxHeaderCount).
+		Str("admin_key", redacted(apiConfig.AdminKey)).
+		Str("receipt_secret", redacted(apiConfig.ReceiptSecret)).
+		Msg("starting service")
 }
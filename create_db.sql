@@ -1,13 +1,107 @@
+PRAGMA user_version = 9;
+
 CREATE TABLE IF NOT EXISTS users (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	pin char(4),
-	balance int
+	card_number varchar(19) UNIQUE,
+	balance int,
+	closed_at int,
+	external_ref varchar(64) UNIQUE,
+	temp_pin char(4),
+	temp_pin_expires_at int
 );
 
+-- Temporary PINs authenticate to a single account; expired ones are cleared
+-- before new ones are issued
+CREATE UNIQUE INDEX IF NOT EXISTS users_temp_pin ON users(temp_pin);
+
+-- The type of a transaction is its TransactionType, transfers between
+-- accounts being recorded with a type of their own
 CREATE TABLE IF NOT EXISTS transactions (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type int NOT NULL,
 	amount int,
 	user int,
+	created_at int NOT NULL DEFAULT (strftime('%s', 'now')),
+	category varchar(32),
+
+	FOREIGN KEY(user) REFERENCES users(id)
+);
+
+-- Histories and summaries select the transactions of an account over a
+-- period; the index also serves the lookups by account alone
+CREATE INDEX IF NOT EXISTS transactions_user_created_at ON transactions(user, created_at);
+-- Purges select the transactions of all accounts before a cutoff
+CREATE INDEX IF NOT EXISTS transactions_created_at ON transactions(created_at);
+
+CREATE TABLE IF NOT EXISTS holds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	amount int,
+	user int,
+	created_at int NOT NULL,
+	expires_at int NOT NULL,
+
+	FOREIGN KEY(user) REFERENCES users(id)
+);
+
+-- Reasons of the adjustments made to balances by administrators, as an audit
+-- trail of the corrections
+CREATE TABLE IF NOT EXISTS adjustments (
+	transaction_id int PRIMARY KEY,
+	reason varchar(255) NOT NULL,
+
+	FOREIGN KEY(transaction_id) REFERENCES transactions(id)
+);
+
+-- Withdrawal limits overriding the configured defaults for an account, NULL
+-- ones falling back to the defaults
+CREATE TABLE IF NOT EXISTS account_limits (
+	user int PRIMARY KEY,
+	max_withdrawal int,
+	daily_withdrawal int,
+	withdrawal_cooldown_ms int,
+
+	FOREIGN KEY(user) REFERENCES users(id)
+);
+
+-- Open accounts found below the minimum active balance since `since', and
+-- flagged at `flagged_at' once they stayed below it for the configured period
+CREATE TABLE IF NOT EXISTS low_balances (
+	user int PRIMARY KEY,
+	since int NOT NULL,
+	flagged_at int,
+
+	FOREIGN KEY(user) REFERENCES users(id)
+);
+
+-- Transactions purged by retention are folded into the opening balance of
+-- their account, as of the purge cutoff
+CREATE TABLE IF NOT EXISTS opening_balances (
+	user int PRIMARY KEY,
+	balance int NOT NULL,
+	as_of int NOT NULL,
+
+	FOREIGN KEY(user) REFERENCES users(id)
+);
+
+-- Responses to requests made with an idempotency key, replayed on retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key varchar(255) PRIMARY KEY,
+	fingerprint char(64) NOT NULL,
+	status int NOT NULL,
+	content_type varchar(255) NOT NULL DEFAULT '',
+	body blob,
+	expires_at int NOT NULL
+);
+
+-- Administrative actions, as an audit trail of what administrators did; the
+-- account is NULL for actions on none, and the detail never holds secrets
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action varchar(32) NOT NULL,
+	user int,
+	created_at int NOT NULL,
+	detail text NOT NULL DEFAULT '',
 
 	FOREIGN KEY(user) REFERENCES users(id)
 );
@@ -5,11 +5,17 @@ go 1.17
 require (
 	github.com/google/uuid v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.12
+	github.com/nats-io/nats.go v1.13.0
 	github.com/rs/zerolog v1.26.1
 	github.com/spf13/cobra v1.4.0
+	golang.org/x/net v0.0.0-20220325170049-de3da57026de
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/nats-io/nkeys v0.3.0 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e // indirect
+	golang.org/x/text v0.3.7 // indirect
 )
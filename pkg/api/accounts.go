@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+type closeAccountRequest struct {
+	// PayoutTo is the account the remaining balance is transferred to,
+	// required unless the balance is zero
+	PayoutTo *persistence.Account `json:"payout_to"`
+}
+
+type closeAccountResponse struct {
+	PaidOut int64 `json:"paid_out"`
+}
+
+// closeOwnAccount closes the account of the session on POST /accounts/close
+//
+// The remaining balance is transferred to the account given as `payout_to',
+// and every session of the account is revoked. The body can be omitted when
+// the balance is zero.
+func (s *Server) closeOwnAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	req := closeAccountRequest{}
+	if r.ContentLength != 0 {
+		if !s.requireJSON(w, r) {
+			return
+		}
+
+		err := s.decodeJSON(r.Body, &req)
+		if err != nil && !errors.Is(err, errEmptyBody) {
+			log.Error().Err(err).Msg("failed to decode account closing")
+			s.writeDecodeError(w, r, err, "invalid account closing")
+			return
+		}
+	}
+
+	if req.PayoutTo != nil && *req.PayoutTo == sess.Account {
+		s.writeError(w, r, 400, "cannot pay out to the account being closed")
+		return
+	}
+
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
+	}
+	defer s.inFlight.release(sess.Account)
+
+	paidOut := int64(0)
+	var err error
+	if req.PayoutTo != nil {
+		paidOut, err = s.db.CloseAccountWithPayout(sess.Account, *req.PayoutTo)
+	} else {
+		err = s.db.CloseAccount(sess.Account)
+	}
+	if errors.Is(err, persistence.ErrNonZeroBalance) {
+		if req.PayoutTo == nil {
+			s.writeError(w, r, 409, "account balance is not zero, a payout_to account is required")
+		} else {
+			s.writeError(w, r, 409, "account has funds on hold")
+		}
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to close account")
+		s.writeTransactionError(w, r, err, "failed to close account")
+		return
+	}
+
+	revoked := s.as.RevokeAccountSessions(sess.Account, uuid.Nil)
+	log.Info().Int("account_id", int(sess.Account)).Int64("paid_out", paidOut).
+		Int("revoked_sessions", revoked).Msg("account closed by its owner")
+
+	s.writeResponse(w, r, 200, closeAccountResponse{
+		PaidOut: paidOut,
+	})
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+type adjustmentRequest struct {
+	// Amount is signed, negative adjustments decreasing the balance
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// adjustBalance corrects the balance of `acc' by a signed amount on POST
+// /admin/accounts/{id}/adjust, e.g. after a failed external settlement
+//
+// The adjustment is recorded as a transaction of its own, along with its
+// reason, which is required.
+func (s *Server) adjustBalance(w http.ResponseWriter, r *http.Request, acc persistence.Account) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
+		return
+	}
+
+	var req adjustmentRequest
+	err := s.decodeJSON(r.Body, &req)
+	if err != nil {
+		logError(err).Msg("failed to decode adjustment")
+		s.writeDecodeError(w, r, err, "invalid adjustment")
+		return
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		s.writeError(w, r, 400, "a reason is required")
+		return
+	}
+
+	if len(req.Reason) > persistence.MaxReasonLength {
+		s.writeErrorf(w, r, 400, "reason longer than %d bytes", persistence.MaxReasonLength)
+		return
+	}
+
+	if req.Amount == 0 {
+		s.writeError(w, r, 400, "invalid amount")
+		return
+	}
+
+	id, err := s.db.DoTransaction(r.Context(), acc, persistence.Transaction{
+		Type:   persistence.Adjustment,
+		Amount: req.Amount,
+		Reason: req.Reason,
+	})
+	if err != nil {
+		logError(err).Int("account_id", int(acc)).Msg("failed to adjust balance")
+		s.writeTransactionError(w, r, err, "failed to adjust balance")
+		return
+	}
+
+	log.Info().Int("account_id", int(acc)).Int64("transaction_id", id).Int64("amount", req.Amount).
+		Str("reason", req.Reason).Msg("balance adjusted")
+	s.recordAudit("adjust", acc, fmt.Sprintf("%+d: %s", req.Amount, req.Reason))
+
+	s.writeResponse(w, r, 201, transactionIDResponse{
+		TransactionID: id,
+	})
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdjustBalance(t *testing.T) {
+	srv, store := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+	acc := createAccount(t, store, "4623", 500)
+
+	tests := []struct {
+		name, body string
+		want       int
+		// balance is the balance of the account after the adjustment
+		balance int64
+	}{
+		{"positive", `{"amount":50,"reason":"failed settlement"}`, 201, 550},
+		{"negative", `{"amount":-200,"reason":"failed settlement"}`, 201, 350},
+		{"without reason", `{"amount":50}`, 400, 350},
+		{"blank reason", `{"amount":50,"reason":"  "}`, 400, 350},
+		{"zero amount", `{"amount":0,"reason":"failed settlement"}`, 400, 350},
+		{"insufficient funds", `{"amount":-1000,"reason":"failed settlement"}`, 422, 350},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := adminRequest(http.MethodPost, "/admin/accounts/1/adjust", "secret", test.body)
+			wantStatus(t, serve(srv, r), test.want)
+
+			balance, err := store.Balance(acc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != test.balance {
+				t.Errorf("balance = %d, want %d", balance, test.balance)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+// AdminKeyHeader is the header administrators pass their API key in
+const AdminKeyHeader = "X-Admin-Key"
+
+// AdminAuth authenticates administrators before processing requests on admin
+// routes
+//
+// It is independent from the customer sessions handled by AuthServer: admin
+// requests are authenticated by a static API key, sent on every request.
+type AdminAuth struct {
+	Key     string
+	Wrapped http.Handler
+	// Proxies are trusted to report the address of clients, which is logged
+	// on failed authentications
+	Proxies TrustedProxies
+	// Clock tells the server time of error responses
+	Clock clock.Clock
+}
+
+// NewAdminAuth returns a new instance of AdminAuth
+//
+// If `key' is empty, all admin requests are rejected.
+func NewAdminAuth(key string, wrapped http.Handler) AdminAuth {
+	return AdminAuth{
+		Key:     key,
+		Wrapped: wrapped,
+		Clock:   clock.System,
+	}
+}
+
+// ServeHTTP checks the admin key before processing the request
+func (aa AdminAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(AdminKeyHeader)
+	if key == "" {
+		log.Error().Str("client_ip", aa.Proxies.ClientIP(r)).Msg("missing admin key header")
+		writeErrorAt(w, r, aa.Clock.Now(), 401, "unauthorized")
+		return
+	}
+
+	if aa.Key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(aa.Key)) != 1 {
+		log.Error().Str("client_ip", aa.Proxies.ClientIP(r)).Msg("invalid admin key")
+		writeErrorAt(w, r, aa.Clock.Now(), 401, "unauthorized")
+		return
+	}
+
+	aa.Wrapped.ServeHTTP(w, r)
+}
+
+// parseAccountPath extracts the account and the action from paths of the form
+// `<prefix><account>[/<action>]'
+func parseAccountPath(prefix, path string) (persistence.Account, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || !persistence.Account(id).IsValid() {
+		return persistence.NoAccount, "", false
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	return persistence.Account(id), action, true
+}
+
+type createAccountRequest struct {
+	PIN        string `json:"pin"`
+	CardNumber string `json:"card_number"`
+	Balance    int64  `json:"balance"`
+	// ExternalRef identifies the account in upstream systems, creations with
+	// the same reference return the same account
+	ExternalRef string `json:"external_ref"`
+}
+
+type createAccountResponse struct {
+	ID persistence.Account `json:"id"`
+}
+
+// createAccount creates an account on POST /admin/accounts
+//
+// Responds with 201 when the account is created, and 200 when an account
+// already exists with the external reference of the request.
+func (s *Server) createAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
+		return
+	}
+
+	req := createAccountRequest{}
+	err := s.decodeJSON(r.Body, &req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode account creation")
+		s.writeDecodeError(w, r, err, "invalid account")
+		return
+	}
+
+	if req.PIN == "" || req.CardNumber == "" {
+		s.writeError(w, r, 400, "pin and card_number are required")
+		return
+	}
+
+	acc, created, err := s.db.CreateAccount(req.PIN, req.CardNumber, req.ExternalRef, req.Balance)
+	if errors.Is(err, persistence.ErrDuplicateCard) {
+		s.writeError(w, r, 409, "card number already in use")
+		return
+	}
+	if errors.Is(err, persistence.ErrPINInUse) {
+		s.writeError(w, r, 409, "PIN already in use")
+		return
+	}
+	if errors.Is(err, persistence.ErrInvalidTransaction) || errors.Is(err, persistence.ErrAmountOverflow) {
+		s.writeError(w, r, 400, "invalid initial balance")
+		return
+	}
+	if errors.Is(err, persistence.ErrBelowMinimumDeposit) {
+		s.writeError(w, r, 400, "initial balance below minimum deposit")
+		return
+	}
+	if errors.Is(err, persistence.ErrWeakPIN) {
+		s.writeError(w, r, 400, "PIN too weak")
+		return
+	}
+	if err != nil {
+		logError(err).Msg("failed to create account")
+		s.writeInternalError(w, r, err, "failed to create account")
+		return
+	}
+
+	status := 200
+	if created {
+		status = 201
+		s.recordAudit("create", acc, "")
+	}
+	s.writeResponse(w, r, status, createAccountResponse{
+		ID: acc,
+	})
+}
+
+type accountInfoResponse struct {
+	ID       persistence.Account `json:"id"`
+	Balance  int64               `json:"balance"`
+	ClosedAt *time.Time          `json:"closed_at,omitempty"`
+}
+
+// adminAccount serves the admin routes operating on a single account:
+//
+//	GET /admin/accounts/{id}: the state of the account
+//	POST /admin/accounts/{id}/close: closes the account
+//	POST /admin/accounts/{id}/reopen: reopens a closed account
+//	POST /admin/accounts/{id}/temp-pin: issues a temporary PIN
+//	POST /admin/accounts/{id}/adjust: corrects the balance, with a reason
+func (s *Server) adminAccount(w http.ResponseWriter, r *http.Request) {
+	acc, action, ok := parseAccountPath("/admin/accounts/", r.URL.Path)
+	if !ok {
+		s.writeError(w, r, 404, "not found")
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			s.writeError(w, r, 405, "not allowed")
+			return
+		}
+		s.getAccountInfo(w, r, acc)
+	case "close", "reopen":
+		if r.Method != http.MethodPost {
+			s.writeError(w, r, 405, "not allowed")
+			return
+		}
+		s.setAccountClosed(w, r, acc, action == "close")
+	case "temp-pin":
+		if r.Method != http.MethodPost {
+			s.writeError(w, r, 405, "not allowed")
+			return
+		}
+		s.issueTempPIN(w, r, acc)
+	case "limits":
+		s.adminAccountLimits(w, r, acc)
+	case "adjust":
+		s.adjustBalance(w, r, acc)
+	default:
+		s.writeError(w, r, 404, "not found")
+	}
+}
+
+func (s *Server) getAccountInfo(w http.ResponseWriter, r *http.Request, acc persistence.Account) {
+	info, err := s.db.AccountInfo(acc)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such account")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(acc)).Msg("failed to get account info")
+		s.writeInternalError(w, r, err, "failed to get account")
+		return
+	}
+
+	resp := accountInfoResponse{
+		ID:      info.ID,
+		Balance: info.Balance,
+	}
+	if info.IsClosed() {
+		resp.ClosedAt = &info.ClosedAt
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+func (s *Server) setAccountClosed(w http.ResponseWriter, r *http.Request, acc persistence.Account, closed bool) {
+	var err error
+	if closed {
+		err = s.db.CloseAccount(acc)
+	} else {
+		err = s.db.ReopenAccount(acc)
+	}
+
+	switch {
+	case err == nil:
+		action := "reopen"
+		if closed {
+			action = "close"
+		}
+		s.recordAudit(action, acc, "")
+		fmt.Fprint(w, "ok")
+	case errors.Is(err, persistence.ErrNoAccount):
+		s.writeError(w, r, 404, "no such account")
+	case errors.Is(err, persistence.ErrAccountClosed):
+		s.writeError(w, r, 409, "account already closed")
+	case errors.Is(err, persistence.ErrNonZeroBalance):
+		s.writeError(w, r, 409, "account balance must be zero to be closed")
+	default:
+		logError(err).Int("account_id", int(acc)).Msg("failed to change account state")
+		s.writeInternalError(w, r, err, "failed to change account state")
+	}
+}
+
+type tempPINResponse struct {
+	PIN       string    `json:"pin"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Server) issueTempPIN(w http.ResponseWriter, r *http.Request, acc persistence.Account) {
+	pin, expiresAt, err := s.db.IssueTempPIN(acc)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such open account")
+		return
+	}
+	if errors.Is(err, persistence.ErrNoTempPINAvailable) {
+		log.Error().Err(err).Int("account_id", int(acc)).Msg("failed to issue temporary PIN")
+		s.writeError(w, r, 503, "no temporary PIN available")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(acc)).Msg("failed to issue temporary PIN")
+		s.writeInternalError(w, r, err, "failed to issue temporary PIN")
+		return
+	}
+
+	// The temporary PIN itself is never recorded
+	s.recordAudit("temp-pin", acc, "")
+
+	s.writeResponse(w, r, 201, tempPINResponse{
+		PIN:       pin,
+		ExpiresAt: expiresAt,
+	})
+}
+
+type balancesResponse struct {
+	Balances map[string]int64 `json:"balances"`
+	Missing  []int            `json:"missing"`
+}
+
+// adminBalances outputs the balances of the accounts listed in the `accounts'
+// parameter on GET /admin/balances?accounts=1,2,3
+func (s *Server) adminBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	accs := []persistence.Account{}
+	if param := r.URL.Query().Get("accounts"); param != "" {
+		for _, field := range strings.Split(param, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || !persistence.Account(id).IsValid() {
+				s.writeErrorf(w, r, 400, "invalid account: %q", field)
+				return
+			}
+			accs = append(accs, persistence.Account(id))
+		}
+	}
+
+	if len(accs) > s.cfg.MaxBalanceLookups {
+		s.writeErrorf(w, r, 400, "too many accounts, at most %d allowed", s.cfg.MaxBalanceLookups)
+		return
+	}
+
+	balances, err := s.db.BalanceMany(accs)
+	if err != nil {
+		logError(err).Msg("failed to look up balances")
+		s.writeInternalError(w, r, err, "failed to look up balances")
+		return
+	}
+
+	resp := balancesResponse{
+		Balances: map[string]int64{},
+		Missing:  []int{},
+	}
+	for _, acc := range accs {
+		balance, ok := balances[acc]
+		if !ok {
+			resp.Missing = append(resp.Missing, int(acc))
+			continue
+		}
+		resp.Balances[strconv.Itoa(int(acc))] = balance
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+type purgeRequest struct {
+	// Before is the time before which transactions are purged, now minus
+	// TransactionRetention if nil
+	Before *time.Time `json:"before"`
+}
+
+type purgeResponse struct {
+	Before time.Time `json:"before"`
+	Purged int64     `json:"purged"`
+}
+
+// adminPurgeTransactions purges the transactions older than the retention
+// period, or than `before' if given in the body, POST only
+func (s *Server) adminPurgeTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	req := purgeRequest{}
+	if r.ContentLength != 0 {
+		if !s.requireJSON(w, r) {
+			return
+		}
+
+		err := s.decodeJSON(r.Body, &req)
+		if err != nil && !errors.Is(err, errEmptyBody) {
+			log.Error().Err(err).Msg("failed to decode purge request")
+			s.writeDecodeError(w, r, err, "invalid purge request")
+			return
+		}
+	}
+
+	now := s.clock.Now()
+	before := time.Time{}
+	switch {
+	case req.Before != nil:
+		before = *req.Before
+	case s.cfg.TransactionRetention > 0:
+		before = now.Add(-s.cfg.TransactionRetention)
+	default:
+		s.writeError(w, r, 400, "no retention period configured, a `before' time is required")
+		return
+	}
+
+	if s.cfg.TransactionRetention > 0 && before.After(now.Add(-s.cfg.TransactionRetention)) {
+		s.writeError(w, r, 400, "cannot purge transactions within the retention period")
+		return
+	}
+
+	purged, err := s.db.PurgeTransactions(before)
+	if err != nil {
+		logError(err).Msg("failed to purge transactions")
+		s.writeInternalError(w, r, err, "failed to purge transactions")
+		return
+	}
+
+	log.Info().Time("before", before).Int64("purged", purged).Msg("transactions purged")
+	s.recordAudit("purge", persistence.NoAccount, fmt.Sprintf("%d transactions before %s", purged, before.UTC().Format(time.RFC3339)))
+
+	s.writeResponse(w, r, 200, purgeResponse{
+		Before: before.UTC(),
+		Purged: purged,
+	})
+}
+
+type revokedSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// adminRevokeSessions forces the logout of an account on DELETE
+// /admin/sessions/{id}, by revoking all its sessions, and outputs how many
+// were revoked
+func (s *Server) adminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	acc, action, ok := parseAccountPath("/admin/sessions/", r.URL.Path)
+	if !ok || action != "" {
+		s.writeError(w, r, 404, "not found")
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	revoked := s.as.RevokeAccountSessions(acc, uuid.Nil)
+	log.Info().Int("account_id", int(acc)).Int("revoked", revoked).Msg("sessions revoked by administrator")
+	s.recordAudit("revoke-sessions", acc, fmt.Sprintf("%d sessions", revoked))
+
+	s.writeResponse(w, r, 200, revokedSessionsResponse{
+		Revoked: revoked,
+	})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+// adminRequest returns a request to the admin route `target', with the admin
+// key `key' unless empty
+func adminRequest(method, target, key, body string) *http.Request {
+	r := newRequest(method, target, "", body)
+	if key != "" {
+		r.Header.Set(AdminKeyHeader, key)
+	}
+
+	return r
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv, _ := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+
+	tests := []struct {
+		name, key string
+		want      int
+	}{
+		{"missing key", "", 401},
+		{"invalid key", "wrong", 401},
+		{"key prefix", "secre", 401},
+		{"valid key", "secret", 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantStatus(t, serve(srv, adminRequest(http.MethodGet, "/admin/stats", test.key, "")), test.want)
+		})
+	}
+}
+
+func TestAdminAuthWithoutKey(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+
+	// Admin routes are disabled when no key is configured, even for an
+	// empty key
+	for _, key := range []string{"", "secret"} {
+		wantStatus(t, serve(srv, adminRequest(http.MethodGet, "/admin/stats", key, "")), 401)
+	}
+}
+
+func TestAdminAuthIgnoresSessions(t *testing.T) {
+	srv, store := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+	createAccount(t, store, "4623", 0)
+
+	// Customer sessions do not grant access to admin routes
+	r := newRequest(http.MethodGet, "/admin/stats", login(t, srv, "4623"), "")
+	wantStatus(t, serve(srv, r), 401)
+}
+
+func TestCreateAccountConflicts(t *testing.T) {
+	srv, store := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+	createAccount(t, store, "4623", 0)
+
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"created", `{"pin":"8264","card_number":"4970100000000001","balance":0}`, 201},
+		{"card in use", `{"pin":"7391","card_number":"4970104623000000","balance":0}`, 409},
+		{"PIN in use", `{"pin":"4623","card_number":"4970100000000002","balance":0}`, 409},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantStatus(t, serve(srv, adminRequest(http.MethodPost, "/admin/accounts", "secret", test.body)), test.want)
+		})
+	}
+
+	// The first account still logs in with its PIN
+	login(t, srv, "4623")
+}
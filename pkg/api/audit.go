@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// recordAudit records the administrative action `action' on `acc', NoAccount
+// for actions on none, in the audit log
+//
+// The action being already done, failing to record it is only logged.
+// `detail' must not hold secrets, such as PINs or session tokens.
+func (s *Server) recordAudit(action string, acc persistence.Account, detail string) {
+	_, err := s.db.RecordAudit(persistence.AuditEntry{
+		Action:  action,
+		Account: acc,
+		Detail:  detail,
+	})
+	if err != nil {
+		logError(err).Str("action", action).Int("account_id", int(acc)).Msg("failed to record audit entry")
+	}
+}
+
+type auditEntryResponse struct {
+	ID        int64     `json:"id"`
+	Action    string    `json:"action"`
+	AccountID *int      `json:"account_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+type auditResponse struct {
+	Entries []auditEntryResponse `json:"entries"`
+	Limit   int                  `json:"limit"`
+	Offset  int                  `json:"offset"`
+}
+
+// adminAudit outputs the audit log on GET /admin/audit, newest first,
+// filtered by `?account=', `?action=', and the RFC 3339 `?from=' and `?to=',
+// and paginated with `?limit=' and `?offset='
+func (s *Server) adminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	filter := persistence.AuditFilter{
+		Action: r.URL.Query().Get("action"),
+	}
+
+	if param := r.URL.Query().Get("account"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil || !persistence.Account(id).IsValid() {
+			s.writeErrorf(w, r, 400, "invalid account: %q", param)
+			return
+		}
+		filter.Account = persistence.Account(id)
+	}
+
+	from, ok := s.parseTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+
+	to, ok := s.parseTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+	filter.From, filter.To = from, to
+
+	limit, offset, ok := s.parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := s.db.ListAudit(filter, limit, offset)
+	if err != nil {
+		logError(err).Msg("failed to list audit log")
+		s.writeInternalError(w, r, err, "failed to list audit log")
+		return
+	}
+
+	resp := auditResponse{
+		Entries: make([]auditEntryResponse, 0, len(entries)),
+		Limit:   limit,
+		Offset:  offset,
+	}
+	for _, entry := range entries {
+		entryResp := auditEntryResponse{
+			ID:        entry.ID,
+			Action:    entry.Action,
+			CreatedAt: entry.CreatedAt,
+			Detail:    entry.Detail,
+		}
+		if entry.Account.IsValid() {
+			id := int(entry.Account)
+			entryResp.AccountID = &id
+		}
+		resp.Entries = append(resp.Entries, entryResp)
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
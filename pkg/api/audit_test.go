@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// listAudit returns the actions of the audit log entries output by GET
+// `target'
+func listAudit(t *testing.T, srv *Server, target string) []string {
+	t.Helper()
+
+	w := serve(srv, adminRequest(http.MethodGet, target, "secret", ""))
+	wantStatus(t, w, 200)
+
+	var env struct {
+		Data auditResponse `json:"data"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []string{}
+	for _, entry := range env.Data.Entries {
+		actions = append(actions, entry.Action)
+	}
+
+	return actions
+}
+
+func TestAdminAudit(t *testing.T) {
+	srv, store := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+	createAccount(t, store, "4623", 500)
+	createAccount(t, store, "8264", 0)
+
+	requests := []struct {
+		target, body string
+		want         int
+	}{
+		{"/admin/accounts/2/temp-pin", "", 201},
+		{"/admin/accounts/1/adjust", `{"amount":-50,"reason":"failed settlement"}`, 201},
+		{"/admin/accounts/2/close", "", 200},
+		{"/admin/maintenance", `{"enabled":true}`, 200},
+		// Failed actions are not recorded
+		{"/admin/accounts/1/close", "", 409},
+	}
+
+	tempPIN := ""
+	for _, req := range requests {
+		w := serve(srv, adminRequest(http.MethodPost, req.target, "secret", req.body))
+		wantStatus(t, w, req.want)
+
+		if strings.HasSuffix(req.target, "/temp-pin") {
+			var env struct {
+				Data tempPINResponse `json:"data"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tempPIN = env.Data.PIN
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"maintenance", "close", "adjust", "temp-pin"}},
+		{"?account=2", []string{"close", "temp-pin"}},
+		{"?action=adjust", []string{"adjust"}},
+		{"?account=1&action=close", []string{}},
+		{"?limit=2", []string{"maintenance", "close"}},
+		{"?limit=2&offset=2", []string{"adjust", "temp-pin"}},
+		{"?from=2100-01-01T00:00:00Z", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			if actions := listAudit(t, srv, "/admin/audit"+test.query); !reflect.DeepEqual(actions, test.want) {
+				t.Errorf("actions = %v, want %v", actions, test.want)
+			}
+		})
+	}
+
+	// Neither the temporary PIN nor the admin key are ever recorded
+	w := serve(srv, adminRequest(http.MethodGet, "/admin/audit", "secret", ""))
+	var env struct {
+		Data auditResponse `json:"data"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details := []string{}
+	for _, entry := range env.Data.Entries {
+		for _, secret := range []string{tempPIN, "secret"} {
+			if strings.Contains(entry.Detail, secret) {
+				t.Errorf("detail of %s contains %q: %q", entry.Action, secret, entry.Detail)
+			}
+		}
+		details = append(details, entry.Detail)
+	}
+
+	want := []string{"enabled: true", "", "-50: failed settlement", ""}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("details = %q, want %q", details, want)
+	}
+}
+
+func TestAdminAuditInvalidFilters(t *testing.T) {
+	srv, _ := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+
+	for _, query := range []string{"?account=abc", "?account=0", "?from=yesterday", "?limit=-1"} {
+		wantStatus(t, serve(srv, adminRequest(http.MethodGet, "/admin/audit"+query, "secret", "")), 400)
+	}
+
+	wantStatus(t, serve(srv, adminRequest(http.MethodPost, "/admin/audit", "secret", "")), 405)
+	wantStatus(t, serve(srv, adminRequest(http.MethodGet, "/admin/audit", "", "")), 401)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/rs/zerolog/log"
+)
+
+// challengeNonceBytes is the size of the nonces of login challenges
+const challengeNonceBytes = 32
+
+// errTooManyChallenges is returned when issuing a login challenge while the
+// maximum number of challenges are pending
+var errTooManyChallenges = errors.New("too many pending login challenges")
+
+// challengeStore keeps the nonces of the login challenges issued, until they
+// are used or expire
+//
+// At most `max' nonces are kept, so unauthenticated clients requesting
+// challenges they never answer cannot exhaust the memory of the server.
+type challengeStore struct {
+	lifetime time.Duration
+	max      int
+	clock    clock.Clock
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newChallengeStore(lifetime time.Duration, max int, clk clock.Clock) *challengeStore {
+	return &challengeStore{
+		lifetime: lifetime,
+		max:      max,
+		clock:    clk,
+		nonces:   map[string]time.Time{},
+	}
+}
+
+// issue generates a nonce, valid once until the returned expiration
+//
+// Fails with errTooManyChallenges if `max' unexpired nonces are pending.
+func (cs *challengeStore) issue() (string, time.Time, error) {
+	buf := make([]byte, challengeNonceBytes)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	nonce := hex.EncodeToString(buf)
+	now := cs.clock.Now()
+	expiresAt := now.Add(cs.lifetime)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for n, exp := range cs.nonces {
+		if !now.Before(exp) {
+			delete(cs.nonces, n)
+		}
+	}
+	if cs.max > 0 && len(cs.nonces) >= cs.max {
+		return "", time.Time{}, errTooManyChallenges
+	}
+	cs.nonces[nonce] = expiresAt
+
+	return nonce, expiresAt, nil
+}
+
+// consume invalidates `nonce', and tells whether it was issued and had not
+// expired yet
+func (cs *challengeStore) consume(nonce string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	expiresAt, ok := cs.nonces[nonce]
+	if !ok {
+		return false
+	}
+
+	delete(cs.nonces, nonce)
+	return cs.clock.Now().Before(expiresAt)
+}
+
+type challengeResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// getLoginChallenge issues a login challenge on GET /login/challenge
+//
+// The client answers it on /login with the hex encoded
+// HMAC-SHA256(pin, nonce) in the `nip-hmac' header, along with the nonce and
+// the card number, so the PIN is never sent.
+func (s *Server) getLoginChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	nonce, expiresAt, err := s.challenges.issue()
+	if errors.Is(err, errTooManyChallenges) {
+		log.Warn().Str("client_ip", s.cfg.TrustedProxies.ClientIP(r)).Msg("too many pending login challenges")
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, r, 503, "too many pending login challenges")
+		return
+	}
+	if err != nil {
+		logError(err).Msg("failed to issue login challenge")
+		s.writeInternalError(w, r, err, "failed to issue login challenge")
+		return
+	}
+
+	s.writeResponse(w, r, 200, challengeResponse{
+		Nonce:     nonce,
+		ExpiresAt: expiresAt.UTC(),
+	})
+}
+
+// readChallengeAnswer reads the answer to a login challenge from the headers
+// of `r', and invalidates the challenge; `ok' is false if the answer is
+// malformed or the challenge unknown, in which case the error has been
+// replied
+func (s *Server) readChallengeAnswer(w http.ResponseWriter, r *http.Request) (cardNumber string, nonce, response []byte, ok bool) {
+	cardNumber = r.Header.Get("card-number")
+	nonceHdr := r.Header.Get("nonce")
+	if cardNumber == "" || nonceHdr == "" {
+		s.writeError(w, r, 400, "missing header: 'card-number' and 'nonce' are required with 'nip-hmac'")
+		return "", nil, nil, false
+	}
+
+	nonce, err := hex.DecodeString(nonceHdr)
+	if err != nil {
+		s.writeError(w, r, 400, "invalid nonce")
+		return "", nil, nil, false
+	}
+
+	response, err = hex.DecodeString(r.Header.Get("nip-hmac"))
+	if err != nil {
+		s.writeError(w, r, 400, "invalid nip-hmac, expected hex")
+		return "", nil, nil, false
+	}
+
+	if !s.challenges.consume(nonceHdr) {
+		s.writeError(w, r, 401, "unknown or expired challenge")
+		return "", nil, nil, false
+	}
+
+	return cardNumber, nonce, response, true
+}
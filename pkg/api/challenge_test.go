@@ -0,0 +1,100 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// getChallenge requests a login challenge, and returns the response
+func getChallenge(h http.Handler) (challengeResponse, int) {
+	w := serve(h, newRequest(http.MethodGet, "/login/challenge", "", ""))
+
+	var env struct {
+		Data challengeResponse `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &env)
+
+	return env.Data, w.Code
+}
+
+// answerChallenge returns a login request answering the challenge `nonce'
+// for the card `cardNumber' with `pin'
+func answerChallenge(nonce, cardNumber, pin string) *http.Request {
+	raw, _ := hex.DecodeString(nonce)
+	mac := hmac.New(sha256.New, []byte(pin))
+	mac.Write(raw)
+
+	r := newRequest(http.MethodGet, "/login", "", "")
+	r.Header.Set("card-number", cardNumber)
+	r.Header.Set("nonce", nonce)
+	r.Header.Set("nip-hmac", hex.EncodeToString(mac.Sum(nil)))
+
+	return r
+}
+
+func TestLoginChallenge(t *testing.T) {
+	clk := newFakeClock()
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	createAccount(t, store, "4623", 0)
+	srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, DefaultConfig())
+
+	challenge, status := getChallenge(srv)
+	if status != 200 {
+		t.Fatalf("challenge: status = %d", status)
+	}
+
+	wantStatus(t, serve(srv, answerChallenge(challenge.Nonce, "4970104623000000", "8264")), 401)
+
+	// Challenges are answered once, even wrongly
+	wantStatus(t, serve(srv, answerChallenge(challenge.Nonce, "4970104623000000", "4623")), 401)
+
+	challenge, _ = getChallenge(srv)
+	wantStatus(t, serve(srv, answerChallenge(challenge.Nonce, "4970104623000000", "4623")), 200)
+
+	challenge, _ = getChallenge(srv)
+	clk.advance(DefaultConfig().LoginChallengeLifetime)
+	wantStatus(t, serve(srv, answerChallenge(challenge.Nonce, "4970104623000000", "4623")), 401)
+}
+
+func TestLoginChallengesCapped(t *testing.T) {
+	clk := newFakeClock()
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	createAccount(t, store, "4623", 0)
+
+	cfg := DefaultConfig()
+	cfg.MaxLoginChallenges = 2
+	srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, cfg)
+
+	first, _ := getChallenge(srv)
+	getChallenge(srv)
+
+	w := serve(srv, newRequest(http.MethodGet, "/login/challenge", "", ""))
+	wantStatus(t, w, 503)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After not set")
+	}
+
+	// Pending challenges can still be answered, which frees their slot
+	wantStatus(t, serve(srv, answerChallenge(first.Nonce, "4970104623000000", "4623")), 200)
+	if _, status := getChallenge(srv); status != 200 {
+		t.Errorf("challenge after one was answered: status = %d, want 200", status)
+	}
+	if _, status := getChallenge(srv); status != 503 {
+		t.Errorf("challenge beyond the maximum: status = %d, want 503", status)
+	}
+
+	// Expired challenges free their slot as well
+	clk.advance(cfg.LoginChallengeLifetime + time.Second)
+	for i := 0; i < 2; i++ {
+		if _, status := getChallenge(srv); status != 200 {
+			t.Errorf("challenge after the others expired: status = %d, want 200", status)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies whose
+// X-Forwarded-For and X-Real-IP headers are trusted
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses the CIDRs of trusted proxies, e.g. `10.0.0.0/8'
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	proxies := TrustedProxies{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (tp TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent `r'
+//
+// The forwarding headers are only used when the request comes from a trusted
+// proxy, otherwise they could be spoofed by the client: the address is then
+// the last one in X-Forwarded-For not of a trusted proxy, or X-Real-IP.
+func (tp TrustedProxies) ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !tp.contains(remoteIP) {
+		return remote
+	}
+
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(strings.Join(fwd, ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+
+			client = ip.String()
+			if !tp.contains(ip) {
+				break
+			}
+		}
+
+		if client != "" {
+			return client
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return remote
+}
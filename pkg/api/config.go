@@ -0,0 +1,164 @@
+package api
+
+import "time"
+
+// Config holds the tunables of the public API
+type Config struct {
+	// MaxBatchRecipients is the maximum number of accounts a single batch
+	// transfer can credit
+	MaxBatchRecipients int
+	// MaxBalanceLookups is the maximum number of accounts whose balance can
+	// be looked up in a single admin request
+	MaxBalanceLookups int
+
+	// DefaultPageSize is the number of items returned by list routes when
+	// no `limit' is requested
+	DefaultPageSize int
+	// MaxPageSize is the maximum number of items returned by list routes,
+	// larger `limit's are clamped to it
+	MaxPageSize int
+
+	// AdminKey is the API key administrators authenticate with on the
+	// /admin routes; admin routes are disabled when empty
+	AdminKey string
+
+	// Banner is the service name reported on GET /
+	Banner string
+
+	// SessionMode determines whether sessions are renewed on use
+	SessionMode SessionMode
+	// SessionGrace is how long sliding sessions can still be used after they
+	// expired, they are renewed when used during that period
+	SessionGrace time.Duration
+	// SessionClockSkew is the clock drift tolerated between the instances
+	// sharing sessions, sessions being honored until that long after they
+	// expire
+	SessionClockSkew time.Duration
+	// SessionSweepInterval is the period at which expired sessions are
+	// removed, they are never removed if 0
+	SessionSweepInterval time.Duration
+	// RevokeSessionsOnPINChange invalidates the other sessions of an account
+	// when its PIN is changed
+	RevokeSessionsOnPINChange bool
+	// KeepSessionOnPINChange keeps the session the PIN was changed with when
+	// revoking sessions on PIN changes
+	KeepSessionOnPINChange bool
+	// SessionSnapshotPath is the file sessions are saved to, and restored
+	// from on startup, so restarts do not log users out; sessions are not
+	// saved when empty
+	SessionSnapshotPath string
+	// SessionSnapshotInterval is the period at which sessions are saved
+	SessionSnapshotInterval time.Duration
+
+	// Denominations are the values of the bills the ATM dispenses
+	Denominations []int64
+
+	// MaxInFlightPerAccount is the maximum number of transactions processed
+	// concurrently for an account, further ones are rejected; no maximum is
+	// enforced if 0
+	MaxInFlightPerAccount int
+
+	// MaxConcurrentRequests is the maximum number of requests served
+	// concurrently, further ones are shed with 503 except for /healthz; no
+	// maximum is enforced if 0
+	MaxConcurrentRequests int
+
+	// StrictDecoding rejects request bodies with fields unknown to the
+	// route
+	StrictDecoding bool
+
+	// ReceiptSecret is the key transaction receipts are signed with,
+	// receipts are not available when empty
+	ReceiptSecret string
+
+	// NoSniff sets X-Content-Type-Options: nosniff on all responses
+	NoSniff bool
+	// NoStore sets Cache-Control: no-store on the responses of authenticated
+	// and admin routes
+	NoStore bool
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header sent
+	// on requests served over TLS, the header is not sent if 0
+	HSTSMaxAge time.Duration
+
+	// TrustedProxies are the reverse proxies whose forwarding headers are
+	// trusted to report the address of clients
+	TrustedProxies TrustedProxies
+
+	// TransactionRetention is how long transactions are kept before they
+	// can be purged by administrators; they are only purged up to an
+	// explicit time if 0
+	TransactionRetention time.Duration
+
+	// RouteTimeout is the maximum time to serve a request, after which it
+	// is replied 503; no maximum is enforced if 0
+	RouteTimeout time.Duration
+	// RouteTimeouts override RouteTimeout for the routes registered with
+	// these patterns, e.g. "/statement"; slow routes have longer defaults
+	RouteTimeouts map[string]time.Duration
+	// MaxRequestTimeout caps the timeouts clients set on their requests
+	// with the X-Request-Timeout header; they are not capped if 0
+	MaxRequestTimeout time.Duration
+
+	// PlaintextLogin allows logging in with the PIN itself, rather than
+	// with the answer to a login challenge
+	PlaintextLogin bool
+	// LoginChallengeLifetime is how long a login challenge can be answered
+	// after it is issued
+	LoginChallengeLifetime time.Duration
+	// MaxLoginChallenges is the maximum number of login challenges pending
+	// at once, further ones being refused with 503 until some are answered
+	// or expire; no maximum is enforced if 0
+	MaxLoginChallenges int
+	// FreshAuthWindow is how long after the PIN was last checked a session
+	// can change the PIN, close the account, or make a large transfer;
+	// sessions are always fresh enough if 0
+	FreshAuthWindow time.Duration
+	// LargeTransferAmount is the total from which batch transfers require a
+	// fresh authentication; never required for transfers if 0
+	LargeTransferAmount int64
+
+	// IdempotencyTTL is how long the response to a request made with an
+	// Idempotency-Key is replayed to its retries
+	IdempotencyTTL time.Duration
+
+	// MaxHeaderCount is the maximum number of headers of a request, requests
+	// with more are rejected with 431; no maximum is enforced if 0
+	MaxHeaderCount int
+
+	// Currency is the ISO 4217 code of the currency amounts are counted in,
+	// one of those accepted by ParseCurrency
+	Currency string
+}
+
+// DefaultConfig returns the configuration used when none is specified
+func DefaultConfig() Config {
+	return Config{
+		MaxBatchRecipients:        100,
+		MaxBalanceLookups:         100,
+		DefaultPageSize:           20,
+		MaxPageSize:               100,
+		Banner:                    "ATM service",
+		SessionMode:               SlidingSessions,
+		SessionSweepInterval:      time.Minute,
+		SessionSnapshotInterval:   30 * time.Second,
+		RevokeSessionsOnPINChange: true,
+		KeepSessionOnPINChange:    true,
+		Denominations:             []int64{20, 50, 100},
+		MaxInFlightPerAccount:     2,
+		MaxConcurrentRequests:     256,
+		StrictDecoding:            true,
+		NoSniff:                   true,
+		NoStore:                   true,
+		HSTSMaxAge:                365 * 24 * time.Hour,
+		MaxHeaderCount:            50,
+		PlaintextLogin:            true,
+		RouteTimeout:              10 * time.Second,
+		MaxRequestTimeout:         30 * time.Second,
+		LoginChallengeLifetime:    time.Minute,
+		MaxLoginChallenges:        10000,
+		FreshAuthWindow:           5 * time.Minute,
+		LargeTransferAmount:       1000,
+		IdempotencyTTL:            24 * time.Hour,
+		Currency:                  "USD",
+	}
+}
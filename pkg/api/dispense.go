@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lbajolet/atm_service/pkg/cash"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+var errNotDispensable = errors.New("amount cannot be dispensed")
+
+// withdrawalBreakdown checks that `amount' can be dispensed by the ATM, and
+// returns the bills it is dispensed as
+//
+// The limits of the account, like its maximum withdrawal, are enforced by
+// the persistence layer.
+func (s *Server) withdrawalBreakdown(amount int64) (map[int64]int64, error) {
+	breakdown, ok := cash.Breakdown(amount, s.cfg.Denominations)
+	if !ok {
+		return nil, errNotDispensable
+	}
+
+	return breakdown, nil
+}
+
+type maxWithdrawalResponse struct {
+	Amount int64 `json:"amount"`
+}
+
+// getMaxWithdrawal outputs the largest amount the account can withdraw on GET
+// /withdraw/max, given its balance not held, the denominations of the ATM and
+// its maximum withdrawal
+func (s *Server) getMaxWithdrawal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	available, err := s.db.AvailableBalance(sess.Account)
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get available balance")
+		s.writeTransactionError(w, r, err, "failed to get available balance")
+		return
+	}
+
+	_, limits, err := s.db.AccountLimits(sess.Account)
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get account limits")
+		s.writeTransactionError(w, r, err, "failed to get account limits")
+		return
+	}
+
+	if limits.MaxWithdrawal > 0 && available > limits.MaxWithdrawal {
+		available = limits.MaxWithdrawal
+	}
+
+	s.writeResponse(w, r, 200, maxWithdrawalResponse{
+		Amount: cash.LargestDispensable(available, s.cfg.Denominations),
+	})
+}
+
+type breakdownResponse struct {
+	Breakdown map[int64]int64 `json:"breakdown"`
+}
+
+// getWithdrawalBreakdown previews the bills a withdrawal would be dispensed
+// as, without performing it
+func (s *Server) getWithdrawalBreakdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		s.writeError(w, r, 400, "invalid amount")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	_, limits, err := s.db.AccountLimits(sess.Account)
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get account limits")
+		s.writeTransactionError(w, r, err, "failed to get account limits")
+		return
+	}
+
+	if limits.MaxWithdrawal > 0 && amount > limits.MaxWithdrawal {
+		s.writeError(w, r, 422, persistence.ErrAboveMaxWithdrawal.Error())
+		return
+	}
+
+	breakdown, err := s.withdrawalBreakdown(amount)
+	if err != nil {
+		log.Error().Err(err).Int64("amount", amount).Msg("withdrawal cannot be dispensed")
+		s.writeError(w, r, 422, err.Error())
+		return
+	}
+
+	s.writeResponse(w, r, 200, breakdownResponse{
+		Breakdown: breakdown,
+	})
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// drainRetryAfter is the delay clients are told to wait before retrying
+// requests refused while the server shuts down, in seconds, by when another
+// instance should serve them
+const drainRetryAfter = 5
+
+// Drain makes the server refuse new requests with 503, while the ones being
+// served complete, when it starts shutting down
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Draining returns whether the server refuses new requests, since it is
+// shutting down
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// rejectWhenDraining refuses requests with 503 once the server is draining,
+// rather than starting them and cutting them off at shutdown
+//
+// /healthz is refused as well, so load balancers stop routing requests to the
+// server.
+func (s *Server) rejectWhenDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Draining() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", strconv.Itoa(drainRetryAfter))
+			s.writeError(w, r, 503, "server shutting down")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// blockingStore performs transactions once released, telling when they
+// started
+type blockingStore struct {
+	*persistence.Memory
+	started, release chan struct{}
+}
+
+func (s blockingStore) DoTransaction(ctx context.Context, acc persistence.Account, tx persistence.Transaction) (int64, error) {
+	close(s.started)
+	<-s.release
+
+	return s.Memory.DoTransaction(ctx, acc, tx)
+}
+
+func TestDrain(t *testing.T) {
+	memory := persistence.NewMemory(persistence.DefaultConfig())
+	acc := createAccount(t, memory, "4623", 0)
+
+	store := blockingStore{Memory: memory, started: make(chan struct{}), release: make(chan struct{})}
+	srv := NewServerWithDeps(Deps{Store: store}, DefaultConfig())
+	sessionID := login(t, srv, "4623")
+
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		inFlight <- serve(srv, newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`))
+	}()
+
+	<-store.started
+	srv.Drain()
+
+	for _, target := range []string{"/balance", "/healthz"} {
+		w := serve(srv, newRequest(http.MethodGet, target, sessionID, ""))
+		wantStatus(t, w, 503)
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: Retry-After not set", target)
+		}
+	}
+
+	// The request being served when draining started completes
+	close(store.release)
+	wantStatus(t, <-inFlight, 200)
+
+	balance, err := memory.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 100 {
+		t.Errorf("balance = %d, want 100", balance)
+	}
+}
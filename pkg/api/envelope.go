@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDKeyCtx is the context key holding the correlation ID of a request
+const RequestIDKeyCtx = "RequestID"
+
+// RequestIDHeader carries the correlation ID of a request, both ways
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the correlation IDs accepted from clients
+const maxRequestIDLength = 128
+
+// requestIDs tags each request with a correlation ID, echoed in the
+// X-Request-ID response header and in the response envelope
+//
+// The ID sent by the client is kept if it is reasonable, otherwise a new one is
+// generated.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), RequestIDKeyCtx, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID tells whether a client-provided correlation ID can be kept
+// as is: not empty, bounded, and made of printable ASCII only
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestID returns the correlation ID of `r', empty if it was not tagged
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(RequestIDKeyCtx).(string)
+	return id
+}
+
+type responseEnvelope struct {
+	Data       interface{} `json:"data"`
+	RequestID  string      `json:"request_id"`
+	ServerTime time.Time   `json:"server_time"`
+}
+
+// writeResponse replies to a successful request with `data' wrapped in the
+// response envelope, along with the status code
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(responseEnvelope{
+		Data:       data,
+		RequestID:  requestID(r),
+		ServerTime: s.clock.Now().UTC(),
+	})
+}
+
+type errorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// errorEnvelope is the envelope of error responses, parallel to
+// responseEnvelope
+type errorEnvelope struct {
+	Error      errorBody `json:"error"`
+	RequestID  string    `json:"request_id"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+// writeError replies to a failed request with the status code and `msg'
+// wrapped in the error envelope
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeErrorAt(w, r, s.clock.Now(), status, msg)
+}
+
+// writeErrorf is writeError with a message formatted like fmt.Sprintf
+func (s *Server) writeErrorf(w http.ResponseWriter, r *http.Request, status int, format string, args ...interface{}) {
+	s.writeError(w, r, status, fmt.Sprintf(format, args...))
+}
+
+// writeErrorAt is writeError at server time `now'
+func writeErrorAt(w http.ResponseWriter, r *http.Request, now time.Time, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorEnvelope{
+		Error: errorBody{
+			Status:  status,
+			Message: msg,
+		},
+		RequestID:  requestID(r),
+		ServerTime: now.UTC(),
+	})
+}
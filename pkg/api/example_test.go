@@ -0,0 +1,60 @@
+package api_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/lbajolet/atm_service/pkg/api"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// The server can be tested end to end with httptest, without a database nor
+// a real port, on top of the in-memory persistence layer
+func ExampleNewServerWithDeps() {
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	_, _, err := store.CreateAccount("4623", "4970100000000000", "", 500)
+	if err != nil {
+		panic(err)
+	}
+
+	srv := api.NewServerWithDeps(api.Deps{Store: store}, api.DefaultConfig())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	login, err := http.NewRequest(http.MethodGet, ts.URL+"/login", nil)
+	if err != nil {
+		panic(err)
+	}
+	login.Header.Set("nip", "4623")
+
+	resp, err := http.DefaultClient.Do(login)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	fmt.Println("login:", resp.StatusCode)
+
+	balance, err := http.NewRequest(http.MethodGet, ts.URL+"/balance?format=text", nil)
+	if err != nil {
+		panic(err)
+	}
+	balance.Header.Set("Authorization", resp.Header.Get("SessionID"))
+
+	resp, err = http.DefaultClient.Do(balance)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("balance:", string(body))
+
+	// Output:
+	// login: 200
+	// balance: 500
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// securityHeaders sets the headers hardening every response, according to the
+// configuration
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.NoSniff {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+
+		if s.cfg.HSTSMaxAge > 0 && r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security",
+				"max-age="+strconv.FormatInt(int64(s.cfg.HSTSMaxAge.Seconds()), 10))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// noStore wraps routes serving account data, so their responses are not
+// cached by clients or intermediaries
+func (s *Server) noStore(next http.Handler) http.Handler {
+	if !s.cfg.NoStore {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitHeaders rejects requests with more headers than configured
+func (s *Server) limitHeaders(next http.Handler) http.Handler {
+	if s.cfg.MaxHeaderCount <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+
+		if count > s.cfg.MaxHeaderCount {
+			s.writeError(w, r, http.StatusRequestHeaderFieldsTooLarge, "too many headers")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxHeaderCount(t *testing.T) {
+	srv, _ := newTestServer(t, func(cfg *Config) {
+		cfg.MaxHeaderCount = 10
+	})
+
+	tests := []struct {
+		headers int
+		want    int
+	}{
+		{10, 200},
+		{11, 431},
+	}
+
+	for _, test := range tests {
+		r := newRequest(http.MethodGet, "/version", "", "")
+		for i := 0; i < test.headers; i++ {
+			r.Header.Add(fmt.Sprintf("X-Test-%d", i%3), "value")
+		}
+
+		wantStatus(t, serve(srv, r), test.want)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+
+	// Served like cmd/main.go, with its default limit
+	ts := httptest.NewUnstartedServer(srv)
+	ts.Config.MaxHeaderBytes = 16 << 10
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		size int
+		want int
+	}{
+		{1 << 10, 200},
+		{32 << 10, 431},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest(http.MethodGet, ts.URL+"/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Test", strings.Repeat("a", test.size))
+
+		resp, err := ts.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.want {
+			t.Errorf("header of %d bytes: status = %d, want %d", test.size, resp.StatusCode, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type healthResponse struct {
+	OpenConnections int    `json:"open_connections"`
+	InUse           int    `json:"in_use"`
+	Idle            int    `json:"idle"`
+	WaitCount       int64  `json:"wait_count"`
+	WaitDuration    string `json:"wait_duration"`
+	// LastSuccess is null until an operation succeeds
+	LastSuccess   *time.Time `json:"last_success"`
+	SchemaVersion int        `json:"schema_version"`
+}
+
+// getHealth checks that the service can reach its database on GET /healthz,
+// replying with 503 if it cannot
+//
+// With `?verbose=true', the state of the connection pool and schema are
+// reported as JSON.
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if r.URL.Query().Get("verbose") != "true" {
+		err := s.db.Ping()
+		if err != nil {
+			log.Error().Err(err).Msg("health check failed")
+			s.writeError(w, r, 503, "unhealthy")
+			return
+		}
+
+		fmt.Fprint(w, "ok")
+		return
+	}
+
+	health, err := s.db.HealthDetailed()
+	if err != nil {
+		log.Error().Err(err).Msg("health check failed")
+		s.writeError(w, r, 503, "unhealthy")
+		return
+	}
+
+	resp := healthResponse{
+		OpenConnections: health.OpenConnections,
+		InUse:           health.InUse,
+		Idle:            health.Idle,
+		WaitCount:       health.WaitCount,
+		WaitDuration:    health.WaitDuration.String(),
+		SchemaVersion:   health.SchemaVersion,
+	}
+	if !health.LastSuccess.IsZero() {
+		resp.LastSuccess = &health.LastSuccess
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type holdResponse struct {
+	ID        int64     `json:"hold_id"`
+	Amount    int64     `json:"amount"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// placeHold reserves an amount for a later withdrawal on POST /withdraw/hold
+//
+// The amount must be dispensable like a withdrawal; the hold is settled with
+// captureHold or cancelled with releaseHold.
+func (s *Server) placeHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	amount, _, err := s.decodeAmount(r)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode held amount")
+		s.writeDecodeError(w, r, err, "invalid amount")
+		return
+	}
+
+	_, err = s.withdrawalBreakdown(amount)
+	if err != nil {
+		log.Error().Err(err).Int64("amount", amount).Msg("hold cannot be dispensed")
+		s.writeError(w, r, 422, err.Error())
+		return
+	}
+
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
+	}
+	defer s.inFlight.release(sess.Account)
+
+	hold, err := s.db.PlaceHold(r.Context(), sess.Account, amount)
+	if err != nil {
+		logError(err).Msg("hold failed")
+		s.writeTransactionError(w, r, err, "failed to place hold")
+		return
+	}
+
+	s.writeResponse(w, r, 201, holdResponse{
+		ID:        hold.ID,
+		Amount:    hold.Amount,
+		ExpiresAt: hold.ExpiresAt,
+	})
+}
+
+// captureHold settles a hold of the account on POST
+// /withdraw/capture/{holdID}, performing the withdrawal
+func (s *Server) captureHold(w http.ResponseWriter, r *http.Request) {
+	s.settleHold(w, r, "/withdraw/capture/", true)
+}
+
+// releaseHold cancels a hold of the account on POST
+// /withdraw/release/{holdID}
+func (s *Server) releaseHold(w http.ResponseWriter, r *http.Request) {
+	s.settleHold(w, r, "/withdraw/release/", false)
+}
+
+func (s *Server) settleHold(w http.ResponseWriter, r *http.Request, prefix string, capture bool) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+	if err != nil {
+		s.writeError(w, r, 404, "no such hold")
+		return
+	}
+
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
+	}
+	defer s.inFlight.release(sess.Account)
+
+	if capture {
+		err = s.db.CaptureHold(r.Context(), sess.Account, id)
+	} else {
+		err = s.db.ReleaseHold(r.Context(), sess.Account, id)
+	}
+	if err != nil {
+		logError(err).Int64("hold_id", id).Bool("capture", capture).Msg("failed to settle hold")
+		s.writeTransactionError(w, r, err, "failed to settle hold")
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
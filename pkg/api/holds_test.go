@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// placeHold places a hold of `body' on the session `sessionID', and returns
+// its ID
+func placeHold(t *testing.T, h http.Handler, sessionID, body string) int64 {
+	t.Helper()
+
+	w := serve(h, newRequest(http.MethodPost, "/withdraw/hold", sessionID, body))
+	wantStatus(t, w, 201)
+
+	resp := struct {
+		Data holdResponse `json:"data"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Data.ID
+}
+
+func TestHoldRoutes(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	acc := createAccount(t, store, "4623", 500)
+	sessionID := login(t, srv, "4623")
+
+	captured := placeHold(t, srv, sessionID, `{"amount":200}`)
+	released := placeHold(t, srv, sessionID, `{"amount":100}`)
+
+	// Held funds cannot be withdrawn
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/withdraw", sessionID, `{"amount":300}`)), 422)
+
+	capture := fmt.Sprintf("/withdraw/capture/%d", captured)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, capture, sessionID, "")), 200)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, capture, sessionID, "")), 404)
+
+	release := fmt.Sprintf("/withdraw/release/%d", released)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, release, sessionID, "")), 200)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, release, sessionID, "")), 404)
+
+	available, err := store.AvailableBalance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available != 300 {
+		t.Errorf("available balance = %d, want 300", available)
+	}
+}
+
+func TestHoldsOfOtherAccounts(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 500)
+	createAccount(t, store, "8264", 500)
+
+	id := placeHold(t, srv, login(t, srv, "4623"), `{"amount":200}`)
+
+	// Holds of other accounts are reported as not found
+	other := login(t, srv, "8264")
+	for _, action := range []string{"capture", "release"} {
+		target := fmt.Sprintf("/withdraw/%s/%d", action, id)
+		wantStatus(t, serve(srv, newRequest(http.MethodPost, target, other, "")), 404)
+	}
+}
@@ -1,105 +1,462 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lbajolet/atm_service/pkg/cash"
+	"github.com/lbajolet/atm_service/pkg/clock"
 	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/lbajolet/atm_service/pkg/version"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 const SessionKeyCtx = "Context"
 
+// SessionMode determines whether sessions are renewed when used
+type SessionMode int
+
+const (
+	// SlidingSessions are renewed when used close to their expiration
+	SlidingSessions SessionMode = iota
+	// FixedSessions expire at a fixed deadline after being created,
+	// regardless of activity
+	FixedSessions
+)
+
+// String returns the name of the mode, as accepted by Set
+func (m SessionMode) String() string {
+	switch m {
+	case SlidingSessions:
+		return "sliding"
+	case FixedSessions:
+		return "fixed"
+	}
+
+	return fmt.Sprintf("SessionMode(%d)", int(m))
+}
+
+// Set parses the mode from its name, either "sliding" or "fixed"
+func (m *SessionMode) Set(name string) error {
+	switch name {
+	case "sliding":
+		*m = SlidingSessions
+	case "fixed":
+		*m = FixedSessions
+	default:
+		return fmt.Errorf("unknown session mode %q, expected sliding or fixed", name)
+	}
+
+	return nil
+}
+
+// Type returns the name of the type, for use as a command-line flag
+func (m *SessionMode) Type() string {
+	return "sliding|fixed"
+}
+
+// SessionLifetime is the time a session stays valid after being created or
+// renewed
+const SessionLifetime = 10 * time.Minute
+
 type Session struct {
 	ID         uuid.UUID
 	Account    persistence.Account
+	Created    time.Time
 	Expiration time.Time
+	Mode       SessionMode
+	// MustChangePIN restricts the session to changing the PIN of the
+	// account, after a login with a temporary PIN
+	MustChangePIN bool
+	// AuthenticatedAt is the last time the PIN of the account was checked
+	// for the session, at login or through /session/reauth
+	AuthenticatedAt time.Time
+}
+
+// RedactedID returns an identifier for the session that can be shown to
+// users, without disclosing the session token
+func (s *Session) RedactedID() string {
+	return s.ID.String()[:8]
 }
 
 // IsValid checks that the session is still able to be used
 func (s *Session) IsValid() bool {
-	if !time.Now().Before(s.Expiration) {
-		return false
+	return s.IsValidWithGrace(clock.System, 0)
+}
+
+// IsValidWithGrace checks that the session is still able to be used at the
+// time given by `clk', allowing sliding sessions expired for less than
+// `grace' to be used, in which case they are renewed
+//
+// Fixed sessions are never used past their expiration.
+func (s *Session) IsValidWithGrace(clk clock.Clock, grace time.Duration) bool {
+	return s.isValidAt(clk.Now(), grace, 0)
+}
+
+// isValidAt is IsValidWithGrace at time `now', the session being honored
+// until `skew' after its expiration, for the clock drift between instances
+func (s *Session) isValidAt(now time.Time, grace, skew time.Duration) bool {
+	expiration := s.Expiration.Add(skew)
+	if !now.Before(expiration) {
+		if s.Mode == FixedSessions || !now.Before(expiration.Add(grace)) {
+			return false
+		}
+
+		log.Debug().Str("session", s.RedactedID()).Dur("expired_for", now.Sub(s.Expiration)).Msg("expired session used within grace period")
+		s.renewAt(now)
+		return true
 	}
 
 	// Auto-renew session if it expires in less than a minute
-	if time.Now().Add(time.Minute).After(s.Expiration) {
-		s.Renew()
+	if now.Add(time.Minute).After(s.Expiration) {
+		s.renewAt(now)
 	}
 	return true
 }
 
+// Renew extends the validity of a sliding session
+//
+// Fixed sessions keep their original expiration.
 func (s *Session) Renew() {
-	s.Expiration = time.Now().Add(10 * time.Minute)
+	s.renewAt(time.Now())
+}
+
+// renewAt is Renew at time `now'
+func (s *Session) renewAt(now time.Time) {
+	if s.Mode == FixedSessions {
+		return
+	}
+
+	s.Expiration = now.Add(SessionLifetime)
 }
 
 // NewSession returns a new Session for the account
 //
 // Sessions are valid for 10 minutes after they're created
-func NewSession(acc persistence.Account) *Session {
-	session := &Session{
-		ID:      uuid.New(),
-		Account: acc,
+func NewSession(acc persistence.Account, mode SessionMode) *Session {
+	return newSessionAt(acc, mode, time.Now())
+}
+
+// newSessionAt is NewSession at time `now'
+func newSessionAt(acc persistence.Account, mode SessionMode, now time.Time) *Session {
+	return &Session{
+		ID:              uuid.New(),
+		Account:         acc,
+		Created:         now,
+		Expiration:      now.Add(SessionLifetime),
+		Mode:            mode,
+		AuthenticatedAt: now,
 	}
-	session.Renew()
-	return session
 }
 
 // AuthServer authenticates users that connect to routes that require authentication
 type AuthServer struct {
 	AuthMap *sync.Map
+	Mode    SessionMode
+	// Grace is how long sliding sessions can still be used after they
+	// expired, being renewed when they are
+	Grace time.Duration
+	// Skew is the tolerated clock drift between instances, sessions being
+	// honored, and renewed, until Skew after their expiration
+	Skew    time.Duration
 	Wrapped http.Handler
+	// Clock tells the time sessions are created, renewed and expire at
+	Clock clock.Clock
+
+	// mu serializes the changes of AuthMap that depend on its content, so a
+	// renewal cannot bring back a session revoked concurrently
+	mu *sync.Mutex
 }
 
 // NewAuthServer returns a new instance of AuthServer
-func NewAuthServer(wrapped http.Handler) AuthServer {
+func NewAuthServer(wrapped http.Handler, mode SessionMode, grace time.Duration) AuthServer {
 	return AuthServer{
 		AuthMap: &sync.Map{},
+		Mode:    mode,
+		Grace:   grace,
 		Wrapped: wrapped,
+		Clock:   clock.System,
+		mu:      &sync.Mutex{},
 	}
 }
 
+// NewSession opens a new session for the account
+//
+// Fails with persistence.ErrInvalidAccount if `acc' is not a valid account,
+// so a session can never be opened for persistence.NoAccount.
 func (as AuthServer) NewSession(acc persistence.Account) (*Session, error) {
-	sess := NewSession(acc)
+	if !acc.IsValid() {
+		return nil, fmt.Errorf("account %d: %w", acc, persistence.ErrInvalidAccount)
+	}
+
+	sess := newSessionAt(acc, as.Mode, as.Clock.Now())
 	as.AuthMap.Store(sess.ID, sess)
 	return sess, nil
 }
 
+// NewPINChangeSession returns a new session for the account, only allowed to
+// change its PIN
+func (as AuthServer) NewPINChangeSession(acc persistence.Account) (*Session, error) {
+	if !acc.IsValid() {
+		return nil, fmt.Errorf("account %d: %w", acc, persistence.ErrInvalidAccount)
+	}
+
+	sess := newSessionAt(acc, as.Mode, as.Clock.Now())
+	sess.MustChangePIN = true
+	as.AuthMap.Store(sess.ID, sess)
+	return sess, nil
+}
+
+// ErrNoSession is returned when operating on a session that is not stored
+var ErrNoSession = errors.New("no such session")
+
+// RotateSession replaces the session `old' with a new session for the same
+// account
+//
+// The old session is invalidated immediately.
+func (as AuthServer) RotateSession(old uuid.UUID) (*Session, error) {
+	as.mu.Lock()
+	val, ok := as.AuthMap.LoadAndDelete(old)
+	as.mu.Unlock()
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	sess, ok := val.(*Session)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	var newSess *Session
+	var err error
+	if sess.MustChangePIN {
+		newSess, err = as.NewPINChangeSession(sess.Account)
+	} else {
+		newSess, err = as.NewSession(sess.Account)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Rotating the session does not authenticate the account again
+	newSess.AuthenticatedAt = sess.AuthenticatedAt
+	return newSess, nil
+}
+
+// AccountSessions returns the unexpired sessions of the account
+func (as AuthServer) AccountSessions(acc persistence.Account) []*Session {
+	sessions := []*Session{}
+	now := as.Clock.Now()
+
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		sess, ok := val.(*Session)
+		if ok && sess.Account == acc && now.Before(sess.Expiration) {
+			sessions = append(sessions, sess)
+		}
+		return true
+	})
+
+	return sessions
+}
+
+// RevokeSession invalidates the session of the account identified by its
+// redacted ID
+func (as AuthServer) RevokeSession(acc persistence.Account, redactedID string) error {
+	var revoked *Session
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		sess, ok := val.(*Session)
+		if ok && sess.Account == acc && sess.RedactedID() == redactedID {
+			revoked = sess
+			return false
+		}
+		return true
+	})
+
+	if revoked == nil {
+		return ErrNoSession
+	}
+
+	as.mu.Lock()
+	as.AuthMap.Delete(revoked.ID)
+	as.mu.Unlock()
+	return nil
+}
+
+// RevokeAccountSessions invalidates all the sessions of the account but
+// `except', and returns how many were revoked
+//
+// Pass uuid.Nil as `except' to revoke every session of the account.
+func (as AuthServer) RevokeAccountSessions(acc persistence.Account, except uuid.UUID) int {
+	revoked := 0
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		sess, ok := val.(*Session)
+		if ok && sess.Account == acc && sess.ID != except {
+			as.AuthMap.Delete(key)
+			revoked++
+		}
+		return true
+	})
+
+	return revoked
+}
+
+// SessionCounts returns the number of sessions that can still be used, and
+// the number of sessions stored, including expired ones not swept yet
+func (as AuthServer) SessionCounts() (valid int, stored int) {
+	now := as.Clock.Now()
+
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		stored++
+		sess, ok := val.(*Session)
+		if ok && now.Before(sess.Expiration) {
+			valid++
+		}
+		return true
+	})
+
+	return valid, stored
+}
+
+// Sweep removes the sessions expired for longer than the grace period, and
+// malformed entries, and returns how many were removed
+func (as AuthServer) Sweep() int {
+	now := as.Clock.Now()
+	swept := 0
+
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		sess, ok := val.(*Session)
+		if ok && now.Before(sess.Expiration.Add(as.Grace+as.Skew)) {
+			return true
+		}
+
+		as.mu.Lock()
+		// The session may have been renewed since it was read
+		if current, found := as.AuthMap.Load(key); found && current == val {
+			as.AuthMap.Delete(key)
+			swept++
+		}
+		as.mu.Unlock()
+		return true
+	})
+
+	return swept
+}
+
+// sweepEvery calls Sweep every `interval', forever
+func (as AuthServer) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		swept := as.Sweep()
+		if swept > 0 {
+			log.Debug().Int("swept", swept).Msg("expired sessions swept")
+		}
+	}
+}
+
+// replaceSession stores `updated' in place of `current', unless `current' was
+// removed or replaced in the meantime
+//
+// Sessions in AuthMap are never modified in place: changes are made on a copy
+// stored with replaceSession, so a request failing halfway cannot leave a
+// half-updated session behind.
+func (as AuthServer) replaceSession(current, updated *Session) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	val, ok := as.AuthMap.Load(current.ID)
+	if !ok || val != current {
+		return false
+	}
+
+	as.AuthMap.Store(updated.ID, updated)
+	return true
+}
+
+// sessionTokenPrefix is the URN prefix some clients send session tokens with
+const sessionTokenPrefix = "urn:uuid:"
+
+// parseSessionToken parses the session token given in the Authorization
+// header, ignoring surrounding spaces, the case of its hex digits, and an
+// optional urn:uuid: prefix, so all the representations of a token match the
+// same session
+func parseSessionToken(token string) (uuid.UUID, error) {
+	token = strings.ToLower(strings.TrimSpace(token))
+	token = strings.TrimPrefix(token, sessionTokenPrefix)
+
+	return uuid.Parse(token)
+}
+
 // HandleAuthRequest checks that the authentication is valid before processing the request
 func (as AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		log.Error().Msg("missing auth header")
-		w.WriteHeader(401)
-		fmt.Fprint(w, "unauthorized")
+		writeErrorAt(w, r, as.Clock.Now(), 401, "unauthorized")
 		return
 	}
 
-	uuid, err := uuid.Parse(authHeader)
+	uuid, err := parseSessionToken(authHeader)
 	if err != nil {
 		log.Error().Str("Authorisation", authHeader).Msg("not a uuid")
-		w.WriteHeader(400)
-		fmt.Fprint(w, "invalid authorization")
+		writeErrorAt(w, r, as.Clock.Now(), 400, "invalid authorization")
 		return
 	}
 
 	val, ok := as.AuthMap.Load(uuid)
 	if !ok {
 		log.Error().Str("Authorisation", authHeader).Msg("not in session cache")
-		w.WriteHeader(401)
-		fmt.Fprintf(w, "invalid authorization")
+		writeErrorAt(w, r, as.Clock.Now(), 401, "invalid authorization")
+		return
+	}
+
+	sess, ok := val.(*Session)
+	if !ok {
+		log.Error().Str("Authorisation", authHeader).Msgf("invalid session cache entry of type %T", val)
+		writeErrorAt(w, r, as.Clock.Now(), 401, "invalid authorization")
+		return
+	}
+
+	if !sess.Account.IsValid() {
+		log.Error().Str("Authorisation", authHeader).Int("account_id", int(sess.Account)).Msg("session of an invalid account")
+		writeErrorAt(w, r, as.Clock.Now(), 401, "invalid authorization")
+		return
+	}
+
+	renewed := *sess
+	if !renewed.isValidAt(as.Clock.Now(), as.Grace, as.Skew) {
+		writeErrorAt(w, r, as.Clock.Now(), 401, "session expired")
 		return
 	}
 
-	sess := val.(*Session)
-	if !sess.IsValid() {
-		w.WriteHeader(401)
-		fmt.Fprintf(w, "session expired")
+	if !renewed.Expiration.Equal(sess.Expiration) {
+		if !as.replaceSession(sess, &renewed) {
+			writeErrorAt(w, r, as.Clock.Now(), 401, "invalid authorization")
+			return
+		}
+		sess = &renewed
+	}
+
+	if sess.MustChangePIN && r.URL.Path != "/pin" {
+		writeErrorAt(w, r, as.Clock.Now(), 403, "PIN change required")
 		return
 	}
 
@@ -110,50 +467,392 @@ func (as AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Server serves the main routes for the public API
 type Server struct {
-	as  AuthServer
-	db  *persistence.DB
-	mux *http.ServeMux
+	aa       AdminAuth
+	as       AuthServer
+	cfg      Config
+	clock    clock.Clock
+	db       Store
+	handler  http.Handler
+	inFlight *accountLimiter
+	// requestSlots holds a token per request being served, nil if
+	// concurrent requests are not limited
+	requestSlots chan struct{}
+	challenges   *challengeStore
+	idempotency  IdempotencyStore
+
+	// maintenance is non-zero when money movements are disabled, accessed
+	// atomically
+	maintenance int32
+	// draining is non-zero once the server shuts down, accessed atomically
+	draining int32
+}
+
+// NewServer returns a Server operating on `db'
+func NewServer(db *persistence.DB, cfg Config) *Server {
+	return NewServerWithDeps(Deps{Store: db}, cfg)
 }
 
-func NewServer(db *persistence.DB) *Server {
+// NewServerWithDeps returns a Server operating on `deps'
+func NewServerWithDeps(deps Deps, cfg Config) *Server {
+	if deps.Clock == nil {
+		deps.Clock = clock.System
+	}
+
 	srv := &Server{
-		db: db,
+		cfg:      cfg,
+		clock:    deps.Clock,
+		db:       deps.Store,
+		inFlight: newAccountLimiter(cfg.MaxInFlightPerAccount),
+	}
+	srv.challenges = newChallengeStore(cfg.LoginChallengeLifetime, cfg.MaxLoginChallenges, deps.Clock)
+	srv.idempotency = deps.Idempotency
+	if srv.idempotency == nil {
+		srv.idempotency = newMemoryIdempotencyStore(deps.Clock)
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		srv.requestSlots = make(chan struct{}, cfg.MaxConcurrentRequests)
 	}
 
+	// routes lists the exact routes, which are also served with a trailing
+	// slash
+	routes := map[string]bool{}
+
 	mux := &http.ServeMux{}
-	mux.HandleFunc("/login", srv.login)
+	handlePublic := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, srv.withTimeout(pattern, handler))
+		if !strings.HasSuffix(pattern, "/") {
+			routes[pattern] = true
+		}
+	}
 
+	handlePublic("/", srv.root)
+	handlePublic("/login", srv.login)
+	handlePublic("/login/challenge", srv.getLoginChallenge)
+	handlePublic("/login/check", srv.checkLogin)
+	handlePublic("/version", srv.getVersion)
+	handlePublic("/config/public", srv.getPublicConfig)
+	handlePublic("/healthz", srv.getHealth)
+
+	// Authenticated routes are mounted one by one behind the AuthServer, so
+	// unknown paths are not mistaken for routes requiring authentication.
 	authRoutesHandlers := &http.ServeMux{}
-	authRoutesHandlers.HandleFunc("/balance", srv.getBalance)
-	authRoutesHandlers.HandleFunc("/deposit", srv.doDeposit)
-	authRoutesHandlers.HandleFunc("/withdraw", srv.doWithdrawal)
+	srv.as = NewAuthServer(authRoutesHandlers, cfg.SessionMode, cfg.SessionGrace)
+	srv.as.Clock = deps.Clock
+	srv.as.Skew = cfg.SessionClockSkew
+	if deps.Sessions != nil {
+		srv.as.AuthMap = deps.Sessions
+	}
+	if cfg.SessionSweepInterval > 0 {
+		go srv.as.sweepEvery(cfg.SessionSweepInterval)
+	}
+	if cfg.SessionSnapshotPath != "" && cfg.SessionSnapshotInterval > 0 {
+		go srv.as.snapshotEvery(cfg.SessionSnapshotPath, cfg.SessionSnapshotInterval)
+	}
+	handleAuth := func(pattern string, handler http.HandlerFunc) {
+		authRoutesHandlers.Handle(pattern, srv.withTimeout(pattern, handler))
+		mux.Handle(pattern, srv.noStore(srv.as))
+		if !strings.HasSuffix(pattern, "/") {
+			routes[pattern] = true
+		}
+	}
+
+	handleAuth("/balance", srv.getBalance)
+	handleAuth("/deposit", srv.unlessMaintenance(srv.idempotent(srv.doDeposit)))
+	handleAuth("/withdraw", srv.unlessMaintenance(srv.idempotent(srv.doWithdrawal)))
+	handleAuth("/withdraw/breakdown", srv.getWithdrawalBreakdown)
+	handleAuth("/withdraw/max", srv.getMaxWithdrawal)
+	handleAuth("/withdraw/hold", srv.unlessMaintenance(srv.idempotent(srv.placeHold)))
+	handleAuth("/withdraw/capture/", srv.unlessMaintenance(srv.captureHold))
+	handleAuth("/withdraw/release/", srv.releaseHold)
+	handleAuth("/transfer/batch", srv.unlessMaintenance(srv.idempotent(srv.doBatchTransfer)))
+	handleAuth("/session/rotate", srv.rotateSession)
+	handleAuth("/session/reauth", srv.reauthenticate)
+	handleAuth("/sessions", srv.listSessions)
+	handleAuth("/sessions/", srv.revokeSession)
+	handleAuth("/transactions", srv.listTransactions)
+	handleAuth("/transactions/", srv.transaction)
+	handleAuth("/summary", srv.getSummary)
+	handleAuth("/summary/by-category", srv.getSummaryByCategory)
+	handleAuth("/statement", srv.getStatement)
+	handleAuth("/pin", srv.requireFreshAuth(srv.changePIN))
+	handleAuth("/accounts/close", srv.unlessMaintenance(srv.requireFreshAuth(srv.closeOwnAccount)))
+
+	adminRoutesHandlers := &http.ServeMux{}
+	handleAdmin := func(pattern string, handler http.HandlerFunc) {
+		adminRoutesHandlers.Handle(pattern, srv.withTimeout(pattern, handler))
+		if !strings.HasSuffix(pattern, "/") {
+			routes[pattern] = true
+		}
+	}
+
+	handleAdmin("/admin/accounts", srv.createAccount)
+	handleAdmin("/admin/accounts/", srv.adminAccount)
+	handleAdmin("/admin/maintenance", srv.adminMaintenance)
+	handleAdmin("/admin/db/maintenance", srv.adminDBMaintenance)
+	handleAdmin("/admin/low-balances/check", srv.adminFlagLowBalances)
+	handleAdmin("/admin/stats", srv.adminStats)
+	handleAdmin("/admin/sessions/", srv.adminRevokeSessions)
+	handleAdmin("/admin/balances", srv.adminBalances)
+	handleAdmin("/admin/transactions/purge", srv.adminPurgeTransactions)
+	handleAdmin("/admin/audit", srv.adminAudit)
 
-	srv.as = NewAuthServer(authRoutesHandlers)
-	mux.Handle("/", srv.as)
+	srv.aa = NewAdminAuth(cfg.AdminKey, adminRoutesHandlers)
+	srv.aa.Proxies = cfg.TrustedProxies
+	srv.aa.Clock = deps.Clock
+	mux.Handle("/admin/", srv.noStore(srv.aa))
 
-	srv.mux = mux
+	srv.handler = requestIDs(srv.rejectWhenDraining(srv.securityHeaders(srv.limitHeaders(srv.shedLoad(srv.recoverPanics(srv.clientTimeout(trimTrailingSlash(routes, mux))))))))
 
 	return srv
 }
 
+type rootResponse struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+}
+
+// root serves a banner on GET /, so the service can be probed without
+// authentication
+func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		s.writeError(w, r, 404, "not found")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	s.writeResponse(w, r, 200, rootResponse{
+		Service: s.cfg.Banner,
+		Version: version.Version,
+	})
+}
+
+type versionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// getVersion serves the build information of the service
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	s.writeResponse(w, r, 200, versionResponse{
+		Version:   version.Version,
+		Commit:    version.Commit,
+		BuildDate: version.BuildDate,
+	})
+}
+
 func (s *Server) login(w http.ResponseWriter, r *http.Request) {
-	hdr := r.Header.Get("nip")
-	if hdr == "" {
-		w.WriteHeader(400)
-		fmt.Fprint(w, "missing header: 'nip'")
+	acc, temporary, ok := s.authenticate(w, r, false)
+	if !ok {
 		return
 	}
 
-	acc, err := s.db.Auth(hdr)
-	if err != nil {
-		w.WriteHeader(400)
-		fmt.Fprint(w, "invalid nip")
+	if temporary {
+		sess, err := s.as.NewPINChangeSession(acc)
+		if err != nil {
+			logError(err).Msg("failed to open session")
+			s.writeInternalError(w, r, err, "failed to open session")
+			return
+		}
+		w.Header().Add("SessionID", sess.ID.String())
+		w.Header().Add("PINChangeRequired", "true")
 		return
 	}
 
 	sess, err := s.as.NewSession(acc)
+	if err != nil {
+		logError(err).Msg("failed to open session")
+		s.writeInternalError(w, r, err, "failed to open session")
+		return
+	}
 	w.Header().Add("SessionID", sess.ID.String())
-	return
+}
+
+// checkLogin verifies the PIN, or the answer to a login challenge, like
+// /login, on POST /login/check, without opening a session, so monitoring
+// probes do not fill the session store
+//
+// Temporary PINs are checked without being used up, so they still open a
+// session on /login afterwards.
+func (s *Server) checkLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	_, _, ok := s.authenticate(w, r, true)
+	if !ok {
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+// authenticate checks the PIN, or the answer to a login challenge, given in
+// the headers of `r', and replies the error if they do not match an account
+//
+// `temporary' tells whether the account was authenticated with a temporary
+// PIN, `ok' whether it was authenticated at all. Temporary PINs are used up,
+// unless only checked with `checkOnly'.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, checkOnly bool) (acc persistence.Account, temporary bool, ok bool) {
+	var err error
+	if r.Header.Get("nip-hmac") != "" {
+		cardNumber, nonce, response, answered := s.readChallengeAnswer(w, r)
+		if !answered {
+			return
+		}
+
+		acc, err = s.db.AuthChallenge(cardNumber, nonce, response)
+	} else {
+		if !s.cfg.PlaintextLogin {
+			s.writeError(w, r, 400, "plaintext PIN login disabled, answer a challenge from /login/challenge")
+			return
+		}
+
+		hdr := r.Header.Get("nip")
+		if hdr == "" {
+			s.writeError(w, r, 400, "missing header: 'nip'")
+			return
+		}
+
+		if checkOnly {
+			acc, temporary, err = s.db.CheckPIN(hdr)
+		} else {
+			acc, temporary, err = s.db.Auth(hdr)
+		}
+	}
+	if errors.Is(err, persistence.ErrNoAccount) {
+		log.Warn().Str("client_ip", s.cfg.TrustedProxies.ClientIP(r)).Msg("login with an invalid PIN")
+		s.writeError(w, r, 401, "invalid nip")
+		return
+	}
+	if errors.Is(err, persistence.ErrAccountClosed) {
+		s.writeError(w, r, 403, "account closed")
+		return
+	}
+	if errors.Is(err, persistence.ErrAccountNotAllowed) {
+		log.Warn().Err(err).Str("client_ip", s.cfg.TrustedProxies.ClientIP(r)).Msg("login to account outside of the allowlist")
+		s.writeError(w, r, 403, "account not allowed")
+		return
+	}
+	if err != nil {
+		logError(err).Msg("authentication failed")
+		s.writeInternalError(w, r, err, "failed to authenticate")
+		return
+	}
+
+	return acc, temporary, true
+}
+
+func (s *Server) rotateSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	newSess, err := s.as.RotateSession(sess.ID)
+	if err != nil {
+		log.Error().Err(err).Int("account_id", int(sess.Account)).Msg("failed to rotate session")
+		s.writeError(w, r, 401, "invalid authorization")
+		return
+	}
+
+	w.Header().Add("SessionID", newSess.ID.String())
+}
+
+type sessionResponse struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+}
+
+// listSessions outputs the active sessions of the account
+//
+// Sessions are identified by their redacted ID, never by their token.
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	resp := []sessionResponse{}
+	for _, other := range s.as.AccountSessions(sess.Account) {
+		resp = append(resp, sessionResponse{
+			ID:        other.RedactedID(),
+			CreatedAt: other.Created,
+			ExpiresAt: other.Expiration,
+			Current:   other.ID == sess.ID,
+		})
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+// revokeSession invalidates a session of the account, on DELETE
+// /sessions/{id} with `id' the redacted ID of the session
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	err := s.as.RevokeSession(sess.Account, strings.TrimPrefix(r.URL.Path, "/sessions/"))
+	if err != nil {
+		s.writeError(w, r, 404, "no such session")
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+type balanceResponse struct {
+	// Balance is the balance in units of the currency, as output before
+	// BalanceMinor, for compatibility
+	Balance int64 `json:"balance"`
+	// BalanceMinor is the balance in the minor unit of the currency, e.g.
+	// in cents
+	BalanceMinor int64 `json:"balance_minor"`
+	// Currency is the ISO 4217 code of the currency of the balance
+	Currency string `json:"currency"`
+	// BalanceDisplay is the balance formatted with its currency for the
+	// locale of the client, so clients do not have to format it themselves
+	BalanceDisplay   string     `json:"balance_display"`
+	TransactionCount *int64     `json:"transaction_count,omitempty"`
+	LastActivity     *time.Time `json:"last_activity,omitempty"`
+	// LowBalanceFlaggedAt is when the account was flagged for keeping its
+	// balance below the minimum active balance, absent if it is not flagged
+	LowBalanceFlaggedAt *time.Time `json:"low_balance_flagged_at,omitempty"`
 }
 
 func (s *Server) getBalance(w http.ResponseWriter, r *http.Request) {
@@ -163,18 +862,148 @@ func (s *Server) getBalance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sess := sessItf.(*Session)
+
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		s.getBalanceAsOf(w, r, sess, asOf)
+		return
+	}
+
 	balance, err := s.db.Balance(sess.Account)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no balance available")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get balance")
+		s.writeInternalError(w, r, err, "failed to get balance")
+		return
+	}
+
+	resp := balanceResponse{
+		Balance: balance,
+	}
+
+	if r.URL.Query().Get("stats") == "true" && !wantsText(r) {
+		stats, err := s.db.AccountStats(sess.Account)
+		if err != nil {
+			logError(err).Int("account_id", int(sess.Account)).Msg("failed to get account stats")
+			s.writeInternalError(w, r, err, "failed to get account stats")
+			return
+		}
+
+		resp.TransactionCount = &stats.TransactionCount
+		if !stats.LastActivity.IsZero() {
+			resp.LastActivity = &stats.LastActivity
+		}
+	}
+
+	if !wantsText(r) {
+		flaggedAt, err := s.db.LowBalanceFlag(sess.Account)
+		if err != nil {
+			logError(err).Int("account_id", int(sess.Account)).Msg("failed to get low balance flag")
+			s.writeInternalError(w, r, err, "failed to get balance")
+			return
+		}
+
+		if !flaggedAt.IsZero() {
+			resp.LowBalanceFlaggedAt = &flaggedAt
+		}
+	}
+
+	s.writeBalance(w, r, resp)
+}
+
+// wantsText returns whether the client asked for a plain text response,
+// through `?format=text' or by accepting text/plain before application/json
+//
+// This keeps the bare integer output of /balance available to legacy clients.
+func wantsText(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "text":
+		return true
+	case "json":
+		return false
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+
+	return false
+}
+
+// writeBalance outputs the balance as negotiated with the client: the bare
+// balance in plain text, or the full response as JSON, with the balance in
+// the minor unit of the currency, and formatted for the locale of the client
+func (s *Server) writeBalance(w http.ResponseWriter, r *http.Request, resp balanceResponse) {
+	if wantsText(r) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%d", resp.Balance)
+		return
+	}
+
+	locale := requestLocale(r)
+	if locale != "" {
+		w.Header().Set("Content-Language", locale)
+	}
+	resp.Currency = s.cfg.Currency
+	resp.BalanceMinor = currencies[s.cfg.Currency].minorUnits(resp.Balance)
+	resp.BalanceDisplay = formatMoney(resp.Balance, s.cfg.Currency, locale)
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+// getBalanceAsOf outputs the balance of the account at the RFC 3339 timestamp
+// `asOf'
+func (s *Server) getBalanceAsOf(w http.ResponseWriter, r *http.Request, sess *Session, asOf string) {
+	at, err := time.Parse(time.RFC3339, asOf)
 	if err != nil {
-		log.Error().Err(err).Int("account_id", int(sess.Account)).Msg("failed to get balance")
+		s.writeError(w, r, 400, "invalid as_of, expected an RFC 3339 timestamp")
+		return
 	}
 
-	fmt.Fprintf(w, "%d", balance)
+	if at.After(s.clock.Now()) {
+		s.writeError(w, r, 400, "as_of must not be in the future")
+		return
+	}
+
+	balance, err := s.db.BalanceAsOf(sess.Account, at)
+	if errors.Is(err, persistence.ErrHistoryPurged) {
+		s.writeError(w, r, 410, "transaction history purged before as_of")
+		return
+	}
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no balance available")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get balance")
+		s.writeInternalError(w, r, err, "failed to get balance")
+		return
+	}
+
+	s.writeBalance(w, r, balanceResponse{
+		Balance: balance,
+	})
 }
 
 func (s *Server) doDeposit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(405)
-		fmt.Fprint(w, "not allowed")
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
 		return
 	}
 
@@ -185,31 +1014,45 @@ func (s *Server) doDeposit(w http.ResponseWriter, r *http.Request) {
 
 	sess := sessItf.(*Session)
 
-	depAmount := int64(-1)
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&depAmount)
+	depAmount, category, err := s.decodeDeposit(r, s.cfg.Denominations)
+	if errors.Is(err, cash.ErrUnknownDenomination) {
+		log.Error().Err(err).Msg("deposit of unknown denomination")
+		s.writeError(w, r, 422, err.Error())
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("failed to decode deposit amount")
+		s.writeDecodeError(w, r, err, "invalid amount")
+		return
+	}
+
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
 	}
+	defer s.inFlight.release(sess.Account)
 
-	err = s.db.DoTransaction(sess.Account, persistence.Transaction{
-		Type:   persistence.Deposit,
-		Amount: depAmount,
+	id, err := s.db.DoTransaction(r.Context(), sess.Account, persistence.Transaction{
+		Type:     persistence.Deposit,
+		Amount:   depAmount,
+		Category: category,
 	})
 	if err != nil {
-		log.Error().Err(err).Msg("transaction failed")
-		w.WriteHeader(500)
-		fmt.Fprint(w, "failed to perform deposit")
+		logError(err).Msg("transaction failed")
+		s.writeTransactionError(w, r, err, "failed to perform deposit")
 		return
 	}
 
-	fmt.Fprint(w, "ok")
+	s.writeTransactionID(w, r, id)
 }
 
 func (s *Server) doWithdrawal(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(405)
-		fmt.Fprint(w, "not allowed")
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
 		return
 	}
 
@@ -220,27 +1063,442 @@ func (s *Server) doWithdrawal(w http.ResponseWriter, r *http.Request) {
 
 	sess := sessItf.(*Session)
 
-	depAmount := int64(-1)
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&depAmount)
+	depAmount, category, err := s.decodeAmount(r)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to decode withdrawn amount")
+		s.writeDecodeError(w, r, err, "invalid amount")
+		return
+	}
+
+	_, err = s.withdrawalBreakdown(depAmount)
+	if err != nil {
+		log.Error().Err(err).Int64("amount", depAmount).Msg("withdrawal cannot be dispensed")
+		s.writeError(w, r, 422, err.Error())
+		return
 	}
 
-	err = s.db.DoTransaction(sess.Account, persistence.Transaction{
-		Type:   persistence.Withdrawal,
-		Amount: depAmount,
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
+	}
+	defer s.inFlight.release(sess.Account)
+
+	id, err := s.db.DoTransaction(r.Context(), sess.Account, persistence.Transaction{
+		Type:     persistence.Withdrawal,
+		Amount:   depAmount,
+		Category: category,
+	})
+	if err != nil {
+		logError(err).Msg("transaction failed")
+		s.writeTransactionError(w, r, err, "failed to perform withdrawal")
+		return
+	}
+
+	s.writeTransactionID(w, r, id)
+}
+
+type transactionIDResponse struct {
+	TransactionID int64 `json:"transaction_id"`
+}
+
+// writeTransactionID replies to a successful deposit or withdrawal with the ID
+// of the recorded transaction
+func (s *Server) writeTransactionID(w http.ResponseWriter, r *http.Request, id int64) {
+	s.writeResponse(w, r, 200, transactionIDResponse{
+		TransactionID: id,
 	})
+}
+
+type batchCredit struct {
+	To     persistence.Account `json:"to"`
+	Amount int64               `json:"amount"`
+}
+
+// doBatchTransfer debits the account and credits several accounts on POST
+// /transfer/batch, atomically unless ?mode=independent is given, in which
+// case every credit is applied on its own and reported
+func (s *Server) doBatchTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	independent := false
+	switch r.URL.Query().Get("mode") {
+	case "", "atomic":
+	case "independent":
+		independent = true
+	default:
+		s.writeError(w, r, 400, "invalid mode, expected atomic or independent")
+		return
+	}
+
+	var batch []batchCredit
+	err := s.decodeJSON(r.Body, &batch)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode batch transfer")
+		s.writeDecodeError(w, r, err, "invalid batch")
+		return
+	}
+
+	if len(batch) == 0 {
+		s.writeError(w, r, 400, "empty batch")
+		return
+	}
+
+	if len(batch) > s.cfg.MaxBatchRecipients {
+		s.writeErrorf(w, r, 400, "too many recipients, at most %d allowed", s.cfg.MaxBatchRecipients)
+		return
+	}
+
+	credits := make([]persistence.Credit, 0, len(batch))
+	for _, c := range batch {
+		credits = append(credits, persistence.Credit{
+			To:     c.To,
+			Amount: c.Amount,
+		})
+	}
+
+	// Invalid amounts are rejected for the whole batch, even in independent
+	// mode, as they would make the total compared to LargeTransferAmount
+	// meaningless
+	total, err := persistence.CreditsTotal(credits)
 	if err != nil {
-		log.Error().Err(err).Msg("transaction failed")
-		w.WriteHeader(500)
-		fmt.Fprint(w, "failed to perform deposit")
+		log.Error().Err(err).Msg("invalid batch transfer")
+		s.writeError(w, r, 400, err.Error())
+		return
+	}
+
+	if s.cfg.LargeTransferAmount > 0 && total >= s.cfg.LargeTransferAmount && !s.checkFreshAuth(w, r, sess) {
+		return
+	}
+
+	if !s.inFlight.acquire(sess.Account) {
+		s.writeError(w, r, 429, "too many transactions in progress")
+		return
+	}
+	defer s.inFlight.release(sess.Account)
+
+	if independent {
+		s.writeBatchResults(w, r, sess.Account, batch, s.db.TransferEach(r.Context(), sess.Account, credits))
+		return
+	}
+
+	err = s.db.FanOutTransfer(r.Context(), sess.Account, credits)
+	if err != nil {
+		logError(err).Msg("batch transfer failed")
+		s.writeTransactionError(w, r, err, "failed to perform transfer")
 		return
 	}
 
 	fmt.Fprint(w, "ok")
 }
 
+type batchResult struct {
+	To     persistence.Account `json:"to"`
+	Amount int64               `json:"amount"`
+	OK     bool                `json:"ok"`
+	// Error is the reason the credit failed, empty if it was applied
+	Error string `json:"error,omitempty"`
+}
+
+type batchResultsResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchFailureReasons are the errors of a credit reported to the client as
+// is; other errors are reported as a generic failure, so internal details do
+// not leak
+var batchFailureReasons = []error{
+	persistence.ErrInsufficientFunds,
+	persistence.ErrNoAccount,
+	persistence.ErrInvalidAccount,
+	persistence.ErrAccountClosed,
+	persistence.ErrInvalidTransaction,
+	persistence.ErrAmountOverflow,
+	persistence.ErrAboveMaxWithdrawal,
+	persistence.ErrDailyLimitExceeded,
+	persistence.ErrWithdrawalTooSoon,
+	persistence.ErrOutsideBusinessHours,
+	persistence.ErrBusy,
+	persistence.ErrQueryTimeout,
+	persistence.ErrCircuitOpen,
+}
+
+// batchFailureReason returns the reason of the failure `err' of a credit
+func batchFailureReason(err error) string {
+	for _, reason := range batchFailureReasons {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+
+	return "transfer failed"
+}
+
+// writeBatchResults outputs the outcome of every credit of a batch transfer
+// made with ?mode=independent, `errs' being their errors in order
+func (s *Server) writeBatchResults(w http.ResponseWriter, r *http.Request, from persistence.Account, batch []batchCredit, errs []error) {
+	resp := batchResultsResponse{
+		Results: make([]batchResult, 0, len(batch)),
+	}
+
+	for i, c := range batch {
+		result := batchResult{
+			To:     c.To,
+			Amount: c.Amount,
+			OK:     errs[i] == nil,
+		}
+
+		if errs[i] != nil {
+			logError(errs[i]).Int("account_id", int(from)).Int("to", int(c.To)).Msg("batch credit failed")
+			result.Error = batchFailureReason(errs[i])
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+// amountRequest is the body of a transaction, either a bare amount or an
+// object
+type amountRequest struct {
+	Amount *int64 `json:"amount"`
+	// Denominations is the number of bills of each denomination deposited
+	Denominations map[int64]int64 `json:"denominations"`
+	// Category labels the transaction for reporting
+	Category string `json:"category"`
+}
+
+// decodeAmountRequest reads the body of `r', either a bare amount or an
+// amountRequest object
+func (s *Server) decodeAmountRequest(r *http.Request) (amountRequest, error) {
+	req := amountRequest{}
+
+	raw := json.RawMessage{}
+	err := s.decodeJSON(r.Body, &raw)
+	if err != nil {
+		return req, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		amount := int64(-1)
+		err = json.Unmarshal(raw, &amount)
+		req.Amount = &amount
+		return req, err
+	}
+
+	err = s.decodeJSON(bytes.NewReader(raw), &req)
+	if err != nil {
+		return req, err
+	}
+
+	if (req.Amount == nil) == (req.Denominations == nil) {
+		return req, errors.New("exactly one of amount and denominations is required")
+	}
+
+	return req, nil
+}
+
+// decodeAmount reads the amount and category of a transaction from the body
+// of `r'
+func (s *Server) decodeAmount(r *http.Request) (amount int64, category string, err error) {
+	req, err := s.decodeAmountRequest(r)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if req.Amount == nil {
+		return -1, "", errors.New("amount is required")
+	}
+
+	return *req.Amount, req.Category, nil
+}
+
+// decodeDeposit reads the amount and category of a deposit from the body of
+// `r', the amount being given either as is or as bill counts per denomination
+//
+// Bills of denominations not in `accepted' are refused with
+// cash.ErrUnknownDenomination.
+func (s *Server) decodeDeposit(r *http.Request, accepted []int64) (amount int64, category string, err error) {
+	req, err := s.decodeAmountRequest(r)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if req.Denominations != nil {
+		amount, err = cash.SumDenominations(req.Denominations, accepted)
+		return amount, req.Category, err
+	}
+
+	return *req.Amount, req.Category, nil
+}
+
+// errEmptyBody is returned when decoding a request without body
+var errEmptyBody = errors.New("request body required")
+
+// errTrailingData is returned when decoding a request whose body holds more
+// than one JSON value
+var errTrailingData = errors.New("unexpected data after the JSON value")
+
+// decodeJSON decodes the JSON value of `body' into `v'
+//
+// Unless lenient decoding is configured, objects with fields unknown to `v'
+// are rejected. Fails with errEmptyBody if `body' is empty, and with
+// errTrailingData if it holds more than one value.
+func (s *Server) decodeJSON(body io.Reader, v interface{}) error {
+	dec := json.NewDecoder(body)
+	if s.cfg.StrictDecoding {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err == io.EOF {
+		return errEmptyBody
+	}
+	if err != nil {
+		return err
+	}
+
+	// A body holding several values, e.g. `100 200', is as malformed as a
+	// truncated one
+	if dec.Decode(&json.RawMessage{}) != io.EOF {
+		return errTrailingData
+	}
+
+	return nil
+}
+
+// writeDecodeError replies with 400 to a request whose body could not be
+// decoded, with `msg' unless the body is missing
+func (s *Server) writeDecodeError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	if errors.Is(err, errEmptyBody) {
+		msg = errEmptyBody.Error()
+	}
+
+	s.writeError(w, r, 400, msg)
+}
+
+// requireJSON checks that the body of `r' is declared as JSON, and replies
+// with 415 otherwise
+//
+// Returns whether the handler can proceed with decoding the body.
+func (s *Server) requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != "application/json" {
+		log.Error().Str("Content-Type", ct).Msg("unsupported content type")
+		s.writeError(w, r, 415, "unsupported media type, expected application/json")
+		return false
+	}
+
+	return true
+}
+
+// logError returns the event logging the failure of an operation with `err',
+// an error unless the operation was cancelled by the client going away
+func logError(err error) *zerolog.Event {
+	if errors.Is(err, context.Canceled) {
+		return log.Info().Err(err).Bool("cancelled", true)
+	}
+
+	return log.Error().Err(err)
+}
+
+// writeTransactionError replies to a request whose transaction failed with
+// `err', unless it was cancelled by its client: the client is gone and would
+// not receive the response
+func (s *Server) writeTransactionError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	setRetryAfter(w, err)
+	s.writeError(w, r, transactionErrorStatus(err), msg)
+}
+
+// writeInternalError replies to an unexpected failure of the persistence
+// layer: with 503 while the database is unavailable, 500 otherwise, and not
+// at all if the request was cancelled by its client, like
+// writeTransactionError
+func (s *Server) writeInternalError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if errors.Is(err, persistence.ErrCircuitOpen) {
+		setRetryAfter(w, err)
+		s.writeError(w, r, 503, msg)
+		return
+	}
+
+	s.writeError(w, r, 500, msg)
+}
+
+// setRetryAfter sets the Retry-After header for errors telling when the
+// operation can be retried
+func setRetryAfter(w http.ResponseWriter, err error) {
+	retryAfter := time.Duration(0)
+
+	tooSoon := &persistence.WithdrawalTooSoonError{}
+	circuitOpen := &persistence.CircuitOpenError{}
+	switch {
+	case errors.As(err, &tooSoon):
+		retryAfter = tooSoon.RetryAfter
+	case errors.As(err, &circuitOpen):
+		retryAfter = circuitOpen.RetryAfter
+	default:
+		return
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// transactionErrorStatus maps the errors returned by DoTransaction to HTTP
+// statuses
+func transactionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, persistence.ErrWithdrawalTooSoon):
+		return 429
+	case errors.Is(err, persistence.ErrNoAccount), errors.Is(err, persistence.ErrNoHold):
+		return 404
+	case errors.Is(err, persistence.ErrInsufficientFunds), errors.Is(err, persistence.ErrAboveMaxWithdrawal),
+		errors.Is(err, persistence.ErrDailyLimitExceeded), errors.Is(err, persistence.ErrOutsideBusinessHours):
+		return 422
+	case errors.Is(err, persistence.ErrInvalidTransaction), errors.Is(err, persistence.ErrInvalidCategory),
+		errors.Is(err, persistence.ErrInvalidAccount):
+		return 400
+	case errors.Is(err, persistence.ErrAmountOverflow):
+		return 422
+	case errors.Is(err, persistence.ErrAccountClosed):
+		return 403
+	case errors.Is(err, persistence.ErrNonZeroBalance):
+		return 409
+	case errors.Is(err, persistence.ErrBusy), errors.Is(err, persistence.ErrQueryTimeout),
+		errors.Is(err, persistence.ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded):
+		return 503
+	}
+
+	return 500
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mux.ServeHTTP(w, r)
+	s.handler.ServeHTTP(w, r)
 }
@@ -0,0 +1,646 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// newTestServer returns a server on the in-memory persistence, with the
+// default configuration changed by `configure', if any
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, *persistence.Memory) {
+	t.Helper()
+
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	cfg := DefaultConfig()
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	return NewServerWithDeps(Deps{Store: store}, cfg), store
+}
+
+// createAccount creates an account with `pin' and an opening `balance'
+func createAccount(t *testing.T, store *persistence.Memory, pin string, balance int64) persistence.Account {
+	t.Helper()
+
+	acc, _, err := store.CreateAccount(pin, fmt.Sprintf("497010%s000000", pin), "", balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return acc
+}
+
+// newRequest returns a request to `target', sent as JSON when it has a body,
+// on the session `sessionID' unless empty
+func newRequest(method, target, sessionID, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if sessionID != "" {
+		r.Header.Set("Authorization", sessionID)
+	}
+
+	return r
+}
+
+// serve returns the response of `h' to `r'
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+// login opens a session with `pin' and returns its ID
+func login(t *testing.T, h http.Handler, pin string) string {
+	t.Helper()
+
+	r := newRequest(http.MethodGet, "/login", "", "")
+	r.Header.Set("nip", pin)
+
+	w := serve(h, r)
+	if w.Code != 200 {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	return w.Header().Get("SessionID")
+}
+
+// wantStatus fails the test unless `w' has `want' for status, and carries it
+// in the error envelope if it is an error
+func wantStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body)
+	}
+	if want < 400 || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		return
+	}
+
+	var env errorEnvelope
+	err := json.Unmarshal(w.Body.Bytes(), &env)
+	if err != nil {
+		t.Fatalf("error envelope: %v: %s", err, w.Body)
+	}
+	if env.Error.Status != want {
+		t.Errorf("envelope status = %d, want %d", env.Error.Status, want)
+	}
+}
+
+func TestTransactionErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{persistence.ErrNoAccount, 404},
+		{persistence.ErrNoHold, 404},
+		{persistence.ErrInsufficientFunds, 422},
+		{persistence.ErrAboveMaxWithdrawal, 422},
+		{persistence.ErrDailyLimitExceeded, 422},
+		{persistence.ErrOutsideBusinessHours, 422},
+		{persistence.ErrAmountOverflow, 422},
+		{persistence.ErrInvalidTransaction, 400},
+		{persistence.ErrInvalidCategory, 400},
+		{persistence.ErrInvalidAccount, 400},
+		{persistence.ErrAccountClosed, 403},
+		{persistence.ErrNonZeroBalance, 409},
+		{&persistence.WithdrawalTooSoonError{}, 429},
+		{persistence.ErrBusy, 503},
+		{persistence.ErrQueryTimeout, 503},
+		{persistence.ErrCircuitOpen, 503},
+		{context.DeadlineExceeded, 503},
+		{persistence.ErrInternal, 500},
+	}
+
+	for _, test := range tests {
+		// Errors are matched with errors.Is, through the wrapping of the
+		// persistence layer
+		err := fmt.Errorf("account 1: %w", test.err)
+		if got := transactionErrorStatus(err); got != test.want {
+			t.Errorf("transactionErrorStatus(%v) = %d, want %d", err, got, test.want)
+		}
+	}
+}
+
+func TestWriteInternalError(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{persistence.ErrInternal, 500},
+		{&persistence.CircuitOpenError{}, 503},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		srv.writeInternalError(w, httptest.NewRequest(http.MethodGet, "/", nil), test.err, "failed")
+		wantStatus(t, w, test.want)
+	}
+}
+
+// headerRecorder records whether a status was written
+type headerRecorder struct {
+	*httptest.ResponseRecorder
+	wroteHeader bool
+}
+
+func (w *headerRecorder) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *headerRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestCancelledRequestsNotReplied(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	err := fmt.Errorf("account 1: %w", context.Canceled)
+
+	writers := map[string]func(http.ResponseWriter, *http.Request, error, string){
+		"transaction": srv.writeTransactionError,
+		"internal":    srv.writeInternalError,
+	}
+
+	for name, write := range writers {
+		w := &headerRecorder{ResponseRecorder: httptest.NewRecorder()}
+		write(w, httptest.NewRequest(http.MethodPost, "/deposit", nil), err, "failed")
+		if w.wroteHeader {
+			t.Errorf("%s error replied to a cancelled request: %d %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+// cancellingStore cancels the request of the first transaction, as if its
+// client went away while it was performed
+type cancellingStore struct {
+	*persistence.Memory
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) DoTransaction(ctx context.Context, acc persistence.Account, tx persistence.Transaction) (int64, error) {
+	if s.cancel == nil {
+		return s.Memory.DoTransaction(ctx, acc, tx)
+	}
+
+	s.cancel()
+	s.cancel = nil
+	<-ctx.Done()
+	return -1, fmt.Errorf("account %d: %w", acc, ctx.Err())
+}
+
+func TestCancelledTransaction(t *testing.T) {
+	memory := persistence.NewMemory(persistence.DefaultConfig())
+	acc := createAccount(t, memory, "4623", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &cancellingStore{Memory: memory, cancel: cancel}
+	srv := NewServerWithDeps(Deps{Store: store}, DefaultConfig())
+	sessionID := login(t, srv, "4623")
+
+	r := newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`)
+	r.Header.Set(IdempotencyKeyHeader, "deposit-1")
+	serve(srv, r.WithContext(ctx))
+
+	// The cancelled request is not recorded as the response to its key, so
+	// its retry is performed
+	r = newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`)
+	r.Header.Set(IdempotencyKeyHeader, "deposit-1")
+	w := serve(srv, r)
+	wantStatus(t, w, 200)
+	if w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("retry of a cancelled request replayed")
+	}
+
+	balance, err := memory.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 100 {
+		t.Errorf("balance = %d, want 100", balance)
+	}
+}
+
+func TestTransactionErrorsReplied(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 100)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		target, body string
+		want         int
+	}{
+		{"/withdraw", `{"amount":200}`, 422},
+		{"/withdraw", `{"amount":0}`, 400},
+		{"/withdraw/capture/1000", "", 404},
+	}
+
+	for _, test := range tests {
+		w := serve(srv, newRequest(http.MethodPost, test.target, sessionID, test.body))
+		wantStatus(t, w, test.want)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	acc := createAccount(t, store, "4623", 0)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", 200},
+		{"application/json; charset=utf-8", 200},
+		{"text/plain", 415},
+		{"application/x-www-form-urlencoded", 415},
+		{"", 415},
+	}
+
+	for _, test := range tests {
+		r := newRequest(http.MethodPost, "/deposit", sessionID, "100")
+		r.Header.Set("Content-Type", test.contentType)
+
+		w := serve(srv, r)
+		if w.Code != test.want {
+			t.Errorf("Content-Type %q: status = %d, want %d", test.contentType, w.Code, test.want)
+		}
+	}
+
+	balance, err := store.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 200 {
+		t.Errorf("balance = %d, want 200", balance)
+	}
+}
+
+func TestMalformedAmounts(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	acc := createAccount(t, store, "4623", 500)
+	sessionID := login(t, srv, "4623")
+
+	bodies := []string{
+		`{"amount":`,
+		`"100"`,
+		`{"amount":"100"}`,
+		`{"amount":1.5}`,
+		`[100]`,
+		`100 200`,
+		`{"category":"groceries"}`,
+	}
+
+	for _, target := range []string{"/deposit", "/withdraw"} {
+		for _, body := range bodies {
+			w := serve(srv, newRequest(http.MethodPost, target, sessionID, body))
+			if w.Code != 400 {
+				t.Errorf("%s %s: status = %d, want 400", target, body, w.Code)
+			}
+		}
+	}
+
+	// No transaction was attempted
+	txs, err := store.RecentTransactions(acc, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 {
+		t.Errorf("%d transactions recorded, want the opening deposit only", len(txs))
+	}
+}
+
+// fakeClock is a clock.Clock set by the tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestSessionModes(t *testing.T) {
+	tests := []struct {
+		mode SessionMode
+		// want are the statuses of /balance 9m30s after login, then 11m
+		// after login
+		want [2]int
+	}{
+		{SlidingSessions, [2]int{200, 200}},
+		{FixedSessions, [2]int{200, 401}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode.String(), func(t *testing.T) {
+			clk := newFakeClock()
+			store := persistence.NewMemory(persistence.DefaultConfig())
+			createAccount(t, store, "4623", 0)
+
+			cfg := DefaultConfig()
+			cfg.SessionMode = test.mode
+			cfg.SessionGrace = 0
+			srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, cfg)
+			sessionID := login(t, srv, "4623")
+
+			// The first request renews sliding sessions close to their
+			// expiration, so they outlive the second one
+			clk.advance(9*time.Minute + 30*time.Second)
+			wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", sessionID, "")), test.want[0])
+
+			clk.advance(90 * time.Second)
+			wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", sessionID, "")), test.want[1])
+		})
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, mode := range []SessionMode{SlidingSessions, FixedSessions} {
+		sess := newSessionAt(1, mode, now)
+		deadline := sess.Expiration
+
+		// Sessions used within a minute of their expiration are renewed,
+		// unless fixed
+		if !sess.isValidAt(deadline.Add(-30*time.Second), 0, 0) {
+			t.Fatalf("%s session expired before its deadline", mode)
+		}
+
+		wantRenewed := mode == SlidingSessions
+		if renewed := sess.Expiration.After(deadline); renewed != wantRenewed {
+			t.Errorf("%s session renewed: %t, want %t", mode, renewed, wantRenewed)
+		}
+		if valid := sess.isValidAt(deadline, 0, 0); valid != wantRenewed {
+			t.Errorf("%s session valid at its first deadline: %t, want %t", mode, valid, wantRenewed)
+		}
+	}
+}
+
+func TestSessionClockSkew(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	skew := 5 * time.Second
+
+	for _, mode := range []SessionMode{SlidingSessions, FixedSessions} {
+		deadline := newSessionAt(1, mode, now).Expiration
+
+		// Sessions are honored until the skew after their expiration, and
+		// no further without a grace period
+		tests := []struct {
+			at   time.Time
+			skew time.Duration
+			want bool
+		}{
+			{deadline, 0, false},
+			{deadline, skew, true},
+			{deadline.Add(skew - time.Second), skew, true},
+			{deadline.Add(skew), skew, false},
+		}
+
+		for _, test := range tests {
+			sess := newSessionAt(1, mode, now)
+			if valid := sess.isValidAt(test.at, 0, test.skew); valid != test.want {
+				t.Errorf("%s session valid %s after its deadline with a skew of %s: %t, want %t",
+					mode, test.at.Sub(deadline), test.skew, valid, test.want)
+			}
+
+			wantRenewed := test.want && mode == SlidingSessions
+			if renewed := sess.Expiration.After(deadline); renewed != wantRenewed {
+				t.Errorf("%s session renewed %s after its deadline: %t, want %t",
+					mode, test.at.Sub(deadline), renewed, wantRenewed)
+			}
+		}
+	}
+}
+
+func TestSessionClockSkewConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		// after is how long after login /balance is requested
+		after time.Duration
+		want  int
+	}{
+		{"within skew", 10*time.Minute + 4*time.Second, 200},
+		{"at skew", 10*time.Minute + 5*time.Second, 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clk := newFakeClock()
+			store := persistence.NewMemory(persistence.DefaultConfig())
+			createAccount(t, store, "4623", 0)
+
+			cfg := DefaultConfig()
+			cfg.SessionGrace = 0
+			cfg.SessionClockSkew = 5 * time.Second
+			srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, cfg)
+			sessionID := login(t, srv, "4623")
+
+			clk.advance(test.after)
+			wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", sessionID, "")), test.want)
+		})
+	}
+}
+
+func TestAmountBoundaries(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 0)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"0", 400},
+		{"-1", 400},
+		// Above persistence.MaxAmount
+		{"9007199254740993", 422},
+		{"9223372036854775807", 422},
+		// Not an int64
+		{"9223372036854775808", 400},
+		{"9007199254740992", 200},
+	}
+
+	for _, test := range tests {
+		w := serve(srv, newRequest(http.MethodPost, "/deposit", sessionID, test.body))
+		if w.Code != test.want {
+			t.Errorf("deposit of %s: status = %d, want %d", test.body, w.Code, test.want)
+		}
+	}
+}
+
+func TestCorruptedSessionEntry(t *testing.T) {
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	sessions := &sync.Map{}
+	srv := NewServerWithDeps(Deps{Store: store, Sessions: sessions}, DefaultConfig())
+
+	id := uuid.New()
+	sessions.Store(id, "not a session")
+
+	wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", id.String(), "")), 401)
+}
+
+func TestEmptyBody(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	acc := createAccount(t, store, "4623", 500)
+	sessionID := login(t, srv, "4623")
+
+	for _, target := range []string{"/deposit", "/withdraw", "/withdraw/hold"} {
+		r := newRequest(http.MethodPost, target, sessionID, "")
+		r.Header.Set("Content-Type", "application/json")
+
+		w := serve(srv, r)
+		wantStatus(t, w, 400)
+
+		var env errorEnvelope
+		err := json.Unmarshal(w.Body.Bytes(), &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Error.Message != "request body required" {
+			t.Errorf("%s: message = %q, want %q", target, env.Error.Message, "request body required")
+		}
+	}
+
+	// No transaction was attempted
+	txs, err := store.RecentTransactions(acc, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 {
+		t.Errorf("%d transactions recorded, want the opening deposit only", len(txs))
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	srv, store := newTestServer(t, func(cfg *Config) {
+		cfg.AdminKey = "secret"
+	})
+	acc := createAccount(t, store, "4623", 0)
+	sessionID := login(t, srv, "4623")
+
+	// Both forms reach the same handler, rather than being redirected
+	for _, target := range []string{"/deposit", "/deposit/"} {
+		wantStatus(t, serve(srv, newRequest(http.MethodPost, target, sessionID, `{"amount":100}`)), 200)
+	}
+
+	balance, err := store.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 200 {
+		t.Errorf("balance = %d, want 200", balance)
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/balance/", 200},
+		{"/admin/stats/", 200},
+		{"/transactions/1", 200},
+		{"/transactions/1/", 200},
+	}
+
+	for _, test := range tests {
+		r := newRequest(http.MethodGet, test.target, sessionID, "")
+		r.Header.Set(AdminKeyHeader, "secret")
+		if w := serve(srv, r); w.Code != test.want {
+			t.Errorf("%s: status = %d, want %d", test.target, w.Code, test.want)
+		}
+	}
+}
+
+func TestCheckLogin(t *testing.T) {
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	acc := createAccount(t, store, "4623", 0)
+	sessions := &sync.Map{}
+	srv := NewServerWithDeps(Deps{Store: store, Sessions: sessions}, DefaultConfig())
+
+	tempPIN, _, err := store.IssueTempPIN(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pin  string
+		want int
+	}{
+		{"4623", 200},
+		{"8264", 401},
+		{tempPIN, 200},
+		// Temporary PINs are not used up by checks
+		{tempPIN, 200},
+	}
+
+	for _, test := range tests {
+		r := newRequest(http.MethodPost, "/login/check", "", "")
+		r.Header.Set("nip", test.pin)
+		wantStatus(t, serve(srv, r), test.want)
+	}
+
+	sessions.Range(func(key, val interface{}) bool {
+		t.Errorf("session %v opened by a check", key)
+		return true
+	})
+
+	login(t, srv, tempPIN)
+}
+
+func TestSessionTokenForms(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 0)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		name, token string
+		want        int
+	}{
+		{"canonical", sessionID, 200},
+		{"uppercase", strings.ToUpper(sessionID), 200},
+		{"prefixed", "urn:uuid:" + sessionID, 200},
+		{"prefixed uppercase", strings.ToUpper("urn:uuid:" + sessionID), 200},
+		{"surrounding spaces", " " + sessionID + " ", 200},
+		{"unknown", uuid.New().String(), 401},
+		{"malformed", "not-a-session", 400},
+		{"malformed prefixed", "urn:uuid:" + sessionID[:8], 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", test.token, "")), test.want)
+		})
+	}
+}
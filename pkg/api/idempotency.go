@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+// IdempotencyKeyHeader carries the key making a request safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the idempotency keys accepted from clients
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodyBytes bounds the body of requests made with an idempotency
+// key, which is read in full to fingerprint the request
+const maxIdempotentBodyBytes = 1 << 20
+
+// IdempotencyStore records the responses to requests made with an
+// idempotency key, implemented in memory by default, and by
+// *persistence.DB to share them between instances
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey atomically reserves `key' for the request
+	// identified by `fingerprint' until `expiresAt', unless it is already
+	// reserved or has an unexpired response, which is returned instead
+	ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time) (resp persistence.IdempotentResponse, reserved bool, err error)
+	// StoreIdempotentResponse records `resp' for `key' until it expires, in
+	// place of its reservation
+	StoreIdempotentResponse(key string, resp persistence.IdempotentResponse) error
+	// ReleaseIdempotencyKey drops the reservation of `key'
+	ReleaseIdempotencyKey(key string) error
+}
+
+var _ IdempotencyStore = (*persistence.DB)(nil)
+
+// memoryIdempotencyStore keeps idempotent responses in memory, evicting the
+// expired ones as new ones are stored
+type memoryIdempotencyStore struct {
+	clock clock.Clock
+
+	mu        sync.Mutex
+	responses map[string]persistence.IdempotentResponse
+}
+
+func newMemoryIdempotencyStore(clk clock.Clock) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		clock:     clk,
+		responses: map[string]persistence.IdempotentResponse{},
+	}
+}
+
+func (m *memoryIdempotencyStore) ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time) (persistence.IdempotentResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resp, ok := m.responses[key]
+	if ok && m.clock.Now().Before(resp.ExpiresAt) {
+		return resp, false, nil
+	}
+
+	m.responses[key] = persistence.IdempotentResponse{
+		Fingerprint: fingerprint,
+		ExpiresAt:   expiresAt,
+	}
+
+	return persistence.IdempotentResponse{}, true, nil
+}
+
+func (m *memoryIdempotencyStore) StoreIdempotentResponse(key string, resp persistence.IdempotentResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	for k, stored := range m.responses {
+		if !now.Before(stored.ExpiresAt) {
+			delete(m.responses, k)
+		}
+	}
+	m.responses[key] = resp
+
+	return nil
+}
+
+func (m *memoryIdempotencyStore) ReleaseIdempotencyKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if resp, ok := m.responses[key]; ok && resp.Pending() {
+		delete(m.responses, key)
+	}
+
+	return nil
+}
+
+// responseCapture records the status and body written through it
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rc *responseCapture) WriteHeader(status int) {
+	if rc.status == 0 {
+		rc.status = status
+	}
+	rc.ResponseWriter.WriteHeader(status)
+}
+
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+	rc.body.Write(b)
+	return rc.ResponseWriter.Write(b)
+}
+
+// fingerprint identifies a request by its method, path and body
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isReplayable tells whether the response with `status' is final, and can be
+// replayed to retries rather than letting them through
+func isReplayable(status int) bool {
+	return status < 500 && status != http.StatusTooManyRequests
+}
+
+// idempotent lets POST requests to `handler' carry an Idempotency-Key
+// header: the response is recorded for IdempotencyTTL, and replayed to
+// retries with the same key instead of processing them again
+//
+// Keys are scoped to the account of the session, and reserved while the
+// request is processed: concurrent retries are rejected with 409 rather than
+// processed twice. A key reused for a different request is rejected with 422.
+func (s *Server) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			handler(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			s.writeErrorf(w, r, 400, "idempotency key longer than %d bytes", maxIdempotencyKeyLength)
+			return
+		}
+
+		sessItf := r.Context().Value(SessionKeyCtx)
+		if sessItf == nil {
+			panic("Session must not be nil if authenticated.")
+		}
+
+		sess := sessItf.(*Session)
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxIdempotentBodyBytes+1))
+		if err != nil {
+			s.writeError(w, r, 400, "failed to read request body")
+			return
+		}
+		if len(body) > maxIdempotentBodyBytes {
+			s.writeError(w, r, 413, "request body too large")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scopedKey := fmt.Sprintf("%d:%s", sess.Account, key)
+		fp := fingerprint(r, body)
+
+		expiresAt := s.clock.Now().Add(s.cfg.IdempotencyTTL)
+		resp, reserved, err := s.idempotency.ReserveIdempotencyKey(scopedKey, fp, expiresAt)
+		if err != nil {
+			logError(err).Int("account_id", int(sess.Account)).Msg("failed to reserve idempotency key")
+			s.writeInternalError(w, r, err, "failed to check idempotency key")
+			return
+		}
+		if !reserved {
+			if resp.Fingerprint != fp {
+				s.writeError(w, r, 422, "idempotency key already used for a different request")
+				return
+			}
+
+			if resp.Pending() {
+				s.writeError(w, r, 409, "a request with this idempotency key is already in progress")
+				return
+			}
+
+			if resp.ContentType != "" {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.Status)
+			w.Write(resp.Body)
+			return
+		}
+
+		// The reservation is dropped unless a response is recorded, including
+		// when the handler panics, so the request can be retried
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+
+			err := s.idempotency.ReleaseIdempotencyKey(scopedKey)
+			if err != nil {
+				log.Error().Err(err).Int("account_id", int(sess.Account)).Msg("failed to release idempotency key")
+			}
+		}()
+
+		rc := &responseCapture{ResponseWriter: w}
+		handler(rc, r)
+
+		if rc.status == 0 || !isReplayable(rc.status) {
+			return
+		}
+
+		err = s.idempotency.StoreIdempotentResponse(scopedKey, persistence.IdempotentResponse{
+			Fingerprint: fp,
+			Status:      rc.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rc.body.Bytes(),
+			ExpiresAt:   expiresAt,
+		})
+		if err != nil {
+			log.Error().Err(err).Int("account_id", int(sess.Account)).Msg("failed to store idempotent response")
+			return
+		}
+		stored = true
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// idempotentRequest returns a POST request with the Idempotency-Key `key', on
+// a session of `acc'
+func idempotentRequest(acc persistence.Account, key, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/withdraw", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+
+	ctx := context.WithValue(r.Context(), SessionKeyCtx, &Session{Account: acc})
+	return r.WithContext(ctx)
+}
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	srv := NewServerWithDeps(Deps{Store: persistence.NewMemory(persistence.DefaultConfig())}, DefaultConfig())
+
+	calls := 0
+	handler := srv.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		srv.writeResponse(w, r, 201, calls)
+	})
+
+	first := httptest.NewRecorder()
+	handler(first, idempotentRequest(1, "key", `{"amount":100}`))
+
+	replay := httptest.NewRecorder()
+	handler(replay, idempotentRequest(1, "key", `{"amount":100}`))
+
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if replay.Code != 201 || replay.Body.String() != first.Body.String() {
+		t.Errorf("replayed %d %q, want %d %q", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay not flagged")
+	}
+
+	reused := httptest.NewRecorder()
+	handler(reused, idempotentRequest(1, "key", `{"amount":200}`))
+	if reused.Code != 422 {
+		t.Errorf("key reused for another request: %d, want 422", reused.Code)
+	}
+
+	// Keys are scoped to the account
+	other := httptest.NewRecorder()
+	handler(other, idempotentRequest(2, "key", `{"amount":200}`))
+	if other.Code != 201 || calls != 2 {
+		t.Errorf("key of another account: %d, %d calls", other.Code, calls)
+	}
+}
+
+func TestIdempotentRejectsConcurrentRetries(t *testing.T) {
+	srv := NewServerWithDeps(Deps{Store: persistence.NewMemory(persistence.DefaultConfig())}, DefaultConfig())
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	handler := srv.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+		srv.writeResponse(w, r, 201, nil)
+	})
+
+	first := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		handler(first, idempotentRequest(1, "key", `{"amount":100}`))
+		close(finished)
+	}()
+
+	<-started
+	retry := httptest.NewRecorder()
+	handler(retry, idempotentRequest(1, "key", `{"amount":100}`))
+	close(done)
+	<-finished
+
+	if retry.Code != 409 {
+		t.Errorf("concurrent retry: %d, want 409", retry.Code)
+	}
+	if first.Code != 201 {
+		t.Errorf("first request: %d, want 201", first.Code)
+	}
+}
+
+func TestIdempotentReleasesFailedRequests(t *testing.T) {
+	srv := NewServerWithDeps(Deps{Store: persistence.NewMemory(persistence.DefaultConfig())}, DefaultConfig())
+
+	calls := 0
+	handler := srv.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			srv.writeError(w, r, 503, "unavailable")
+			return
+		}
+		srv.writeResponse(w, r, 201, nil)
+	})
+
+	failed := httptest.NewRecorder()
+	handler(failed, idempotentRequest(1, "key", `{"amount":100}`))
+
+	retry := httptest.NewRecorder()
+	handler(retry, idempotentRequest(1, "key", `{"amount":100}`))
+
+	if calls != 2 || retry.Code != 201 {
+		t.Errorf("retry of a failed request: %d, %d calls", retry.Code, calls)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	clk := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.IdempotencyTTL = time.Hour
+	srv := NewServerWithDeps(Deps{Store: persistence.NewMemory(persistence.DefaultConfig()), Clock: clk}, cfg)
+
+	calls := 0
+	handler := srv.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		srv.writeResponse(w, r, 201, calls)
+	})
+
+	handler(httptest.NewRecorder(), idempotentRequest(1, "key", `{"amount":100}`))
+
+	clk.advance(59 * time.Minute)
+	replay := httptest.NewRecorder()
+	handler(replay, idempotentRequest(1, "key", `{"amount":100}`))
+	if calls != 1 || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry within the TTL not replayed: %d calls", calls)
+	}
+
+	// Once expired, the key is treated as new, even for another request
+	clk.advance(time.Minute)
+	reused := httptest.NewRecorder()
+	handler(reused, idempotentRequest(1, "key", `{"amount":200}`))
+	if calls != 2 || reused.Code != 201 || reused.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expired key: %d, %d calls", reused.Code, calls)
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// accountLimiter caps the number of concurrent operations per account
+type accountLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	inFlight map[persistence.Account]int
+}
+
+// newAccountLimiter returns a limiter allowing `max' concurrent operations per
+// account, or any number if `max' is not positive
+func newAccountLimiter(max int) *accountLimiter {
+	return &accountLimiter{
+		max:      max,
+		inFlight: map[persistence.Account]int{},
+	}
+}
+
+// acquire reserves a slot for an operation on `acc'
+//
+// Returns false if the account already has the maximum number of operations
+// in flight; otherwise the slot must be freed with release.
+func (l *accountLimiter) acquire(acc persistence.Account) bool {
+	if l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[acc] >= l.max {
+		return false
+	}
+
+	l.inFlight[acc]++
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *accountLimiter) release(acc persistence.Account) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight[acc]--
+	if l.inFlight[acc] <= 0 {
+		delete(l.inFlight, acc)
+	}
+}
+
+// shedLoad rejects requests with 503 while MaxConcurrentRequests requests are
+// being served, so spikes do not pile up on the database
+//
+// /healthz is never shed, so a saturated server is not mistaken for a dead
+// one.
+func (s *Server) shedLoad(next http.Handler) http.Handler {
+	if s.requestSlots == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimSuffix(r.URL.Path, "/") == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case s.requestSlots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, r, 503, "server overloaded")
+			return
+		}
+		defer func() { <-s.requestSlots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
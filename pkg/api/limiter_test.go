@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShedLoad(t *testing.T) {
+	srv, _ := newTestServer(t, func(cfg *Config) {
+		cfg.MaxConcurrentRequests = 2
+	})
+
+	// Both slots are taken by requests being served
+	srv.requestSlots <- struct{}{}
+	srv.requestSlots <- struct{}{}
+
+	w := serve(srv, newRequest(http.MethodGet, "/version", "", ""))
+	wantStatus(t, w, 503)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After not set")
+	}
+
+	// Health checks are not shed, so the instance is not taken out of
+	// rotation because it is busy
+	for _, target := range []string{"/healthz", "/healthz/"} {
+		wantStatus(t, serve(srv, newRequest(http.MethodGet, target, "", "")), 200)
+	}
+
+	<-srv.requestSlots
+	wantStatus(t, serve(srv, newRequest(http.MethodGet, "/version", "", "")), 200)
+	if len(srv.requestSlots) != 1 {
+		t.Errorf("%d slots taken after the request, want 1", len(srv.requestSlots))
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// limitsJSON are withdrawal limits as JSON, durations being written like
+// "1h30m"; nil limits are not overridden
+type limitsJSON struct {
+	MaxWithdrawal      *int64  `json:"max_withdrawal"`
+	DailyWithdrawal    *int64  `json:"daily_withdrawal"`
+	WithdrawalCooldown *string `json:"withdrawal_cooldown"`
+}
+
+type accountLimitsResponse struct {
+	// Overrides are the limits set for the account, null ones falling back
+	// to the defaults
+	Overrides limitsJSON `json:"overrides"`
+	// Effective are the limits enforced on the account, 0 meaning no limit
+	Effective limitsJSON `json:"effective"`
+}
+
+func overridesJSON(o persistence.LimitOverrides) limitsJSON {
+	limits := limitsJSON{
+		MaxWithdrawal:   o.MaxWithdrawal,
+		DailyWithdrawal: o.DailyWithdrawal,
+	}
+	if o.WithdrawalCooldown != nil {
+		cooldown := o.WithdrawalCooldown.String()
+		limits.WithdrawalCooldown = &cooldown
+	}
+
+	return limits
+}
+
+func effectiveJSON(l persistence.Limits) limitsJSON {
+	cooldown := l.WithdrawalCooldown.String()
+	return limitsJSON{
+		MaxWithdrawal:      &l.MaxWithdrawal,
+		DailyWithdrawal:    &l.DailyWithdrawal,
+		WithdrawalCooldown: &cooldown,
+	}
+}
+
+// adminAccountLimits outputs (GET) or replaces (POST) the withdrawal limits
+// set for `acc', overriding the configured defaults
+func (s *Server) adminAccountLimits(w http.ResponseWriter, r *http.Request, acc persistence.Account) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !s.requireJSON(w, r) {
+			return
+		}
+
+		var req limitsJSON
+		err := s.decodeJSON(r.Body, &req)
+		if err != nil {
+			logError(err).Msg("failed to decode account limits")
+			s.writeDecodeError(w, r, err, "invalid limits")
+			return
+		}
+
+		overrides := persistence.LimitOverrides{
+			MaxWithdrawal:   req.MaxWithdrawal,
+			DailyWithdrawal: req.DailyWithdrawal,
+		}
+		if req.WithdrawalCooldown != nil {
+			cooldown, err := time.ParseDuration(*req.WithdrawalCooldown)
+			if err != nil {
+				s.writeError(w, r, 400, "invalid withdrawal cooldown")
+				return
+			}
+			overrides.WithdrawalCooldown = &cooldown
+		}
+
+		err = s.db.SetAccountLimits(acc, overrides)
+		if err != nil {
+			s.writeLimitsError(w, r, acc, err, "failed to set account limits")
+			return
+		}
+		s.recordAudit("limits", acc, "")
+	default:
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	overrides, effective, err := s.db.AccountLimits(acc)
+	if err != nil {
+		s.writeLimitsError(w, r, acc, err, "failed to get account limits")
+		return
+	}
+
+	s.writeResponse(w, r, 200, accountLimitsResponse{
+		Overrides: overridesJSON(overrides),
+		Effective: effectiveJSON(effective),
+	})
+}
+
+func (s *Server) writeLimitsError(w http.ResponseWriter, r *http.Request, acc persistence.Account, err error, msg string) {
+	switch {
+	case errors.Is(err, persistence.ErrNoAccount):
+		s.writeError(w, r, 404, "no such account")
+	case errors.Is(err, persistence.ErrInvalidLimits):
+		s.writeError(w, r, 400, "invalid limits, they cannot be negative")
+	default:
+		logError(err).Int("account_id", int(acc)).Msg(msg)
+		s.writeInternalError(w, r, err, msg)
+	}
+}
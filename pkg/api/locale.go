@@ -0,0 +1,147 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// groupSeparators are the thousands separators of the languages amounts can
+// be formatted for
+//
+// Amounts are integers, so only their digit grouping depends on the locale.
+var groupSeparators = map[string]string{
+	"de": ".",
+	"en": ",",
+	"es": ".",
+	"fr": " ",
+	"it": ".",
+	"nl": ".",
+	"pt": ".",
+}
+
+// decimalSeparators are the decimal separators of the languages of
+// groupSeparators, for amounts of currencies with a minor unit
+var decimalSeparators = map[string]string{
+	"de": ",",
+	"en": ".",
+	"es": ",",
+	"fr": ",",
+	"it": ",",
+	"nl": ",",
+	"pt": ",",
+}
+
+// symbolFirst are the languages writing currency symbols before amounts,
+// others writing them after, separated by a space
+var symbolFirst = map[string]bool{
+	"en": true,
+}
+
+// currency is a currency amounts are counted in
+type currency struct {
+	// symbol is written along with amounts
+	symbol string
+	// exponent is the number of digits of its minor unit, e.g. 2 for cents
+	exponent int
+}
+
+// currencies are the currencies amounts can be counted in, by ISO 4217 code
+var currencies = map[string]currency{
+	"CAD": {"$", 2},
+	"CHF": {"CHF", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"JPY": {"¥", 0},
+	"USD": {"$", 2},
+}
+
+// ParseCurrency validates the ISO 4217 code of a currency, and returns it in
+// upper case
+func ParseCurrency(code string) (string, error) {
+	code = strings.ToUpper(code)
+	if _, ok := currencies[code]; !ok {
+		return "", fmt.Errorf("unsupported currency %q", code)
+	}
+
+	return code, nil
+}
+
+// minorUnits returns `amount', counted in units of `cur', in its minor unit
+func (cur currency) minorUnits(amount int64) int64 {
+	for i := 0; i < cur.exponent; i++ {
+		amount *= 10
+	}
+
+	return amount
+}
+
+// requestLocale returns the language amounts are formatted for, from
+// `?locale=' or the first language of Accept-Language
+//
+// Returns an empty string, for unformatted amounts, if none is given.
+func requestLocale(r *http.Request) string {
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+		locale = strings.TrimSpace(strings.Split(locale, ";")[0])
+	}
+
+	// Only the language matters for digit grouping: en-US is formatted as en
+	locale = strings.ToLower(strings.SplitN(strings.SplitN(locale, "-", 2)[0], "_", 2)[0])
+	if _, ok := groupSeparators[locale]; !ok {
+		return ""
+	}
+
+	return locale
+}
+
+// formatAmount formats `amount' with the digit grouping of `locale', or as a
+// bare integer if `locale' is empty
+func formatAmount(amount int64, locale string) string {
+	digits := strconv.FormatInt(amount, 10)
+	sep, ok := groupSeparators[locale]
+	if !ok {
+		return digits
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign, digits = "-", digits[1:]
+	}
+
+	grouped := strings.Builder{}
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteString(sep)
+		}
+		grouped.WriteRune(d)
+	}
+
+	return sign + grouped.String()
+}
+
+// formatMoney formats `amount', counted in units of the currency `code', for
+// `locale', or English if it is empty: e.g. 1500 USD is "$1,500.00" in
+// English, and 1500 EUR "1 500,00 €" in French
+func formatMoney(amount int64, code, locale string) string {
+	if locale == "" {
+		locale = "en"
+	}
+	cur := currencies[code]
+
+	sign, number := "", formatAmount(amount, locale)
+	if amount < 0 {
+		sign, number = "-", number[1:]
+	}
+	if cur.exponent > 0 {
+		number += decimalSeparators[locale] + strings.Repeat("0", cur.exponent)
+	}
+
+	if symbolFirst[locale] {
+		return sign + cur.symbol + number
+	}
+
+	return sign + number + " " + cur.symbol
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount       int64
+		code, locale string
+		want         string
+	}{
+		{1500, "USD", "en", "$1,500.00"},
+		{1500, "USD", "", "$1,500.00"},
+		{-1500, "USD", "en", "-$1,500.00"},
+		{1500, "EUR", "fr", "1\u202f500,00 €"},
+		{1500, "EUR", "de", "1.500,00 €"},
+		{1234567, "GBP", "en", "£1,234,567.00"},
+		{1500, "JPY", "en", "¥1,500"},
+		{1500, "CHF", "it", "1.500,00 CHF"},
+		{20, "CAD", "fr", "20,00 $"},
+	}
+
+	for _, test := range tests {
+		if got := formatMoney(test.amount, test.code, test.locale); got != test.want {
+			t.Errorf("formatMoney(%d, %s, %q) = %q, want %q", test.amount, test.code, test.locale, got, test.want)
+		}
+	}
+}
+
+func TestParseCurrency(t *testing.T) {
+	code, err := ParseCurrency("eur")
+	if err != nil || code != "EUR" {
+		t.Errorf("ParseCurrency(eur) = %q, %v, want EUR", code, err)
+	}
+
+	_, err = ParseCurrency("XXX")
+	if err == nil {
+		t.Error("unsupported currency parsed")
+	}
+}
+
+func TestBalanceRepresentations(t *testing.T) {
+	tests := []struct {
+		currency, locale string
+		want             balanceResponse
+	}{
+		{"USD", "", balanceResponse{Balance: 1500, BalanceMinor: 150000, Currency: "USD", BalanceDisplay: "$1,500.00"}},
+		{"USD", "en-US", balanceResponse{Balance: 1500, BalanceMinor: 150000, Currency: "USD", BalanceDisplay: "$1,500.00"}},
+		{"EUR", "fr", balanceResponse{Balance: 1500, BalanceMinor: 150000, Currency: "EUR", BalanceDisplay: "1\u202f500,00 €"}},
+		{"EUR", "de-DE", balanceResponse{Balance: 1500, BalanceMinor: 150000, Currency: "EUR", BalanceDisplay: "1.500,00 €"}},
+		{"JPY", "en", balanceResponse{Balance: 1500, BalanceMinor: 1500, Currency: "JPY", BalanceDisplay: "¥1,500"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.currency+" "+test.locale, func(t *testing.T) {
+			srv, store := newTestServer(t, func(cfg *Config) {
+				cfg.Currency = test.currency
+			})
+			createAccount(t, store, "4623", 1500)
+			sessionID := login(t, srv, "4623")
+
+			r := newRequest(http.MethodGet, "/balance", sessionID, "")
+			r.Header.Set("Accept-Language", test.locale)
+
+			w := serve(srv, r)
+			wantStatus(t, w, 200)
+
+			var env struct {
+				Data balanceResponse `json:"data"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Data != test.want {
+				t.Errorf("balance = %+v, want %+v", env.Data, test.want)
+			}
+		})
+	}
+}
+
+func TestBalanceAsText(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 1500)
+	sessionID := login(t, srv, "4623")
+
+	// The bare integer output of older versions is kept for compatibility
+	w := serve(srv, newRequest(http.MethodGet, "/balance?format=text", sessionID, ""))
+	wantStatus(t, w, 200)
+	if w.Body.String() != "1500" {
+		t.Errorf("balance = %q, want 1500", w.Body)
+	}
+}
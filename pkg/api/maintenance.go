@@ -0,0 +1,131 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+// maintenanceRetryAfter is the delay clients are told to wait before retrying
+// money movements blocked by the maintenance mode, in seconds
+const maintenanceRetryAfter = 60
+
+// inMaintenance returns whether the maintenance mode is enabled
+func (s *Server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) != 0
+}
+
+// unlessMaintenance wraps routes moving money, so they are rejected while the
+// maintenance mode is enabled
+func (s *Server) unlessMaintenance(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.inMaintenance() {
+			w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			s.writeError(w, r, 503, "service in maintenance")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// adminMaintenance reads (GET) or sets (POST) the maintenance mode
+func (s *Server) adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !s.requireJSON(w, r) {
+			return
+		}
+
+		state := maintenanceState{}
+		err := s.decodeJSON(r.Body, &state)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to decode maintenance state")
+			s.writeDecodeError(w, r, err, "invalid maintenance state")
+			return
+		}
+
+		enabled := int32(0)
+		if state.Enabled {
+			enabled = 1
+		}
+		atomic.StoreInt32(&s.maintenance, enabled)
+		log.Info().Bool("enabled", state.Enabled).Msg("maintenance mode changed")
+		s.recordAudit("maintenance", persistence.NoAccount, fmt.Sprintf("enabled: %t", state.Enabled))
+	default:
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	s.writeResponse(w, r, 200, maintenanceState{
+		Enabled: s.inMaintenance(),
+	})
+}
+
+type dbMaintenanceResponse struct {
+	Duration string `json:"duration"`
+}
+
+// adminDBMaintenance runs the maintenance of the database, POST only
+func (s *Server) adminDBMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	start := s.clock.Now()
+	err := s.db.Maintenance(r.Context())
+	if errors.Is(err, persistence.ErrMaintenanceRunning) {
+		s.writeError(w, r, 409, "database maintenance already running")
+		return
+	}
+	if err != nil {
+		logError(err).Msg("database maintenance failed")
+		s.writeInternalError(w, r, err, "database maintenance failed")
+		return
+	}
+
+	duration := s.clock.Now().Sub(start)
+	log.Info().Dur("duration", duration).Msg("database maintenance done")
+
+	s.writeResponse(w, r, 200, dbMaintenanceResponse{
+		Duration: duration.String(),
+	})
+}
+
+type lowBalancesResponse struct {
+	Flagged int `json:"flagged"`
+}
+
+// adminFlagLowBalances runs the low balance check on POST
+// /admin/low-balances/check, flagging the accounts below the minimum active
+// balance for long enough, and outputs how many were newly flagged
+func (s *Server) adminFlagLowBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	flagged, err := s.db.FlagLowBalances(r.Context())
+	if err != nil {
+		logError(err).Msg("low balance check failed")
+		s.writeInternalError(w, r, err, "low balance check failed")
+		return
+	}
+
+	log.Info().Int("flagged", flagged).Msg("low balance check done")
+
+	s.writeResponse(w, r, 200, lowBalancesResponse{
+		Flagged: flagged,
+	})
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+// pinPattern matches the PINs accepted by the service
+var pinPattern = regexp.MustCompile(`^[0-9]{4}$`)
+
+type changePINRequest struct {
+	PIN string `json:"pin"`
+}
+
+// changePIN replaces the PIN of the account on POST /pin
+//
+// This is the only route sessions opened with a temporary PIN can use, and it
+// lifts that restriction. The other sessions of the account are revoked if
+// configured, and the current one too unless configured to be kept.
+func (s *Server) changePIN(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	if !s.requireJSON(w, r) {
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	req := changePINRequest{}
+	err := s.decodeJSON(r.Body, &req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode PIN change")
+		s.writeDecodeError(w, r, err, "invalid PIN change")
+		return
+	}
+
+	if !pinPattern.MatchString(req.PIN) {
+		s.writeError(w, r, 400, "PIN must be 4 digits")
+		return
+	}
+
+	err = s.db.ChangePIN(sess.Account, req.PIN)
+	if errors.Is(err, persistence.ErrWeakPIN) {
+		s.writeError(w, r, 400, "PIN too weak")
+		return
+	}
+	if errors.Is(err, persistence.ErrPINInUse) {
+		s.writeError(w, r, 409, "PIN already in use")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to change PIN")
+		s.writeInternalError(w, r, err, "failed to change PIN")
+		return
+	}
+
+	if s.cfg.RevokeSessionsOnPINChange {
+		except := sess.ID
+		if !s.cfg.KeepSessionOnPINChange {
+			except = uuid.Nil
+		}
+
+		revoked := s.as.RevokeAccountSessions(sess.Account, except)
+		log.Info().Int("account_id", int(sess.Account)).Int("revoked", revoked).Msg("sessions revoked after PIN change")
+	}
+
+	if sess.MustChangePIN {
+		unrestricted := *sess
+		unrestricted.MustChangePIN = false
+		s.as.replaceSession(sess, &unrestricted)
+	}
+
+	fmt.Fprint(w, "ok")
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestChangePINConflicts(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	createAccount(t, store, "4623", 0)
+	createAccount(t, store, "5082", 0)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"weak PIN", `{"pin":"1111"}`, 400},
+		{"PIN of another account", `{"pin":"5082"}`, 409},
+		{"current PIN", `{"pin":"4623"}`, 409},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantStatus(t, serve(srv, newRequest(http.MethodPost, "/pin", sessionID, test.body)), test.want)
+		})
+	}
+
+	// Both accounts still log in with their own PIN
+	login(t, srv, "4623")
+	login(t, srv, "5082")
+
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/pin", sessionID, `{"pin":"7391"}`)), 200)
+	login(t, srv, "7391")
+}
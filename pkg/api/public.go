@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+type publicConfigResponse struct {
+	Denominations []int64 `json:"denominations"`
+	MinAmount     int64   `json:"min_amount"`
+	MaxAmount     int64   `json:"max_amount"`
+	// MaxWithdrawal is the default maximum withdrawal, which can be
+	// overridden by account; omitted when withdrawals are only limited by
+	// MaxAmount
+	MaxWithdrawal      int64 `json:"max_withdrawal,omitempty"`
+	MaxBatchRecipients int   `json:"max_batch_recipients"`
+	DefaultPageSize    int   `json:"default_page_size"`
+	MaxPageSize        int   `json:"max_page_size"`
+}
+
+// getPublicConfig outputs the policy values clients need to build their forms
+// on GET /config/public, as enforced by the server
+func (s *Server) getPublicConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	s.writeResponse(w, r, 200, publicConfigResponse{
+		Denominations:      s.cfg.Denominations,
+		MinAmount:          1,
+		MaxAmount:          persistence.MaxAmount,
+		MaxWithdrawal:      s.db.DefaultLimits().MaxWithdrawal,
+		MaxBatchRecipients: s.cfg.MaxBatchRecipients,
+		DefaultPageSize:    s.cfg.DefaultPageSize,
+		MaxPageSize:        s.cfg.MaxPageSize,
+	})
+}
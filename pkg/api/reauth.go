@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// isFreshAt tells whether the PIN was checked for the session less than
+// `window' before `now'
+func (s *Session) isFreshAt(now time.Time, window time.Duration) bool {
+	return now.Before(s.AuthenticatedAt.Add(window))
+}
+
+// checkFreshAuth replies 403 unless the PIN was checked for `sess' within
+// FreshAuthWindow, and tells whether the request can go on
+func (s *Server) checkFreshAuth(w http.ResponseWriter, r *http.Request, sess *Session) bool {
+	if s.cfg.FreshAuthWindow <= 0 || sess.isFreshAt(s.clock.Now(), s.cfg.FreshAuthWindow) {
+		return true
+	}
+
+	s.writeError(w, r, 403, "reauthentication required")
+	return false
+}
+
+// requireFreshAuth restricts `handler' to the sessions whose PIN was checked
+// within FreshAuthWindow, for sensitive operations; other sessions have to
+// go through /session/reauth first
+func (s *Server) requireFreshAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessItf := r.Context().Value(SessionKeyCtx)
+		if sessItf == nil {
+			panic("Session must not be nil if authenticated.")
+		}
+
+		if !s.checkFreshAuth(w, r, sessItf.(*Session)) {
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// reauthenticate checks the PIN of the account again on POST
+// /session/reauth, like /login, and renews the authentication of the current
+// session rather than opening another one
+func (s *Server) reauthenticate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	acc, temporary, ok := s.authenticate(w, r, true)
+	if !ok {
+		return
+	}
+
+	// Temporary PINs only allow changing the PIN, from a session of their
+	// own: they are refused without being used up, so they still open it
+	if temporary {
+		s.writeError(w, r, 401, "invalid nip")
+		return
+	}
+
+	if acc != sess.Account {
+		log.Warn().Int("account_id", int(sess.Account)).Str("client_ip", s.cfg.TrustedProxies.ClientIP(r)).Msg("reauthentication with the PIN of another account")
+		s.writeError(w, r, 401, "invalid nip")
+		return
+	}
+
+	reauthenticated := *sess
+	reauthenticated.AuthenticatedAt = s.clock.Now()
+	if !s.as.replaceSession(sess, &reauthenticated) {
+		// The session was revoked or rotated while the PIN was checked
+		s.writeError(w, r, 401, "session expired")
+		return
+	}
+
+	w.WriteHeader(204)
+}
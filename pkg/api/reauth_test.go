@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// reauth returns a request checking `pin' again for the session `sessionID'
+func reauth(sessionID, pin string) *http.Request {
+	r := newRequest(http.MethodPost, "/session/reauth", sessionID, "")
+	r.Header.Set("nip", pin)
+
+	return r
+}
+
+func TestFreshAuth(t *testing.T) {
+	clk := newFakeClock()
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	createAccount(t, store, "4623", 0)
+	srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, DefaultConfig())
+	sessionID := login(t, srv, "4623")
+
+	clk.advance(DefaultConfig().FreshAuthWindow)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/pin", sessionID, `{"pin":"8264"}`)), 403)
+
+	// Stale sessions can still be used for other routes
+	wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", sessionID, "")), 200)
+
+	wantStatus(t, serve(srv, reauth(sessionID, "7391")), 401)
+	wantStatus(t, serve(srv, reauth(sessionID, "4623")), 204)
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/pin", sessionID, `{"pin":"8264"}`)), 200)
+}
+
+func TestReauthRefusesTempPIN(t *testing.T) {
+	clk := newFakeClock()
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	acc := createAccount(t, store, "4623", 0)
+	srv := NewServerWithDeps(Deps{Store: store, Clock: clk}, DefaultConfig())
+	sessionID := login(t, srv, "4623")
+
+	pin, _, err := store.IssueTempPIN(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk.advance(time.Minute)
+	wantStatus(t, serve(srv, reauth(sessionID, pin)), 401)
+
+	// The temporary PIN was not used up, and still logs in
+	r := newRequest(http.MethodGet, "/login", "", "")
+	r.Header.Set("nip", pin)
+
+	w := serve(srv, r)
+	wantStatus(t, w, 200)
+	if w.Header().Get("PINChangeRequired") != "true" {
+		t.Error("login with the temporary PIN does not require changing it")
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog/log"
+)
+
+// recoverPanics turns the panics of `next' into 500 responses, so a failing
+// request does not bring down the service
+//
+// Shared state must not be left half-updated by a panicking handler: see
+// AuthServer.replaceSession for how sessions are updated.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			log.Error().
+				Str("panic", fmt.Sprint(rec)).
+				Str("path", r.URL.Path).
+				Str("request_id", requestID(r)).
+				Bytes("stack", debug.Stack()).
+				Msg("recovered from panic while serving request")
+			s.writeError(w, r, 500, "internal error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// panickingStore panics when changing a PIN, in the middle of /pin
+type panickingStore struct {
+	*persistence.Memory
+}
+
+func (panickingStore) ChangePIN(acc persistence.Account, pin string) error {
+	panic("injected panic")
+}
+
+// snapshotSessions returns a copy of the sessions of `sessions'
+func snapshotSessions(sessions *sync.Map) map[interface{}]Session {
+	snapshot := map[interface{}]Session{}
+	sessions.Range(func(key, val interface{}) bool {
+		snapshot[key] = *val.(*Session)
+		return true
+	})
+
+	return snapshot
+}
+
+func TestPanicLeavesSessionsUnchanged(t *testing.T) {
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	createAccount(t, store, "4623", 0)
+
+	sessions := &sync.Map{}
+	srv := NewServerWithDeps(Deps{Store: panickingStore{store}, Sessions: sessions}, DefaultConfig())
+
+	sessionID := login(t, srv, "4623")
+	login(t, srv, "4623")
+	before := snapshotSessions(sessions)
+
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/pin", sessionID, `{"pin":"8264"}`)), 500)
+
+	after := snapshotSessions(sessions)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("sessions changed by the panicking request:\n%v\nwant\n%v", after, before)
+	}
+
+	wantStatus(t, serve(srv, newRequest(http.MethodGet, "/balance", sessionID, "")), 200)
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// trimTrailingSlash serves requests to `<route>/' as requests to `<route>',
+// for the exact routes listed in `routes', so both forms reach the same
+// handler instead of being told apart by the ServeMux
+//
+// Subtree routes, registered with a trailing slash, are left untouched.
+func trimTrailingSlash(routes map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) > 1 && strings.HasSuffix(path, "/") && routes[strings.TrimSuffix(path, "/")] {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = strings.TrimSuffix(path, "/")
+			r2.URL.RawPath = ""
+			r = r2
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
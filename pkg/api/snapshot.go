@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SaveSessions writes the unexpired sessions to the file at `path', so they
+// can be restored with LoadSessions after a restart
+//
+// The file is replaced atomically, and only readable by its owner since it
+// holds session tokens.
+func (as AuthServer) SaveSessions(path string) error {
+	now := as.Clock.Now()
+	sessions := []*Session{}
+
+	as.AuthMap.Range(func(key, val interface{}) bool {
+		sess, ok := val.(*Session)
+		if ok && now.Before(sess.Expiration) {
+			sessions = append(sessions, sess)
+		}
+		return true
+	})
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSessions stores the sessions saved by SaveSessions in the file at
+// `path', and returns how many were restored
+//
+// Sessions that expired since they were saved are dropped. A missing file
+// restores no session.
+func (as AuthServer) LoadSessions(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sessions := []*Session{}
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return 0, err
+	}
+
+	now := as.Clock.Now()
+	restored := 0
+	for _, sess := range sessions {
+		if sess == nil || !sess.Account.IsValid() || !now.Before(sess.Expiration) {
+			continue
+		}
+
+		as.AuthMap.Store(sess.ID, sess)
+		restored++
+	}
+
+	return restored, nil
+}
+
+// snapshotEvery saves the sessions to `path' every `interval', forever
+func (as AuthServer) snapshotEvery(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := as.SaveSessions(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("failed to save sessions")
+		}
+	}
+}
+
+// RestoreSessions loads the sessions saved in the configured snapshot file,
+// if any
+func (s *Server) RestoreSessions() error {
+	if s.cfg.SessionSnapshotPath == "" {
+		return nil
+	}
+
+	restored, err := s.as.LoadSessions(s.cfg.SessionSnapshotPath)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Int("sessions", restored).Str("path", s.cfg.SessionSnapshotPath).Msg("sessions restored")
+	return nil
+}
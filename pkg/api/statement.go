@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/rs/zerolog/log"
+)
+
+// statementLine is a transaction of a statement exported as JSON Lines
+type statementLine struct {
+	ID   int64     `json:"id"`
+	Date time.Time `json:"date"`
+	Type string    `json:"type"`
+	// Amount is signed, withdrawals being negative
+	Amount   int64  `json:"amount"`
+	Category string `json:"category,omitempty"`
+}
+
+// getStatement outputs the transactions of the account as CSV on GET
+// /statement, over the optional `?from=' and `?to=' RFC 3339 bounds, or as
+// JSON Lines with `?format=jsonl'
+//
+// Amounts are signed, withdrawals being negative; in CSV, they are formatted
+// for the locale of the client if given, and fields are quoted as needed, so
+// formatted amounts do not break CSV parsing.
+//
+// Statements are streamed: transactions are written as they are read from the
+// store, and flushed to the client.
+func (s *Server) getStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "jsonl" {
+		s.writeError(w, r, 400, "invalid format, expected csv or jsonl")
+		return
+	}
+
+	from, ok := s.parseTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+
+	to, ok := s.parseTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+
+	out := newStatementWriter(w, r, format)
+
+	// Transactions are written as they are read, the response starting with
+	// the first one, so errors can only be replied before it
+	err := s.db.EachTransaction(r.Context(), sess.Account, from, to, out.write)
+	if err != nil && out.started {
+		logError(err).Int("account_id", int(sess.Account)).Msg("statement interrupted")
+		return
+	}
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such account")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get statement")
+		s.writeInternalError(w, r, err, "failed to get statement")
+		return
+	}
+
+	err = out.finish()
+	if err != nil {
+		log.Error().Err(err).Int("account_id", int(sess.Account)).Msg("failed to write statement")
+	}
+}
+
+// statementWriter writes the transactions of a statement as CSV, with
+// amounts formatted for the locale of the client, or as JSON Lines, flushing
+// every line so ingestion can start before the end of large statements
+type statementWriter struct {
+	w       http.ResponseWriter
+	format  string
+	locale  string
+	flusher http.Flusher
+	csv     *csv.Writer
+	json    *json.Encoder
+	// started tells whether the headers of the response were written
+	started bool
+}
+
+func newStatementWriter(w http.ResponseWriter, r *http.Request, format string) *statementWriter {
+	flusher, _ := w.(http.Flusher)
+
+	return &statementWriter{
+		w:       w,
+		format:  format,
+		locale:  requestLocale(r),
+		flusher: flusher,
+	}
+}
+
+// start writes the headers of the response, and the header line of CSV
+// statements
+func (sw *statementWriter) start() {
+	sw.started = true
+
+	if sw.format == "jsonl" {
+		sw.w.Header().Set("Content-Type", "application/x-ndjson")
+		sw.json = json.NewEncoder(sw.w)
+		return
+	}
+
+	sw.w.Header().Set("Content-Type", "text/csv")
+	if sw.locale != "" {
+		sw.w.Header().Set("Content-Language", sw.locale)
+	}
+
+	sw.csv = csv.NewWriter(sw.w)
+	sw.csv.Write([]string{"id", "date", "type", "amount"})
+}
+
+// write outputs `rec', and flushes it to the client
+func (sw *statementWriter) write(rec persistence.TransactionRecord) error {
+	if !sw.started {
+		sw.start()
+	}
+
+	if sw.json != nil {
+		err := sw.json.Encode(statementLine{
+			ID:       rec.ID,
+			Date:     rec.CreatedAt,
+			Type:     rec.Type.String(),
+			Amount:   signedAmount(rec),
+			Category: rec.Category,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		sw.csv.Write([]string{
+			strconv.FormatInt(rec.ID, 10),
+			rec.CreatedAt.Format(time.RFC3339),
+			rec.Type.String(),
+			formatAmount(signedAmount(rec), sw.locale),
+		})
+		sw.csv.Flush()
+
+		err := sw.csv.Error()
+		if err != nil {
+			return err
+		}
+	}
+
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+
+	return nil
+}
+
+// finish completes the statement, which may have no transactions
+func (sw *statementWriter) finish() error {
+	if !sw.started {
+		sw.start()
+	}
+
+	if sw.csv != nil {
+		sw.csv.Flush()
+		return sw.csv.Error()
+	}
+
+	return nil
+}
+
+// signedAmount returns the amount of `rec', negative for withdrawals
+func signedAmount(rec persistence.TransactionRecord) int64 {
+	if rec.Type == persistence.Withdrawal {
+		return -rec.Amount
+	}
+
+	return rec.Amount
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+)
+
+type sessionStats struct {
+	Valid  int `json:"valid"`
+	Stored int `json:"stored"`
+}
+
+type statsResponse struct {
+	Sessions sessionStats `json:"sessions"`
+}
+
+// adminStats outputs the operating statistics of the service on GET
+// /admin/stats
+func (s *Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	valid, stored := s.as.SessionCounts()
+
+	s.writeResponse(w, r, 200, statsResponse{
+		Sessions: sessionStats{
+			Valid:  valid,
+			Stored: stored,
+		},
+	})
+}
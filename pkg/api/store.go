@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// Store is the persistence the API operates on, implemented by
+// *persistence.DB, and by *persistence.Memory for load tests
+type Store interface {
+	Ping() error
+	HealthDetailed() (persistence.Health, error)
+	Maintenance(ctx context.Context) error
+
+	Auth(pin string) (persistence.Account, bool, error)
+	CheckPIN(pin string) (persistence.Account, bool, error)
+	AuthChallenge(cardNumber string, nonce, response []byte) (persistence.Account, error)
+	ChangePIN(acc persistence.Account, pin string) error
+	IssueTempPIN(acc persistence.Account) (string, time.Time, error)
+
+	CreateAccount(pin, cardNumber, externalRef string, balance int64) (persistence.Account, bool, error)
+	AccountInfo(acc persistence.Account) (persistence.AccountInfo, error)
+	AccountStats(acc persistence.Account) (persistence.AccountStats, error)
+	CloseAccount(acc persistence.Account) error
+	CloseAccountWithPayout(acc, payout persistence.Account) (int64, error)
+	ReopenAccount(acc persistence.Account) error
+	AccountLimits(acc persistence.Account) (persistence.LimitOverrides, persistence.Limits, error)
+	DefaultLimits() persistence.Limits
+	SetAccountLimits(acc persistence.Account, overrides persistence.LimitOverrides) error
+
+	Balance(acc persistence.Account) (int64, error)
+	BalanceMany(accs []persistence.Account) (map[persistence.Account]int64, error)
+	BalanceAsOf(acc persistence.Account, at time.Time) (int64, error)
+	AvailableBalance(acc persistence.Account) (int64, error)
+	FlagLowBalances(ctx context.Context) (int, error)
+	LowBalanceFlag(acc persistence.Account) (time.Time, error)
+
+	DoTransaction(ctx context.Context, acc persistence.Account, tx persistence.Transaction) (int64, error)
+	FanOutTransfer(ctx context.Context, from persistence.Account, credits []persistence.Credit) error
+	TransferEach(ctx context.Context, from persistence.Account, credits []persistence.Credit) []error
+	PlaceHold(ctx context.Context, acc persistence.Account, amount int64) (persistence.Hold, error)
+	CaptureHold(ctx context.Context, acc persistence.Account, id int64) error
+	ReleaseHold(ctx context.Context, acc persistence.Account, id int64) error
+
+	GetTransaction(id int64) (persistence.TransactionRecord, error)
+	EachTransaction(ctx context.Context, acc persistence.Account, from, to time.Time, fn func(persistence.TransactionRecord) error) error
+	RecentTransactions(acc persistence.Account, limit, offset int) ([]persistence.TransactionRecord, error)
+	BalanceAfter(acc persistence.Account, id int64) (int64, error)
+	Summary(acc persistence.Account, from, to time.Time) (persistence.Summary, error)
+	SummaryByCategory(acc persistence.Account, from, to time.Time) ([]persistence.CategoryTotals, error)
+	PurgeTransactions(before time.Time) (int64, error)
+
+	RecordAudit(entry persistence.AuditEntry) (int64, error)
+	ListAudit(filter persistence.AuditFilter, limit, offset int) ([]persistence.AuditEntry, error)
+}
+
+var (
+	_ Store = (*persistence.DB)(nil)
+	_ Store = (*persistence.Memory)(nil)
+)
+
+// Deps are the dependencies of a Server, which can be replaced by fakes, e.g.
+// to serve the API from httptest.NewServer
+type Deps struct {
+	// Store is the persistence the server operates on
+	Store Store
+	// Clock tells the time sessions are created, renewed and expire at;
+	// clock.System if nil
+	Clock clock.Clock
+	// Sessions stores the sessions by ID, so they can be shared with, or
+	// seeded by, the caller; a new empty store if nil
+	Sessions *sync.Map
+	// Idempotency stores the responses to requests made with an
+	// Idempotency-Key; kept in memory if nil
+	Idempotency IdempotencyStore
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequestTimeoutHeader is the header clients set the timeout of their
+// request with, as a duration, e.g. "2s"
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// defaultRouteTimeouts are the timeouts of the routes allowed to run longer
+// than RouteTimeout, unless configured otherwise
+var defaultRouteTimeouts = map[string]time.Duration{
+	"/transactions":             30 * time.Second,
+	"/summary":                  30 * time.Second,
+	"/summary/by-category":      30 * time.Second,
+	"/statement":                2 * time.Minute,
+	"/admin/balances":           30 * time.Second,
+	"/admin/db/maintenance":     10 * time.Minute,
+	"/admin/transactions/purge": 10 * time.Minute,
+}
+
+// streamingRoutes are the routes flushing their response as they go, which
+// http.TimeoutHandler would buffer in full
+var streamingRoutes = map[string]bool{
+	"/statement": true,
+}
+
+// ParseRouteTimeouts parses the timeouts of routes given as durations by
+// route, e.g. {"/statement": "2m"}
+func ParseRouteTimeouts(timeouts map[string]string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration, len(timeouts))
+	for route, timeout := range timeouts {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("timeout of %s: %w", route, err)
+		}
+		parsed[route] = d
+	}
+
+	return parsed, nil
+}
+
+// routeTimeout returns the timeout of the route registered as `pattern'
+func (s *Server) routeTimeout(pattern string) time.Duration {
+	if timeout, ok := s.cfg.RouteTimeouts[pattern]; ok {
+		return timeout
+	}
+
+	if timeout, ok := defaultRouteTimeouts[pattern]; ok {
+		return timeout
+	}
+
+	return s.cfg.RouteTimeout
+}
+
+// withTimeout bounds the handling of the route `pattern' by its timeout,
+// replying 503 once it elapses; the context of the request is cancelled then,
+// so the database operations of the handler are abandoned
+//
+// Streaming routes are only bounded through the context of the request, their
+// response being cut short if it was already started.
+func (s *Server) withTimeout(pattern string, handler http.Handler) http.Handler {
+	timeout := s.routeTimeout(pattern)
+	if timeout <= 0 {
+		return handler
+	}
+
+	if streamingRoutes[pattern] {
+		return withDeadline(handler, timeout)
+	}
+
+	return http.TimeoutHandler(handler, timeout, "request timed out")
+}
+
+// withDeadline cancels the context of the requests to `handler' once
+// `timeout' elapses, without buffering their response
+func withDeadline(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientTimeout bounds the context of requests by the timeout set by the
+// client in X-Request-Timeout, capped by MaxRequestTimeout, so clients can
+// have slow operations abandoned sooner than the route timeout
+//
+// Invalid timeouts are replied 400.
+func (s *Server) clientTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(RequestTimeoutHeader)
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout, err := time.ParseDuration(header)
+		if err != nil || timeout <= 0 {
+			s.writeErrorf(w, r, 400, "invalid %s, expected a positive duration such as 2s", RequestTimeoutHeader)
+			return
+		}
+
+		if s.cfg.MaxRequestTimeout > 0 && timeout > s.cfg.MaxRequestTimeout {
+			timeout = s.cfg.MaxRequestTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
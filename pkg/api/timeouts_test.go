@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// slowStore takes `delay' to perform transactions, unless their context is
+// done first
+type slowStore struct {
+	*persistence.Memory
+	delay time.Duration
+}
+
+func (s slowStore) DoTransaction(ctx context.Context, acc persistence.Account, tx persistence.Transaction) (int64, error) {
+	timer := time.NewTimer(s.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return s.Memory.DoTransaction(ctx, acc, tx)
+	case <-ctx.Done():
+		return -1, fmt.Errorf("account %d: %w", acc, ctx.Err())
+	}
+}
+
+// newSlowServer returns a server whose transactions take `delay', with the
+// default configuration changed by `configure', if any
+func newSlowServer(t *testing.T, delay time.Duration, configure func(*Config)) (*Server, *persistence.Memory) {
+	t.Helper()
+
+	store := persistence.NewMemory(persistence.DefaultConfig())
+	cfg := DefaultConfig()
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	return NewServerWithDeps(Deps{Store: slowStore{store, delay}}, cfg), store
+}
+
+func TestRouteTimeout(t *testing.T) {
+	srv, store := newSlowServer(t, 100*time.Millisecond, func(cfg *Config) {
+		cfg.RouteTimeouts = map[string]time.Duration{"/deposit": 20 * time.Millisecond}
+	})
+	acc := createAccount(t, store, "4623", 500)
+	sessionID := login(t, srv, "4623")
+
+	w := serve(srv, newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`))
+	if w.Code != 503 {
+		t.Errorf("slow deposit: status = %d, want 503", w.Code)
+	}
+
+	// Other routes keep the default timeout
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/withdraw", sessionID, `{"amount":100}`)), 200)
+
+	// The timed out deposit was abandoned
+	balance, err := store.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 400 {
+		t.Errorf("balance = %d, want 400", balance)
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	timeouts, err := ParseRouteTimeouts(map[string]string{"/statement": "5m", "/balance": "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]time.Duration{"/statement": 5 * time.Minute, "/balance": 2 * time.Second}
+	if !reflect.DeepEqual(timeouts, want) {
+		t.Errorf("timeouts = %v, want %v", timeouts, want)
+	}
+
+	_, err = ParseRouteTimeouts(map[string]string{"/balance": "soon"})
+	if err == nil {
+		t.Error("invalid timeout parsed")
+	}
+
+	srv, _ := newTestServer(t, func(cfg *Config) {
+		cfg.RouteTimeouts = timeouts
+	})
+
+	tests := []struct {
+		pattern string
+		want    time.Duration
+	}{
+		{"/statement", 5 * time.Minute},
+		{"/balance", 2 * time.Second},
+		{"/summary", 30 * time.Second},
+		{"/deposit", DefaultConfig().RouteTimeout},
+	}
+
+	for _, test := range tests {
+		if got := srv.routeTimeout(test.pattern); got != test.want {
+			t.Errorf("timeout of %s = %s, want %s", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv, store := newSlowServer(t, 100*time.Millisecond, func(cfg *Config) {
+		cfg.MaxRequestTimeout = 20 * time.Millisecond
+	})
+	acc := createAccount(t, store, "4623", 500)
+	sessionID := login(t, srv, "4623")
+
+	tests := []struct {
+		name, timeout string
+		want          int
+	}{
+		{"honored", "10ms", 503},
+		{"clamped", "1h", 503},
+		{"unparseable", "soon", 400},
+		{"negative", "-1s", 400},
+		{"zero", "0s", 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`)
+			r.Header.Set(RequestTimeoutHeader, test.timeout)
+
+			start := time.Now()
+			wantStatus(t, serve(srv, r), test.want)
+
+			// The deposit was abandoned before the store completed it
+			if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+				t.Errorf("deposit replied after %s", elapsed)
+			}
+		})
+	}
+
+	balance, err := store.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 500 {
+		t.Errorf("balance = %d, want 500", balance)
+	}
+
+	// Requests without the header keep the route timeout
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/deposit", sessionID, `{"amount":100}`)), 200)
+}
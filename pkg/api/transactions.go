@@ -0,0 +1,344 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+	"github.com/lbajolet/atm_service/pkg/receipt"
+)
+
+type transactionResponse struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+	Category  string    `json:"category,omitempty"`
+}
+
+type transactionsResponse struct {
+	Transactions []transactionResponse `json:"transactions"`
+	Limit        int                   `json:"limit"`
+	Offset       int                   `json:"offset"`
+}
+
+// listTransactions outputs the transactions of the account on GET
+// /transactions, newest first, paginated with `?limit=' and `?offset='
+func (s *Server) listTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	limit, offset, ok := s.parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	records, err := s.db.RecentTransactions(sess.Account, limit, offset)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such account")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to list transactions")
+		s.writeInternalError(w, r, err, "failed to list transactions")
+		return
+	}
+
+	resp := transactionsResponse{
+		Transactions: make([]transactionResponse, 0, len(records)),
+		Limit:        limit,
+		Offset:       offset,
+	}
+	for _, rec := range records {
+		resp.Transactions = append(resp.Transactions, transactionResponse{
+			ID:        rec.ID,
+			Type:      rec.Type.String(),
+			Amount:    rec.Amount,
+			CreatedAt: rec.CreatedAt,
+			Category:  rec.Category,
+		})
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+// transaction serves the routes operating on a single transaction of the
+// account:
+//
+//	GET /transactions/{id}: the transaction
+//	GET /transactions/{id}/receipt: a signed receipt of the transaction
+//
+// Transactions of other accounts are reported as missing, so their IDs cannot
+// be enumerated.
+func (s *Server) transaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		s.writeError(w, r, 404, "no such transaction")
+		return
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if action != "" && action != "receipt" {
+		s.writeError(w, r, 404, "not found")
+		return
+	}
+
+	rec, err := s.db.GetTransaction(id)
+	if err == nil && rec.Account != sess.Account {
+		err = persistence.ErrNoTransaction
+	}
+	if errors.Is(err, persistence.ErrNoTransaction) {
+		s.writeError(w, r, 404, "no such transaction")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get transaction")
+		s.writeInternalError(w, r, err, "failed to get transaction")
+		return
+	}
+
+	if action == "receipt" {
+		s.writeReceipt(w, r, rec)
+		return
+	}
+
+	s.writeResponse(w, r, 200, transactionResponse{
+		ID:        rec.ID,
+		Type:      rec.Type.String(),
+		Amount:    rec.Amount,
+		CreatedAt: rec.CreatedAt,
+		Category:  rec.Category,
+	})
+}
+
+type receiptResponse struct {
+	Receipt   receipt.Receipt `json:"receipt"`
+	Signature string          `json:"signature"`
+}
+
+// writeReceipt outputs the receipt of `rec', signed with the receipt secret
+func (s *Server) writeReceipt(w http.ResponseWriter, r *http.Request, rec persistence.TransactionRecord) {
+	if s.cfg.ReceiptSecret == "" {
+		s.writeError(w, r, 503, "receipts are not available")
+		return
+	}
+
+	balance, err := s.db.BalanceAfter(rec.Account, rec.ID)
+	if err != nil {
+		logError(err).Int("account_id", int(rec.Account)).Msg("failed to get balance for receipt")
+		s.writeInternalError(w, r, err, "failed to build receipt")
+		return
+	}
+
+	rcpt := receipt.Receipt{
+		TransactionID: rec.ID,
+		Account:       int(rec.Account),
+		Type:          rec.Type.String(),
+		Amount:        rec.Amount,
+		CreatedAt:     rec.CreatedAt,
+		BalanceAfter:  balance,
+	}
+
+	s.writeResponse(w, r, 200, receiptResponse{
+		Receipt:   rcpt,
+		Signature: receipt.Sign([]byte(s.cfg.ReceiptSecret), rcpt),
+	})
+}
+
+type summaryResponse struct {
+	Deposits    int64 `json:"deposits"`
+	Withdrawals int64 `json:"withdrawals"`
+	Net         int64 `json:"net"`
+	Balance     int64 `json:"balance"`
+}
+
+// getSummary outputs the totals of the deposits and withdrawals of the
+// account on GET /summary, over the optional `?from=' and `?to=' RFC 3339
+// bounds
+func (s *Server) getSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	from, ok := s.parseTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+
+	to, ok := s.parseTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		s.writeError(w, r, 400, "to must not be before from")
+		return
+	}
+
+	sum, err := s.db.Summary(sess.Account, from, to)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such account")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get summary")
+		s.writeInternalError(w, r, err, "failed to get summary")
+		return
+	}
+
+	s.writeResponse(w, r, 200, summaryResponse{
+		Deposits:    sum.Deposits,
+		Withdrawals: sum.Withdrawals,
+		Net:         sum.Net(),
+		Balance:     sum.Balance,
+	})
+}
+
+type categoryTotalsResponse struct {
+	// Category is null for uncategorized transactions
+	Category    *string `json:"category"`
+	Deposits    int64   `json:"deposits"`
+	Withdrawals int64   `json:"withdrawals"`
+	Net         int64   `json:"net"`
+}
+
+// getSummaryByCategory outputs the totals of the deposits and withdrawals of
+// the account for every category on GET /summary/by-category, over the
+// optional `?from=' and `?to=' RFC 3339 bounds
+func (s *Server) getSummaryByCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, r, 405, "not allowed")
+		return
+	}
+
+	sessItf := r.Context().Value(SessionKeyCtx)
+	if sessItf == nil {
+		panic("Session must not be nil if authenticated.")
+	}
+
+	sess := sessItf.(*Session)
+
+	from, ok := s.parseTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+
+	to, ok := s.parseTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+
+	totals, err := s.db.SummaryByCategory(sess.Account, from, to)
+	if errors.Is(err, persistence.ErrNoAccount) {
+		s.writeError(w, r, 404, "no such account")
+		return
+	}
+	if err != nil {
+		logError(err).Int("account_id", int(sess.Account)).Msg("failed to get summary by category")
+		s.writeInternalError(w, r, err, "failed to get summary")
+		return
+	}
+
+	resp := []categoryTotalsResponse{}
+	for _, t := range totals {
+		ct := categoryTotalsResponse{
+			Deposits:    t.Deposits,
+			Withdrawals: t.Withdrawals,
+			Net:         t.Deposits - t.Withdrawals,
+		}
+		if t.Category != "" {
+			category := t.Category
+			ct.Category = &category
+		}
+		resp = append(resp, ct)
+	}
+
+	s.writeResponse(w, r, 200, resp)
+}
+
+// parseTimeParam parses the optional RFC 3339 query parameter `name', and
+// responds with 400 if it is invalid
+func (s *Server) parseTimeParam(w http.ResponseWriter, r *http.Request, name string) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		s.writeErrorf(w, r, 400, "invalid %s, expected an RFC 3339 timestamp", name)
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// parsePagination reads the `limit' and `offset' query parameters of list
+// routes, replying with 400 if they are invalid
+//
+// A missing limit defaults to the configured page size, and limits above the
+// maximum page size are clamped to it.
+func (s *Server) parsePagination(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	limit, offset := s.cfg.DefaultPageSize, 0
+
+	params := []struct {
+		name string
+		dest *int
+	}{{"limit", &limit}, {"offset", &offset}}
+
+	for _, param := range params {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.writeErrorf(w, r, 400, "invalid %s, expected a non-negative integer", param.name)
+			return 0, 0, false
+		}
+		*param.dest = n
+	}
+
+	if limit > s.cfg.MaxPageSize {
+		limit = s.cfg.MaxPageSize
+	}
+
+	return limit, offset, true
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lbajolet/atm_service/pkg/persistence"
+)
+
+// wantBalances fails the test unless the accounts of `store' have the
+// balances of `want'
+func wantBalances(t *testing.T, store *persistence.Memory, want map[persistence.Account]int64) {
+	t.Helper()
+
+	for acc, balance := range want {
+		got, err := store.Balance(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != balance {
+			t.Errorf("balance of account %d = %d, want %d", acc, got, balance)
+		}
+	}
+}
+
+func TestBatchTransferModes(t *testing.T) {
+	srv, store := newTestServer(t, nil)
+	from := createAccount(t, store, "4623", 500)
+	to := createAccount(t, store, "5082", 0)
+	other := createAccount(t, store, "7391", 0)
+	sessionID := login(t, srv, "4623")
+
+	// The credit to an unknown account fails
+	body := fmt.Sprintf(`[{"to":%d,"amount":100},{"to":42,"amount":50},{"to":%d,"amount":200}]`, to, other)
+
+	// Atomic by default: the failing credit rolls back the others
+	wantStatus(t, serve(srv, newRequest(http.MethodPost, "/transfer/batch", sessionID, body)), 404)
+	wantBalances(t, store, map[persistence.Account]int64{from: 500, to: 0, other: 0})
+
+	w := serve(srv, newRequest(http.MethodPost, "/transfer/batch?mode=independent", sessionID, body))
+	wantStatus(t, w, 200)
+
+	var env struct {
+		Data batchResultsResponse `json:"data"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := env.Data
+	if results.Succeeded != 2 || results.Failed != 1 || len(results.Results) != 3 {
+		t.Fatalf("results = %+v, want 2 succeeded and 1 failed", results)
+	}
+	if failed := results.Results[1]; failed.OK || failed.Error != persistence.ErrNoAccount.Error() {
+		t.Errorf("result of the failing credit = %+v", failed)
+	}
+	wantBalances(t, store, map[persistence.Account]int64{from: 200, to: 100, other: 200})
+}
@@ -0,0 +1,195 @@
+// Package cash computes how amounts are dispensed as bills
+package cash
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Breakdown returns how many bills of each denomination make up `amount',
+// using as few bills as possible
+//
+// Returns false if `amount' cannot be made from `denoms'.
+func Breakdown(amount int64, denoms []int64) (map[int64]int64, bool) {
+	if amount < 0 {
+		return nil, false
+	}
+
+	breakdown := map[int64]int64{}
+	if amount == 0 {
+		return breakdown, true
+	}
+
+	unit := int64(0)
+	for _, d := range denoms {
+		if d > 0 {
+			unit = gcd(unit, d)
+		}
+	}
+
+	if unit == 0 || amount%unit != 0 {
+		return nil, false
+	}
+
+	// Work in multiples of the GCD of the denominations, and find the
+	// smallest number of bills for every amount up to the requested one.
+	n := amount / unit
+	bills := make([]int64, n+1)
+	last := make([]int64, n+1)
+	for i := int64(1); i <= n; i++ {
+		bills[i] = -1
+		for _, d := range denoms {
+			if d <= 0 || d/unit > i {
+				continue
+			}
+
+			prev := bills[i-d/unit]
+			if prev < 0 {
+				continue
+			}
+
+			if bills[i] < 0 || prev+1 < bills[i] {
+				bills[i] = prev + 1
+				last[i] = d
+			}
+		}
+	}
+
+	if bills[n] < 0 {
+		return nil, false
+	}
+
+	for i := n; i > 0; i -= last[i] / unit {
+		breakdown[last[i]]++
+	}
+
+	return breakdown, true
+}
+
+// CanDispense returns whether `amount' can be made from `denoms'
+func CanDispense(amount int64, denoms []int64) bool {
+	_, ok := Breakdown(amount, denoms)
+	return ok
+}
+
+// LargestDispensable returns the largest amount up to `balance' which can be
+// made from `denoms', 0 if none can
+func LargestDispensable(balance int64, denoms []int64) int64 {
+	if balance <= 0 {
+		return 0
+	}
+
+	unit := int64(0)
+	smallest := int64(0)
+	for _, d := range denoms {
+		if d > 0 {
+			unit = gcd(unit, d)
+			if smallest == 0 || d < smallest {
+				smallest = d
+			}
+		}
+	}
+
+	if unit == 0 {
+		return 0
+	}
+
+	// Working in multiples of the GCD, an amount that can be dispensed still
+	// can with one more bill of the smallest denomination. Find, for every
+	// remainder modulo that bill, the smallest amount that can be dispensed,
+	// all larger amounts with the same remainder can be dispensed too.
+	n := balance / unit
+	m := smallest / unit
+	lowest := make([]int64, m)
+	done := make([]bool, m)
+	for r := range lowest {
+		lowest[r] = -1
+	}
+	lowest[0] = 0
+
+	for {
+		r := int64(-1)
+		for i := int64(0); i < m; i++ {
+			if !done[i] && lowest[i] >= 0 && (r < 0 || lowest[i] < lowest[r]) {
+				r = i
+			}
+		}
+		if r < 0 {
+			break
+		}
+		done[r] = true
+
+		for _, d := range denoms {
+			if d <= 0 {
+				continue
+			}
+
+			next := lowest[r] + d/unit
+			if lowest[next%m] < 0 || next < lowest[next%m] {
+				lowest[next%m] = next
+			}
+		}
+	}
+
+	largest := int64(0)
+	for r, low := range lowest {
+		if low < 0 || low > n {
+			continue
+		}
+
+		amount := n - (n-int64(r))%m
+		if amount > largest {
+			largest = amount
+		}
+	}
+
+	return largest * unit
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// ErrUnknownDenomination is returned when counting bills of a denomination the
+// ATM does not accept
+var ErrUnknownDenomination = errors.New("unknown denomination")
+
+// SumDenominations returns the total value of `counts', the number of bills
+// of each denomination
+//
+// Fails with ErrUnknownDenomination if a denomination is not in `accepted'.
+func SumDenominations(counts map[int64]int64, accepted []int64) (int64, error) {
+	total := int64(0)
+	for denom, count := range counts {
+		if !contains(accepted, denom) {
+			return 0, fmt.Errorf("%d: %w", denom, ErrUnknownDenomination)
+		}
+
+		if count < 0 {
+			return 0, fmt.Errorf("negative count of %d bills", denom)
+		}
+
+		if count > 0 && denom > (math.MaxInt64-total)/count {
+			return 0, fmt.Errorf("total of %d bills of %d overflows", count, denom)
+		}
+
+		total += denom * count
+	}
+
+	return total, nil
+}
+
+func contains(values []int64, v int64) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
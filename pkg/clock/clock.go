@@ -0,0 +1,19 @@
+// Package clock abstracts the current time, so time-dependent behaviours can
+// be driven by a fake clock
+package clock
+
+import "time"
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type system struct{}
+
+func (system) Now() time.Time {
+	return time.Now()
+}
+
+// System is the clock of the operating system
+var System Clock = system{}
@@ -0,0 +1,31 @@
+// Package events publishes the money movements of the service to downstream
+// systems
+package events
+
+import "time"
+
+// Transaction is the event published when a money movement is committed
+type Transaction struct {
+	ID      int64 `json:"id"`
+	Account int   `json:"account"`
+	// Amount is negative for debits
+	Amount    int64     `json:"amount"`
+	Category  string    `json:"category,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Publisher publishes transaction events
+//
+// Publish must not block, and failures to publish are not reported to the
+// caller: events are published on a best-effort basis, and never fail the
+// transaction they describe.
+type Publisher interface {
+	Publish(tx Transaction)
+}
+
+// Nop is a Publisher discarding the events, used when no broker is
+// configured
+type Nop struct{}
+
+// Publish discards `tx'
+func (Nop) Publish(tx Transaction) {}
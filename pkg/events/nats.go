@@ -0,0 +1,86 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// natsQueueSize is the number of events waiting to be published to NATS
+// beyond which new events are dropped
+const natsQueueSize = 1024
+
+// NATSPublisher publishes events to a subject of a NATS server
+//
+// Events are queued and published in the background; they are dropped when
+// the queue is full, e.g. while the server cannot be reached for long.
+type NATSPublisher struct {
+	conn    *nats.Conn
+	subject string
+	queue   chan Transaction
+	done    sync.WaitGroup
+}
+
+// NewNATSPublisher connects to the NATS server at `url', and returns a
+// publisher of events to `subject'
+//
+// If the server cannot be reached yet, connecting is retried in the
+// background.
+func NewNATSPublisher(url, subject string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &NATSPublisher{
+		conn:    conn,
+		subject: subject,
+		queue:   make(chan Transaction, natsQueueSize),
+	}
+
+	p.done.Add(1)
+	go p.run()
+
+	return p, nil
+}
+
+// Publish queues `tx' to be published, or drops it if the queue is full
+func (p *NATSPublisher) Publish(tx Transaction) {
+	select {
+	case p.queue <- tx:
+	default:
+		log.Warn().Int64("transaction_id", tx.ID).Msg("event queue full, transaction event dropped")
+	}
+}
+
+func (p *NATSPublisher) run() {
+	defer p.done.Done()
+
+	for tx := range p.queue {
+		data, err := json.Marshal(tx)
+		if err != nil {
+			log.Error().Err(err).Int64("transaction_id", tx.ID).Msg("failed to encode transaction event")
+			continue
+		}
+
+		err = p.conn.Publish(p.subject, data)
+		if err != nil {
+			log.Error().Err(err).Int64("transaction_id", tx.ID).Msg("failed to publish transaction event")
+		}
+	}
+}
+
+// Close publishes the queued events, and disconnects from the server
+//
+// Publish must not be called after Close.
+func (p *NATSPublisher) Close() error {
+	close(p.queue)
+	p.done.Wait()
+
+	return p.conn.Drain()
+}
@@ -0,0 +1,395 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/events"
+	"github.com/mattn/go-sqlite3"
+)
+
+// AccountInfo is the state of an account, as seen by administrators
+type AccountInfo struct {
+	ID      Account
+	Balance int64
+	// ClosedAt is the time the account was closed, zero if it is open
+	ClosedAt time.Time
+}
+
+// IsClosed returns whether the account has been closed
+func (ai AccountInfo) IsClosed() bool {
+	return !ai.ClosedAt.IsZero()
+}
+
+// querier is the subset of *sql.DB and *sql.Tx needed to run single-row
+// queries
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+const accountStateQuery = "SELECT balance, closed_at FROM users WHERE id = ?"
+
+// accountState reads the balance and closing time of `acc'
+//
+// Returns ErrNoAccount if the account does not exist, and ErrInvalidAccount
+// without querying the database if `acc' is not a valid account.
+func accountState(ctx context.Context, q querier, acc Account) (AccountInfo, error) {
+	info := AccountInfo{ID: acc}
+	closedAt := sql.NullInt64{}
+
+	err := checkAccount(acc)
+	if err != nil {
+		return info, err
+	}
+
+	err = q.QueryRowContext(ctx, accountStateQuery, acc).Scan(&info.Balance, &closedAt)
+	if err == sql.ErrNoRows {
+		return info, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+	if err != nil {
+		return info, internal(err, acc, "failed to get account state")
+	}
+
+	if closedAt.Valid {
+		info.ClosedAt = time.Unix(closedAt.Int64, 0).UTC()
+	}
+
+	return info, nil
+}
+
+// openAccountBalance returns the balance of `acc' within `dbTx'
+//
+// Fails with ErrAccountClosed if the account is closed.
+func openAccountBalance(ctx context.Context, dbTx *sql.Tx, acc Account) (int64, error) {
+	info, err := accountState(ctx, dbTx, acc)
+	if err != nil {
+		return -1, err
+	}
+
+	if info.IsClosed() {
+		return -1, fmt.Errorf("account %d: %w", acc, ErrAccountClosed)
+	}
+
+	return info.Balance, nil
+}
+
+// AccountInfo returns the state of the account, whether it is open or closed
+func (d DB) AccountInfo(acc Account) (info AccountInfo, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return AccountInfo{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	return accountState(ctx, d.connection, acc)
+}
+
+const accountCloseQuery = "UPDATE users SET closed_at = ? WHERE id = ?"
+
+// CloseAccount marks the account as closed
+//
+// The account and its transactions are kept, but it can no longer be logged
+// into nor transacted on. Only accounts with a zero balance can be closed.
+func (d DB) CloseAccount(acc Account) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return internal(err, acc, "failed to build DB transaction")
+	}
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	if balance != 0 {
+		dbTx.Rollback()
+		return fmt.Errorf("account %d: %w", acc, ErrNonZeroBalance)
+	}
+
+	_, err = dbTx.ExecContext(ctx, accountCloseQuery, d.cfg.Clock.Now().Unix(), acc)
+	if err != nil {
+		dbTx.Rollback()
+		return internal(err, acc, "failed to close account")
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return internal(err, acc, "failed to commit account closing")
+	}
+
+	return nil
+}
+
+// CloseAccountWithPayout transfers the whole balance of the account to
+// `payout', and marks it as closed, atomically; it returns the amount paid out
+//
+// Accounts with funds on hold cannot be closed, as the held funds cannot be
+// paid out.
+func (d DB) CloseAccountWithPayout(acc, payout Account) (_ int64, err error) {
+	record, err := d.guardAccount(acc, payout)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	if payout == acc {
+		return 0, fmt.Errorf("payout to account %d: %w", payout, ErrInvalidTransaction)
+	}
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, internal(err, acc, "failed to build DB transaction")
+	}
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, err
+	}
+
+	held, err := d.heldAmount(ctx, dbTx, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, err
+	}
+
+	if held != 0 {
+		dbTx.Rollback()
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNonZeroBalance)
+	}
+
+	moved := []events.Transaction{}
+	if balance > 0 {
+		payoutBalance, err := openAccountBalance(ctx, dbTx, payout)
+		if err != nil {
+			dbTx.Rollback()
+			return 0, err
+		}
+
+		_, err = addAmounts(payoutBalance, balance)
+		if err != nil {
+			dbTx.Rollback()
+			return 0, err
+		}
+
+		err = d.applyCredit(ctx, dbTx, acc, transfer, -balance, &moved)
+		if err != nil {
+			dbTx.Rollback()
+			return 0, err
+		}
+
+		err = d.applyCredit(ctx, dbTx, payout, transfer, balance, &moved)
+		if err != nil {
+			dbTx.Rollback()
+			return 0, err
+		}
+	}
+
+	_, err = dbTx.ExecContext(ctx, accountCloseQuery, d.cfg.Clock.Now().Unix(), acc)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, acc, "failed to close account")
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return 0, internal(err, acc, "failed to commit account closing")
+	}
+
+	d.Publish(moved)
+	return balance, nil
+}
+
+const accountReopenQuery = "UPDATE users SET closed_at = NULL WHERE id = ?"
+
+// ReopenAccount reopens a closed account
+func (d DB) ReopenAccount(acc Account) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	res, err := d.connection.ExecContext(ctx, accountReopenQuery, acc)
+	if err != nil {
+		return internal(err, acc, "failed to reopen account")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return internal(err, acc, "failed to reopen account")
+	}
+
+	if n == 0 {
+		return fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	return nil
+}
+
+const accountInsertQuery = "INSERT INTO users(pin, card_number, balance, external_ref) VALUES(?, ?, 0, ?)"
+
+const accountByRefQuery = "SELECT id FROM users WHERE external_ref = ?"
+
+// CreateAccount creates an account for the card, and returns its ID
+//
+// A non-zero `balance' is recorded as an initial deposit, and must be at least
+// the configured minimum opening deposit. Fails with ErrDuplicateCard if the
+// card number is already assigned to an account, with ErrWeakPIN if `pin' is
+// one of the configured weak PINs, and with ErrPINInUse if it already
+// authenticates to an account.
+//
+// If `externalRef' is not empty and an account was already created with it,
+// that account is returned instead, and `created' is false, so creations can
+// be retried safely.
+func (d DB) CreateAccount(pin, cardNumber, externalRef string, balance int64) (acc Account, created bool, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return NoAccount, false, err
+	}
+	defer func() { record(err) }()
+
+	err = d.cfg.checkNewPIN(pin)
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	err = d.cfg.checkOpeningBalance(balance)
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	if externalRef != "" {
+		acc, err = d.accountByRef(ctx, externalRef)
+		if err == nil || !errors.Is(err, ErrNoAccount) {
+			return acc, false, err
+		}
+	}
+
+	ref := sql.NullString{
+		String: externalRef,
+		Valid:  externalRef != "",
+	}
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return NoAccount, false, internal(err, NoAccount, "failed to build DB transaction")
+	}
+
+	err = d.checkPINUnused(ctx, dbTx, NoAccount, pin)
+	if err != nil {
+		dbTx.Rollback()
+		return NoAccount, false, err
+	}
+
+	res, err := dbTx.ExecContext(ctx, accountInsertQuery, pin, cardNumber, ref)
+	if isUniqueViolation(err) {
+		dbTx.Rollback()
+
+		// A concurrent creation with the same reference won the race
+		if externalRef != "" {
+			acc, refErr := d.accountByRef(ctx, externalRef)
+			if refErr == nil {
+				return acc, false, nil
+			}
+		}
+
+		return NoAccount, false, fmt.Errorf("card %s: %w", cardNumber, ErrDuplicateCard)
+	}
+	if err != nil {
+		dbTx.Rollback()
+		return NoAccount, false, internal(err, NoAccount, "failed to insert account")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		dbTx.Rollback()
+		return NoAccount, false, internal(err, NoAccount, "failed to get account ID")
+	}
+
+	acc = Account(id)
+	moved := []events.Transaction{}
+	if balance > 0 {
+		err = d.applyCredit(ctx, dbTx, acc, Deposit, balance, &moved)
+		if err != nil {
+			dbTx.Rollback()
+			return NoAccount, false, err
+		}
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return NoAccount, false, internal(err, acc, "failed to commit account creation")
+	}
+
+	d.Publish(moved)
+	return acc, true, nil
+}
+
+// checkOpeningBalance validates the initial balance of a new account
+func (cfg Config) checkOpeningBalance(balance int64) error {
+	if balance < 0 {
+		return fmt.Errorf("initial balance %d: %w", balance, ErrInvalidTransaction)
+	}
+
+	if balance > MaxAmount {
+		return fmt.Errorf("initial balance %d: %w", balance, ErrAmountOverflow)
+	}
+
+	if balance < cfg.MinOpeningDeposit {
+		return fmt.Errorf("initial balance %d: %w", balance, ErrBelowMinimumDeposit)
+	}
+
+	return nil
+}
+
+// accountByRef returns the account created with `externalRef'
+func (d DB) accountByRef(ctx context.Context, externalRef string) (Account, error) {
+	acc := NoAccount
+
+	err := d.connection.QueryRowContext(ctx, accountByRefQuery, externalRef).Scan(&acc)
+	if err == sql.ErrNoRows {
+		return NoAccount, fmt.Errorf("external reference %s: %w", externalRef, ErrNoAccount)
+	}
+	if err != nil {
+		return NoAccount, internal(err, NoAccount, "failed to get account by external reference")
+	}
+
+	return acc, nil
+}
+
+// isUniqueViolation returns whether `err' is a SQLite UNIQUE constraint
+// violation
+func isUniqueViolation(err error) bool {
+	sqliteErr := sqlite3.Error{}
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreateAccountDuplicateCard(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		createAccount(t, s, "4623", 0)
+
+		_, _, err := s.CreateAccount("8264", "4970104623000000", "", 0)
+		wantError(t, err, ErrDuplicateCard)
+	})
+}
+
+func TestCreateAccountPINInUse(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "8264", 0)
+
+		_, _, err := s.CreateAccount("4623", "4970100000000001", "", 0)
+		wantError(t, err, ErrPINInUse)
+
+		// Nor can it be the unexpired temporary PIN of an account
+		pin, _, err := s.IssueTempPIN(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = s.CreateAccount(pin, "4970100000000002", "", 0)
+		wantError(t, err, ErrPINInUse)
+
+		// The PINs still authenticate to their accounts only
+		got, temporary, err := s.Auth("4623")
+		if err != nil || got != acc || temporary {
+			t.Errorf("auth = %d, %t, %v, want %d", got, temporary, err, acc)
+		}
+		got, temporary, err = s.Auth(pin)
+		if err != nil || got != other || !temporary {
+			t.Errorf("auth with temporary PIN = %d, %t, %v, want %d", got, temporary, err, other)
+		}
+	})
+}
+
+func TestCreateAccountExpiredTempPIN(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		other := createAccount(t, s, "8264", 0)
+
+		pin, expiresAt, err := s.IssueTempPIN(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Expired temporary PINs can be used again
+		clk.now = expiresAt.Add(time.Second)
+		acc, _, err := s.CreateAccount(pin, "4970100000000001", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, _, err := s.Auth(pin)
+		if err != nil || got != acc {
+			t.Errorf("auth = %d, %v, want %d", got, err, acc)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxAmount is the largest amount accepted for a single transaction
+//
+// It is well below math.MaxInt64 so sums of amounts do not come close to
+// overflowing, and amounts stay exactly representable by JSON clients using
+// double precision numbers.
+const MaxAmount = int64(1) << 53
+
+// checkAmount validates the amount of a single movement
+func checkAmount(amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("amount %d: %w", amount, ErrInvalidTransaction)
+	}
+
+	if amount > MaxAmount {
+		return fmt.Errorf("amount %d: %w", amount, ErrAmountOverflow)
+	}
+
+	return nil
+}
+
+// addAmounts returns `a' + `b', failing with ErrAmountOverflow if the sum does
+// not fit in an int64
+func addAmounts(a, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, fmt.Errorf("%d + %d: %w", a, b, ErrAmountOverflow)
+	}
+
+	return a + b, nil
+}
+
+// CreditsTotal validates the amount of every credit of a transfer and
+// returns their sum, failing with ErrInvalidTransaction or ErrAmountOverflow
+func CreditsTotal(credits []Credit) (int64, error) {
+	total := int64(0)
+	for _, c := range credits {
+		err := checkAmount(c.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("credit to account %d: %w", c.To, err)
+		}
+
+		total, err = addAmounts(total, c.Amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestAddAmounts(t *testing.T) {
+	tests := []struct {
+		a, b int64
+		want int64
+		err  error
+	}{
+		{1, 2, 3, nil},
+		{math.MaxInt64 - 1, 1, math.MaxInt64, nil},
+		{math.MaxInt64, 1, 0, ErrAmountOverflow},
+		{math.MaxInt64, math.MaxInt64, 0, ErrAmountOverflow},
+		{math.MinInt64 + 1, -1, math.MinInt64, nil},
+		{math.MinInt64, -1, 0, ErrAmountOverflow},
+		{math.MaxInt64, math.MinInt64, -1, nil},
+	}
+
+	for _, test := range tests {
+		got, err := addAmounts(test.a, test.b)
+		if test.err != nil {
+			wantError(t, err, test.err)
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("addAmounts(%d, %d) = %d, %v, want %d", test.a, test.b, got, err, test.want)
+		}
+	}
+}
+
+func TestTransactionAmountBoundaries(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+
+		tests := []struct {
+			amount int64
+			err    error
+		}{
+			{0, ErrInvalidTransaction},
+			{-1, ErrInvalidTransaction},
+			{math.MinInt64, ErrInvalidTransaction},
+			{MaxAmount + 1, ErrAmountOverflow},
+			{math.MaxInt64, ErrAmountOverflow},
+			{MaxAmount, nil},
+		}
+
+		for _, test := range tests {
+			_, err := s.DoTransaction(context.Background(), acc, Transaction{Type: Deposit, Amount: test.amount})
+			if test.err != nil {
+				wantError(t, err, test.err)
+				continue
+			}
+			if err != nil {
+				t.Errorf("deposit of %d: %v", test.amount, err)
+			}
+		}
+
+		wantBalance(t, s, acc, MaxAmount)
+	})
+}
+
+func TestBalanceOverflow(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "8264", 100)
+		setBalance(t, s, acc, math.MaxInt64-10)
+
+		_, err := s.DoTransaction(context.Background(), acc, Transaction{Type: Deposit, Amount: 11})
+		wantError(t, err, ErrAmountOverflow)
+
+		err = s.FanOutTransfer(context.Background(), other, []Credit{{acc, 11}})
+		wantError(t, err, ErrAmountOverflow)
+
+		_, err = s.DoTransaction(context.Background(), acc, Transaction{Type: Deposit, Amount: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, acc, math.MaxInt64)
+		wantBalance(t, s, other, 100)
+	})
+}
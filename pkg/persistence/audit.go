@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditEntry is an administrative action recorded in the audit log
+type AuditEntry struct {
+	ID int64
+	// Action names the action, e.g. "close" or "adjust"
+	Action string
+	// Account is the account acted on, NoAccount for actions on none
+	Account   Account
+	CreatedAt time.Time
+	// Detail describes the action, e.g. the reason of an adjustment; it
+	// never holds secrets such as PINs or session tokens
+	Detail string
+}
+
+// AuditFilter selects entries of the audit log, its zero value selecting
+// them all
+type AuditFilter struct {
+	// Account selects the entries of an account, if valid
+	Account Account
+	// Action selects the entries of an action, unless empty
+	Action string
+	// From and To bound the period the entries were recorded over, a zero
+	// time leaving the period unbounded on its side
+	From, To time.Time
+}
+
+// MaxAuditActionLength is the maximum length of the action of an audit entry
+const MaxAuditActionLength = 32
+
+// check validates the entry to record, which needs an action
+func (entry AuditEntry) check() error {
+	if entry.Action == "" || len(entry.Action) > MaxAuditActionLength {
+		return fmt.Errorf("audit action %q: %w", entry.Action, ErrInvalidAuditEntry)
+	}
+
+	if entry.Account != NoAccount {
+		return checkAccount(entry.Account)
+	}
+
+	return nil
+}
+
+const auditInsertQuery = "INSERT INTO audit_log(action, user, created_at, detail) VALUES(?, ?, ?, ?)"
+
+// RecordAudit records the administrative action `entry' at the current time,
+// and returns the ID of its entry
+func (d DB) RecordAudit(entry AuditEntry) (_ int64, err error) {
+	err = entry.check()
+	if err != nil {
+		return -1, err
+	}
+
+	record, err := d.guard()
+	if err != nil {
+		return -1, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	user := sql.NullInt64{}
+	if entry.Account != NoAccount {
+		user = sql.NullInt64{Int64: int64(entry.Account), Valid: true}
+	}
+
+	var res sql.Result
+	err = d.retryBusy(ctx, func() error {
+		var err error
+		res, err = d.connection.ExecContext(ctx, auditInsertQuery, entry.Action, user, d.cfg.Clock.Now().Unix(), entry.Detail)
+		return err
+	})
+	if err != nil {
+		return -1, internal(err, entry.Account, "failed to record audit entry")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, internal(err, entry.Account, "failed to record audit entry")
+	}
+
+	return id, nil
+}
+
+const auditQuery = `SELECT id, action, user, created_at, detail FROM audit_log
+WHERE (? IS NULL OR user = ?) AND (? = '' OR action = ?) AND created_at >= ? AND created_at <= ?
+ORDER BY id DESC LIMIT ? OFFSET ?`
+
+// ListAudit returns at most `limit' entries of the audit log selected by
+// `filter', newest first, skipping the `offset' newest ones
+func (d DB) ListAudit(filter AuditFilter, limit, offset int) (_ []AuditEntry, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	user := sql.NullInt64{}
+	if filter.Account.IsValid() {
+		user = sql.NullInt64{Int64: int64(filter.Account), Valid: true}
+	}
+
+	from, to := periodBounds(filter.From, filter.To)
+	rows, err := d.connection.QueryContext(ctx, auditQuery, user, user,
+		filter.Action, filter.Action, from, to, limit, offset)
+	if err != nil {
+		return nil, internal(err, NoAccount, "failed to query audit log")
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{}
+		user := sql.NullInt64{}
+		createdAt := int64(0)
+
+		err = rows.Scan(&entry.ID, &entry.Action, &user, &createdAt, &entry.Detail)
+		if err != nil {
+			return nil, internal(err, NoAccount, "failed to read audit entry")
+		}
+
+		entry.Account = NoAccount
+		if user.Valid {
+			entry.Account = Account(user.Int64)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0).UTC()
+		entries = append(entries, entry)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, internal(err, NoAccount, "failed to read audit log")
+	}
+
+	return entries, nil
+}
+
+// matches tells whether `entry' is selected by `filter'
+func (filter AuditFilter) matches(entry AuditEntry) bool {
+	if filter.Account.IsValid() && entry.Account != filter.Account {
+		return false
+	}
+
+	if filter.Action != "" && entry.Action != filter.Action {
+		return false
+	}
+
+	from, to := periodBounds(filter.From, filter.To)
+	createdAt := entry.CreatedAt.Unix()
+	return createdAt >= from && createdAt <= to
+}
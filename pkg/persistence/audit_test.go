@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// auditIDs returns the IDs of `entries'
+func auditIDs(entries []AuditEntry) []int64 {
+	ids := []int64{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
+
+func TestListAudit(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "8264", 0)
+		start := clk.Now()
+
+		entries := []AuditEntry{
+			{Action: "close", Account: acc},
+			{Action: "temp-pin", Account: other},
+			{Action: "purge", Account: NoAccount, Detail: "1 purged"},
+			{Action: "reopen", Account: acc},
+			{Action: "adjust", Account: acc, Detail: "failed settlement"},
+		}
+		for _, entry := range entries {
+			_, err := s.RecordAudit(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clk.advance(time.Hour)
+		}
+
+		latest, err := s.ListAudit(AuditFilter{}, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := AuditEntry{
+			ID:        5,
+			Action:    "adjust",
+			Account:   acc,
+			CreatedAt: start.Add(4 * time.Hour),
+			Detail:    "failed settlement",
+		}
+		if len(latest) != 1 || latest[0] != want {
+			t.Fatalf("latest entry = %+v, want %+v", latest, want)
+		}
+
+		tests := []struct {
+			name          string
+			filter        AuditFilter
+			limit, offset int
+			want          []int64
+		}{
+			{"all", AuditFilter{}, 10, 0, []int64{5, 4, 3, 2, 1}},
+			{"account", AuditFilter{Account: acc}, 10, 0, []int64{5, 4, 1}},
+			{"action", AuditFilter{Action: "purge"}, 10, 0, []int64{3}},
+			{"account and action", AuditFilter{Account: acc, Action: "temp-pin"}, 10, 0, []int64{}},
+			{"from", AuditFilter{From: start.Add(3 * time.Hour)}, 10, 0, []int64{5, 4}},
+			{"to", AuditFilter{To: start.Add(time.Hour)}, 10, 0, []int64{2, 1}},
+			{"first page", AuditFilter{}, 2, 0, []int64{5, 4}},
+			{"second page", AuditFilter{}, 2, 2, []int64{3, 2}},
+			{"last page", AuditFilter{}, 2, 4, []int64{1}},
+			{"filtered page", AuditFilter{Account: acc}, 2, 1, []int64{4, 1}},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				entries, err := s.ListAudit(test.filter, test.limit, test.offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if ids := auditIDs(entries); !reflect.DeepEqual(ids, test.want) {
+					t.Errorf("entries = %v, want %v", ids, test.want)
+				}
+			})
+		}
+	})
+}
+
+func TestRecordAuditInvalid(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		_, err := s.RecordAudit(AuditEntry{Account: NoAccount})
+		wantError(t, err, ErrInvalidAuditEntry)
+
+		_, err = s.RecordAudit(AuditEntry{Action: "close", Account: 0})
+		wantError(t, err, ErrInvalidAccount)
+	})
+}
@@ -0,0 +1,168 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/rs/zerolog/log"
+)
+
+// CircuitOpenError is returned without reaching the database while the
+// circuit breaker is open, after repeated database failures
+//
+// It matches ErrCircuitOpen with errors.Is.
+type CircuitOpenError struct {
+	// RetryAfter is the remaining time before the database is probed again
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrCircuitOpen, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// circuitBreaker stops operations from reaching the database after
+// `threshold' consecutive failures, for `cooldown'
+//
+// Once the cooldown has elapsed, a single operation probes the database: the
+// circuit closes again if it succeeds, and reopens otherwise.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+	// lastSuccess is the time of the last operation which reached the
+	// database successfully
+	lastSuccess time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, clk clock.Clock) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clk,
+	}
+}
+
+// allow returns a CircuitOpenError if the operation must not reach the
+// database; otherwise its outcome must be passed to record
+func (cb *circuitBreaker) allow() error {
+	if cb.threshold <= 0 {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return nil
+	}
+
+	retryAt := cb.openedAt.Add(cb.cooldown)
+	now := cb.clock.Now()
+	if now.Before(retryAt) {
+		return &CircuitOpenError{
+			RetryAfter: retryAt.Sub(now),
+		}
+	}
+
+	if cb.probing {
+		return &CircuitOpenError{
+			RetryAfter: cb.cooldown,
+		}
+	}
+
+	cb.probing = true
+	return nil
+}
+
+// record updates the state of the circuit with the outcome of an operation
+// allowed by allow
+//
+// Only errors telling the database is unavailable count as failures.
+// Operations cancelled by their caller tell nothing about the database, and
+// are not counted either way.
+func (cb *circuitBreaker) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		cb.mu.Lock()
+		cb.probing = false
+		cb.mu.Unlock()
+		return
+	}
+
+	failed := errors.Is(err, ErrInternal) || errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrBusy)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !failed {
+		cb.lastSuccess = cb.clock.Now()
+	}
+
+	if cb.threshold <= 0 {
+		return
+	}
+
+	wasOpen := cb.failures >= cb.threshold
+	cb.probing = false
+
+	if !failed {
+		if wasOpen {
+			log.Info().Msg("database recovered, circuit closed")
+		}
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		if !wasOpen {
+			log.Error().Int("failures", cb.failures).Dur("cooldown", cb.cooldown).Msg("database failing, circuit opened")
+		}
+		cb.openedAt = cb.clock.Now()
+	}
+}
+
+// lastSucceeded returns the time of the last successful operation, zero if
+// none succeeded yet
+func (cb *circuitBreaker) lastSucceeded() time.Time {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.lastSuccess
+}
+
+// guard checks that the circuit breaker lets an operation through, and
+// returns the function recording its outcome
+func (d DB) guard() (func(error), error) {
+	err := d.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.breaker.record, nil
+}
+
+// guardAccount is guard for operations on `accs', which fail with
+// ErrInvalidAccount before reaching the database if one of them is invalid
+func (d DB) guardAccount(accs ...Account) (func(error), error) {
+	for _, acc := range accs {
+		err := checkAccount(acc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d.guard()
+}
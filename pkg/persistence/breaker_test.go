@@ -0,0 +1,112 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wantAllowed fails the test unless `cb' lets an operation through, or not
+func wantAllowed(t *testing.T, cb *circuitBreaker, want bool) {
+	t.Helper()
+
+	err := cb.allow()
+	if want && err != nil {
+		t.Fatalf("operation refused: %v", err)
+	}
+	if !want {
+		wantError(t, err, ErrCircuitOpen)
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	cb := newCircuitBreaker(3, time.Minute, clk)
+	failure := internal(errors.New("disk I/O error"), NoAccount, "failed")
+
+	// Closed: failures below the threshold, or interrupted by a success,
+	// let operations through
+	for i := 0; i < 2; i++ {
+		wantAllowed(t, cb, true)
+		cb.record(failure)
+	}
+	wantAllowed(t, cb, true)
+	cb.record(nil)
+	for i := 0; i < 2; i++ {
+		wantAllowed(t, cb, true)
+		cb.record(failure)
+	}
+
+	// Errors not telling the database is unavailable are not failures
+	wantAllowed(t, cb, true)
+	cb.record(ErrNoAccount)
+	wantAllowed(t, cb, true)
+	cb.record(context.Canceled)
+
+	// Open: the threshold of consecutive failures is reached
+	wantAllowed(t, cb, true)
+	cb.record(failure)
+	wantAllowed(t, cb, true)
+	cb.record(failure)
+	wantAllowed(t, cb, true)
+	cb.record(failure)
+
+	clk.advance(40 * time.Second)
+	err := cb.allow()
+	var open *CircuitOpenError
+	if !errors.As(err, &open) || open.RetryAfter != 20*time.Second {
+		t.Fatalf("error = %v, want a CircuitOpenError retrying after 20s", err)
+	}
+
+	// Half-open: a single operation probes the database, and reopens the
+	// circuit if it fails
+	clk.advance(20 * time.Second)
+	wantAllowed(t, cb, true)
+	wantAllowed(t, cb, false)
+	cb.record(failure)
+	wantAllowed(t, cb, false)
+
+	// Closed again once a probe succeeds
+	clk.advance(time.Minute)
+	wantAllowed(t, cb, true)
+	cb.record(nil)
+	wantAllowed(t, cb, true)
+	wantAllowed(t, cb, true)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	cb := newCircuitBreaker(0, time.Minute, clk)
+
+	for i := 0; i < 10; i++ {
+		wantAllowed(t, cb, true)
+		cb.record(ErrBusy)
+	}
+}
+
+func TestDBCircuitBreaker(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	cfg := testConfig(clk)
+	cfg.BreakerThreshold = 2
+	cfg.BreakerCooldown = time.Minute
+	db := newTestDB(t, cfg)
+
+	acc := createAccount(t, db, "4623", 100)
+
+	// The database becomes unreachable
+	db.connection.Close()
+	for i := 0; i < 2; i++ {
+		_, err := db.Balance(acc)
+		wantError(t, err, ErrInternal)
+	}
+
+	_, err := db.Balance(acc)
+	wantError(t, err, ErrCircuitOpen)
+	_, _, err = db.Auth("4623")
+	wantError(t, err, ErrCircuitOpen)
+
+	// Invalid accounts are refused before the breaker is consulted
+	_, err = db.Balance(NoAccount)
+	wantError(t, err, ErrInvalidAccount)
+}
@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+)
+
+// ChallengeResponse returns the response to the login challenge `nonce' for
+// an account with `pin': HMAC-SHA256(pin, nonce)
+func ChallengeResponse(pin string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(pin))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+const authByCardQuery = "SELECT id, pin, closed_at FROM users WHERE card_number = ?"
+
+// AuthChallenge authenticates the holder of the card `cardNumber' with their
+// response to the login challenge `nonce', see ChallengeResponse, so the PIN
+// never travels to the service
+//
+// Fails with ErrNoAccount if the card is unknown or the response is wrong,
+// and like Auth otherwise. Temporary PINs cannot be used with challenges.
+func (d DB) AuthChallenge(cardNumber string, nonce, response []byte) (acc Account, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return NoAccount, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	pin := sql.NullString{}
+	closedAt := sql.NullInt64{}
+	err = d.connection.QueryRowContext(ctx, authByCardQuery, cardNumber).Scan(&acc, &pin, &closedAt)
+	if err == sql.ErrNoRows {
+		return NoAccount, fmt.Errorf("auth: %w", ErrNoAccount)
+	}
+	if err != nil {
+		return NoAccount, internal(err, NoAccount, "failed to query account")
+	}
+
+	if !pin.Valid || !hmac.Equal(ChallengeResponse(pin.String, nonce), response) {
+		return NoAccount, fmt.Errorf("auth: %w", ErrNoAccount)
+	}
+
+	err = d.cfg.checkLogin(acc, closedAt.Valid)
+	if err != nil {
+		return NoAccount, err
+	}
+
+	return acc, nil
+}
@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/clock"
+	"github.com/lbajolet/atm_service/pkg/events"
+)
+
+// Config holds the tunables of the persistence layer
+type Config struct {
+	// Path is the path to the SQLite database
+	Path string
+
+	// MinOpeningDeposit is the minimum initial balance of new accounts
+	MinOpeningDeposit int64
+
+	// BusyAttempts is the number of times a transaction is attempted when
+	// the database is busy
+	BusyAttempts int
+	// BusyBackoff is the delay before the first retry of a transaction on a
+	// busy database, doubled on every retry
+	BusyBackoff time.Duration
+
+	// MaxWithdrawal is the maximum amount of a single withdrawal, no maximum
+	// is enforced if 0
+	MaxWithdrawal int64
+	// DailyWithdrawalLimit is the maximum total withdrawn from an account
+	// over the last 24 hours, transfers and holds included; no limit is
+	// enforced if 0
+	DailyWithdrawalLimit int64
+	// WithdrawalCooldown is the minimum time between two withdrawals from an
+	// account, transfers and holds included; no cooldown is enforced if 0
+	//
+	// These are the defaults of the accounts, which can be overridden by
+	// account with SetAccountLimits.
+	WithdrawalCooldown time.Duration
+	// BusinessHours restricts the withdrawals above its threshold to a daily
+	// window, for all accounts; disabled if its threshold is 0
+	BusinessHours BusinessHours
+
+	// TempPINLifetime is how long a temporary PIN can be used after it is
+	// issued
+	TempPINLifetime time.Duration
+
+	// HoldLifetime is how long a hold reserves funds before being released
+	// automatically, if not captured
+	HoldLifetime time.Duration
+
+	// QueryTimeout is the maximum duration of a database operation, after
+	// which it is cancelled and fails with ErrQueryTimeout; no maximum is
+	// enforced if 0
+	QueryTimeout time.Duration
+
+	// StartupTimeout is how long the service waits for the database to be
+	// ready when starting, see DB.WaitReady
+	StartupTimeout time.Duration
+
+	// BreakerThreshold is the number of consecutive database failures after
+	// which operations fail fast with ErrCircuitOpen; operations never fail
+	// fast if 0
+	BreakerThreshold int
+	// BreakerCooldown is how long operations fail fast before the database
+	// is probed again
+	BreakerCooldown time.Duration
+
+	// MinActiveBalance is the balance below which open accounts are flagged
+	// by FlagLowBalances, once they stayed below it for LowBalancePeriod;
+	// accounts are never flagged if 0
+	MinActiveBalance int64
+	// LowBalancePeriod is how long an account must stay below
+	// MinActiveBalance to be flagged
+	LowBalancePeriod time.Duration
+	// LowBalanceCheckInterval is the interval at which FlagLowBalances runs;
+	// it never runs automatically if 0
+	LowBalanceCheckInterval time.Duration
+
+	// MaintenanceInterval is the interval at which the database is vacuumed
+	// and analyzed, see DB.Maintenance; it is never done automatically if 0
+	MaintenanceInterval time.Duration
+
+	// AllowedAccounts restricts authentication to the listed accounts, e.g.
+	// to test accounts in a staging environment; all accounts are allowed
+	// if empty
+	AllowedAccounts []int
+
+	// WeakPINs are the PINs too easy to guess to be set on accounts; any
+	// PIN is accepted if empty
+	WeakPINs []string
+
+	// SimulatedLatency delays every operation of the in-memory persistence
+	// layer, to mimic the latency of a database; ignored by DB
+	SimulatedLatency time.Duration
+
+	// Events publishes the money movements once committed
+	Events events.Publisher
+
+	// Clock tells the time transactions happen at
+	Clock clock.Clock
+}
+
+// DefaultConfig returns the configuration used when none is specified
+func DefaultConfig() Config {
+	return Config{
+		Path:              "db",
+		MinOpeningDeposit: 0,
+		MaxWithdrawal:     1000,
+		BusyAttempts:      5,
+		BusyBackoff:       10 * time.Millisecond,
+		TempPINLifetime:   24 * time.Hour,
+		HoldLifetime:      15 * time.Minute,
+		QueryTimeout:      5 * time.Second,
+		StartupTimeout:    30 * time.Second,
+		BreakerThreshold:  5,
+		BreakerCooldown:   30 * time.Second,
+		LowBalancePeriod:  30 * 24 * time.Hour,
+		WeakPINs:          DefaultWeakPINs(),
+		Events:            events.Nop{},
+		Clock:             clock.System,
+	}
+}
+
+// DefaultWeakPINs returns the PINs rejected unless configured otherwise:
+// repeated digits and straight sequences
+func DefaultWeakPINs() []string {
+	pins := []string{"0123", "1234", "2345", "3456", "4567", "5678", "6789",
+		"9876", "8765", "7654", "6543", "5432", "4321", "3210"}
+	for d := '0'; d <= '9'; d++ {
+		pins = append(pins, strings.Repeat(string(d), 4))
+	}
+
+	return pins
+}
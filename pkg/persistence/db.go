@@ -3,63 +3,174 @@ package persistence
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/lbajolet/atm_service/pkg/events"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/rs/zerolog/log"
 )
 
 type DB struct {
+	cfg        Config
 	connection *sql.DB
+	breaker    *circuitBreaker
+	// maintenance holds a token while Maintenance runs
+	maintenance chan struct{}
 }
 
 // Account is the ID of the account
 type Account int
 
+// NoAccount is the invalid Account returned along with errors, which never
+// matches an account
+const NoAccount = Account(-1)
+
+// IsValid tells whether `acc' can be the ID of an account, IDs starting at 1
+func (acc Account) IsValid() bool {
+	return acc > 0
+}
+
+// checkAccount fails with ErrInvalidAccount if `acc' cannot be the ID of an
+// account, e.g. NoAccount leaking from a failed call
+func checkAccount(acc Account) error {
+	if !acc.IsValid() {
+		return fmt.Errorf("account %d: %w", acc, ErrInvalidAccount)
+	}
+
+	return nil
+}
+
 // NewDB returns the instance of the database
-func NewDB() (*DB, error) {
-	db, err := sql.Open("sqlite3", "db")
+func NewDB(cfg Config) (*DB, error) {
+	db, err := sql.Open("sqlite3", cfg.Path)
 	if err != nil {
 		return nil, err
 	}
 
 	return &DB{
+		cfg,
 		db,
+		newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown, cfg.Clock),
+		make(chan struct{}, 1),
 	}, nil
 }
 
-const auth_sql = "SELECT id FROM users WHERE pin = ?"
+// withTimeout bounds `ctx' by the configured query timeout
+func (d DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.cfg.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d.cfg.QueryTimeout)
+}
+
+const auth_sql = "SELECT id, closed_at FROM users WHERE pin = ? ORDER BY id LIMIT 1"
 
 // Auth authenticates to the database and returns the Account linked to `pin'
-func (d DB) Auth(pin string) (Account, error) {
-	stmt, err := d.connection.Prepare(auth_sql)
+//
+// `pin' is checked against the PIN of the accounts, then against their
+// temporary PINs: a temporary PIN can be used once, before it expires, and
+// `temporary' tells the caller the account holder must change their PIN.
+//
+// Closed accounts cannot authenticate, and fail with ErrAccountClosed.
+func (d DB) Auth(pin string) (acc Account, temporary bool, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return NoAccount, false, err
+	}
+	defer func() { record(err) }()
+
+	acc, err = d.auth(pin)
+	if errors.Is(err, ErrNoAccount) {
+		acc, err = d.useTempPIN(pin)
+		temporary = err == nil
+	}
 	if err != nil {
-		panic(fmt.Sprintf(
-			"failed to build prepared statement, SQL error: %s",
-			err,
-		))
+		return acc, false, err
+	}
+
+	return acc, temporary, nil
+}
+
+// CheckPIN returns the Account linked to `pin' like Auth, but without using
+// up temporary PINs, to check the PIN of an account holder again
+func (d DB) CheckPIN(pin string) (acc Account, temporary bool, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return NoAccount, false, err
+	}
+	defer func() { record(err) }()
+
+	acc, err = d.auth(pin)
+	if errors.Is(err, ErrNoAccount) {
+		ctx, cancel := d.withTimeout(context.Background())
+		defer cancel()
+
+		acc, err = d.matchTempPIN(ctx, pin)
+		temporary = err == nil
+	}
+	if err != nil {
+		return acc, false, err
+	}
+
+	return acc, temporary, nil
+}
+
+// accountAllowed tells if `acc' is part of the configured allowlist, if any
+func (cfg Config) accountAllowed(acc Account) bool {
+	if len(cfg.AllowedAccounts) == 0 {
+		return true
+	}
+
+	for _, allowed := range cfg.AllowedAccounts {
+		if Account(allowed) == acc {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d DB) auth(pin string) (Account, error) {
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	stmt, err := d.connection.PrepareContext(ctx, auth_sql)
+	if err != nil {
+		return NoAccount, internal(err, NoAccount, "failed to prepare account query")
 	}
 
 	defer stmt.Close()
 
-	acc := Account(-1)
+	acc := NoAccount
 
-	res, err := stmt.Query(pin)
+	res, err := stmt.QueryContext(ctx, pin)
 	if err != nil {
-		log.Error().Err(err).Msg("query failed")
-		return acc, err
+		return acc, internal(err, acc, "failed to query account")
 	}
 
 	if !res.Next() {
-		return acc, fmt.Errorf("no such account")
+		res.Close()
+		if err := res.Err(); err != nil {
+			return acc, internal(err, acc, "failed to query account")
+		}
+		return acc, fmt.Errorf("auth: %w", ErrNoAccount)
 	}
 
-	err = res.Scan(&acc)
+	closedAt := sql.NullInt64{}
+	err = res.Scan(&acc, &closedAt)
+	res.Close()
 	if err != nil {
-		log.Error().Err(err).Msg("scan failed")
-		return acc, err
+		return NoAccount, internal(err, NoAccount, "failed to read account")
+	}
+
+	err = d.cfg.checkLogin(acc, closedAt.Valid)
+	if err != nil {
+		return NoAccount, err
 	}
-	res.Close()
 
 	return acc, nil
 }
@@ -67,37 +178,153 @@ func (d DB) Auth(pin string) (Account, error) {
 const balanceQuery = "SELECT balance FROM users WHERE id = ?"
 
 // Balance gets the current balance for the account
-func (d DB) Balance(acc Account) (int64, error) {
-	stmt, err := d.connection.Prepare(balanceQuery)
+//
+// Fails with ErrNoAccount if the account does not exist; the balance is only
+// meaningful when the error is nil.
+func (d DB) Balance(acc Account) (_ int64, err error) {
+	record, err := d.guardAccount(acc)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"failed to build prepared statement, SQL error: %s",
-			err,
-		))
+		return 0, err
 	}
+	defer func() { record(err) }()
 
-	defer stmt.Close()
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
 
-	res, err := stmt.Query(acc)
+	balance := int64(0)
+	err = d.connection.QueryRowContext(ctx, balanceQuery, acc).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("query failed")
-		return -1, err
+		return 0, internal(err, acc, "failed to query balance")
 	}
 
-	if !res.Next() {
-		log.Error().Msg("empty rowset")
-		return -1, fmt.Errorf("no balance available for account")
+	return balance, nil
+}
+
+const balanceManyQuery = "SELECT id, balance FROM users WHERE id IN (%s)"
+
+// BalanceMany returns the balances of several accounts in a single query
+//
+// Accounts which do not exist are absent from the result.
+func (d DB) BalanceMany(accs []Account) (_ map[Account]int64, err error) {
+	balances := map[Account]int64{}
+	if len(accs) == 0 {
+		return balances, nil
 	}
 
-	balance := int64(-1)
-	err = res.Scan(&balance)
+	record, err := d.guard()
 	if err != nil {
-		log.Error().Err(err).Msg("scan failed")
-		return -1, err
+		return nil, err
 	}
-	res.Close()
+	defer func() { record(err) }()
 
-	return balance, nil
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	args := make([]interface{}, len(accs))
+	for i, acc := range accs {
+		args[i] = acc
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(accs)), ",")
+
+	rows, err := d.connection.QueryContext(ctx, fmt.Sprintf(balanceManyQuery, placeholders), args...)
+	if err != nil {
+		return nil, internal(err, NoAccount, "failed to query balances")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		acc := NoAccount
+		balance := int64(0)
+		err = rows.Scan(&acc, &balance)
+		if err != nil {
+			return nil, internal(err, NoAccount, "failed to read balance")
+		}
+		balances[acc] = balance
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internal(err, NoAccount, "failed to query balances")
+	}
+
+	return balances, nil
+}
+
+const balanceAsOfQuery = "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user = ? AND created_at <= ?"
+
+// BalanceAsOf computes the balance of the account at time `at', by replaying
+// its transactions up to then
+//
+// Fails with a HistoryPurgedError if the transactions up to `at' were purged.
+func (d DB) BalanceAsOf(acc Account, at time.Time) (_ int64, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return 0, err
+	}
+
+	opening, asOf, err := openingBalance(ctx, d.connection, acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkHistory(acc, at, asOf)
+	if err != nil {
+		return 0, err
+	}
+
+	balance := int64(0)
+	err = d.connection.QueryRowContext(ctx, balanceAsOfQuery, acc, at.Unix()).Scan(&balance)
+	if err != nil {
+		return 0, internal(err, acc, "failed to compute balance")
+	}
+
+	return opening + balance, nil
+}
+
+// AccountStats are aggregates over the transactions of an account
+type AccountStats struct {
+	TransactionCount int64
+	// LastActivity is the time of the latest transaction, zero if the
+	// account has no transactions
+	LastActivity time.Time
+}
+
+const accountStatsQuery = "SELECT COUNT(*), MAX(created_at) FROM transactions WHERE user = ?"
+
+// AccountStats computes the transaction count and last activity of the account
+func (d DB) AccountStats(acc Account) (_ AccountStats, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return AccountStats{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	stats := AccountStats{}
+	lastActivity := sql.NullInt64{}
+
+	err = d.connection.QueryRowContext(ctx, accountStatsQuery, acc).Scan(&stats.TransactionCount, &lastActivity)
+	if err != nil {
+		return stats, internal(err, acc, "failed to get account stats")
+	}
+
+	if lastActivity.Valid {
+		stats.LastActivity = time.Unix(lastActivity.Int64, 0).UTC()
+	}
+
+	return stats, nil
 }
 
 // TransactionType determines how the funds of an account will change
@@ -107,73 +334,439 @@ const (
 	// Error is the default value of the Transaction type
 	//
 	// It is only defined so the default value for a Transaction will not
-	// provoke misbehaviours
+	// provoke misbehaviours: transactions of this type are rejected with
+	// ErrInvalidTransaction
 	Error TransactionType = iota
 	// Deposit increases the amount of cash of an account
 	Deposit
 	// Withdrawal decreases the amount of cash on an account
 	Withdrawal
+	// Adjustment corrects the balance of an account, e.g. after a failed
+	// settlement; its amount is signed, and it requires a reason
+	Adjustment
+	// transfer is the type recorded for the movements of transfers between
+	// accounts, and of the payout of closed accounts, so they can be told
+	// apart from deposits and withdrawals; they are reported as such
+	// depending on their direction
+	transfer
 )
 
+func (t TransactionType) String() string {
+	switch t {
+	case Deposit:
+		return "deposit"
+	case Withdrawal:
+		return "withdrawal"
+	case Adjustment:
+		return "adjustment"
+	}
+
+	return "error"
+}
+
 // Transaction is a financial movement for an account
 type Transaction struct {
 	Type   TransactionType
 	Amount int64
+	// Category is a free-form label of the transaction for reporting, of at
+	// most MaxCategoryLength bytes; the transaction is uncategorized if empty
+	Category string
+	// Reason is why an Adjustment was made, of at most MaxReasonLength
+	// bytes; it is required for adjustments, and ignored otherwise
+	Reason string
+}
+
+// MaxReasonLength is the maximum length of the reason of an adjustment
+const MaxReasonLength = 255
+
+// check validates the type, amount, category and reason of `tx'
+//
+// The amount of adjustments is signed, but not zero; the amount of other
+// transactions is positive.
+func (tx Transaction) check() error {
+	_, err := tx.getAmount()
+	if err != nil {
+		return err
+	}
+
+	amount := tx.Amount
+	if tx.Type == Adjustment && amount < 0 {
+		amount = -amount
+	}
+
+	err = checkAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	err = checkCategory(tx.Category)
+	if err != nil {
+		return err
+	}
+
+	if tx.Type == Adjustment {
+		if strings.TrimSpace(tx.Reason) == "" {
+			return fmt.Errorf("adjustment without reason: %w", ErrInvalidTransaction)
+		}
+		if len(tx.Reason) > MaxReasonLength {
+			return fmt.Errorf("adjustment reason of %d bytes: %w", len(tx.Reason), ErrInvalidTransaction)
+		}
+	}
+
+	return nil
 }
 
-func (tx Transaction) getAmount() int64 {
+// MaxCategoryLength is the maximum length of the category of a transaction
+const MaxCategoryLength = 32
+
+// checkCategory validates the category of a transaction
+func checkCategory(category string) error {
+	if len(category) > MaxCategoryLength {
+		return fmt.Errorf("category of %d bytes: %w", len(category), ErrInvalidCategory)
+	}
+
+	for _, r := range category {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("category %q: %w", category, ErrInvalidCategory)
+		}
+	}
+
+	return nil
+}
+
+// nullCategory returns the value stored for `category', NULL for
+// uncategorized transactions
+func nullCategory(category string) sql.NullString {
+	return sql.NullString{
+		String: category,
+		Valid:  category != "",
+	}
+}
+
+// getAmount returns the signed amount `tx' changes the balance by
+//
+// Fails with ErrInvalidTransaction if the type of `tx' is unknown, e.g. for
+// the zero value of Transaction.
+func (tx Transaction) getAmount() (int64, error) {
 	switch tx.Type {
 	case Deposit:
-		return tx.Amount
+		return tx.Amount, nil
 	case Withdrawal:
-		return -tx.Amount
+		return -tx.Amount, nil
+	case Adjustment:
+		return tx.Amount, nil
 	}
 
-	panic("invalid transaction type")
+	return 0, fmt.Errorf("transaction type %d: %w", tx.Type, ErrInvalidTransaction)
 }
 
 const balanceUpdateQuery = "UPDATE users SET balance = (SELECT balance FROM users WHERE id = ?) + ? WHERE id = ?"
 
-const transactionInsertQuery = "INSERT INTO transactions(amount, user) VALUES(?, ?)"
+const transactionInsertQuery = "INSERT INTO transactions(type, amount, user, created_at, category) VALUES(?, ?, ?, ?, ?)"
+
+const adjustmentInsertQuery = "INSERT INTO adjustments(transaction_id, reason) VALUES(?, ?)"
+
+// DoTransaction applies `tx' to the balance of `acc' and records it, and
+// returns the ID of the recorded transaction
+//
+// Withdrawals that would make the balance negative, or dip into held funds,
+// fail with ErrInsufficientFunds.
+//
+// If the database is busy, the transaction is retried with an exponential
+// backoff, until the configured number of attempts is exhausted (ErrBusy) or
+// `ctx' is done.
+func (d DB) DoTransaction(ctx context.Context, acc Account, tx Transaction) (id int64, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return -1, err
+	}
+	defer func() { record(err) }()
+
+	err = d.retryBusy(ctx, func() error {
+		var err error
+		id, err = d.doTransaction(ctx, acc, tx)
+		return err
+	})
+
+	return id, err
+}
+
+func (d DB) doTransaction(ctx context.Context, acc Account, tx Transaction) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return -1, internal(err, acc, "failed to build DB transaction")
+	}
+
+	id, moved, err := d.applyTransaction(ctx, dbTx, acc, tx)
+	if err != nil {
+		dbTx.Rollback()
+		return -1, err
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return -1, internal(err, acc, "failed to commit transaction")
+	}
+
+	d.Publish([]events.Transaction{moved})
+	return id, nil
+}
+
+// BeginTx starts a database transaction, in which several operations can be
+// composed with DoTransactionTx and committed at once
+func (d DB) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return nil, internal(err, NoAccount, "failed to build DB transaction")
+	}
+
+	return dbTx, nil
+}
+
+// DoTransactionTx applies `tx' to the balance of `acc' and records it within
+// `dbTx', started with BeginTx, with the same checks as DoTransaction
+//
+// The caller commits or rolls back `dbTx', and is responsible for publishing
+// the returned event with Publish once committed. Busy databases are not
+// retried, since only the caller can replay the whole transaction.
+func (d DB) DoTransactionTx(ctx context.Context, dbTx *sql.Tx, acc Account, tx Transaction) (id int64, moved events.Transaction, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return -1, events.Transaction{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	return d.applyTransaction(ctx, dbTx, acc, tx)
+}
+
+// applyTransaction applies `tx' to the balance of `acc' and records it
+// within `dbTx', and returns the ID and the event of the recorded transaction
+func (d DB) applyTransaction(ctx context.Context, dbTx *sql.Tx, acc Account, tx Transaction) (int64, events.Transaction, error) {
+	err := tx.check()
+	if err != nil {
+		return -1, events.Transaction{}, err
+	}
+
+	amount, err := tx.getAmount()
+	if err != nil {
+		return -1, events.Transaction{}, err
+	}
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		return -1, events.Transaction{}, err
+	}
+
+	newBalance, err := addAmounts(balance, amount)
+	if err != nil {
+		return -1, events.Transaction{}, err
+	}
+
+	if newBalance < 0 {
+		return -1, events.Transaction{}, fmt.Errorf("account %d: %w", acc, ErrInsufficientFunds)
+	}
+
+	now := d.cfg.Clock.Now()
+	if tx.Type == Withdrawal {
+		state, err := d.debitState(ctx, dbTx, acc, balance)
+		if err != nil {
+			return -1, events.Transaction{}, err
+		}
+
+		err = d.cfg.checkDebit(acc, tx.Amount, state, now)
+		if err != nil {
+			return -1, events.Transaction{}, err
+		}
+	}
+
+	_, err = dbTx.ExecContext(ctx, balanceUpdateQuery, acc, amount, acc)
+	if err != nil {
+		return -1, events.Transaction{}, internal(err, acc, "failed to update balance")
+	}
+
+	res, err := dbTx.ExecContext(ctx, transactionInsertQuery, tx.Type, amount, acc, now.Unix(), nullCategory(tx.Category))
+	if err != nil {
+		return -1, events.Transaction{}, internal(err, acc, "failed to insert transaction")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, events.Transaction{}, internal(err, acc, "failed to get transaction ID")
+	}
+
+	if tx.Type == Adjustment {
+		_, err = dbTx.ExecContext(ctx, adjustmentInsertQuery, id, tx.Reason)
+		if err != nil {
+			return -1, events.Transaction{}, internal(err, acc, "failed to record adjustment")
+		}
+	}
+
+	return id, events.Transaction{
+		ID:        id,
+		Account:   int(acc),
+		Amount:    amount,
+		Category:  tx.Category,
+		CreatedAt: time.Unix(now.Unix(), 0).UTC(),
+	}, nil
+}
 
-func (d DB) DoTransaction(acc Account, tx Transaction) error {
-	dbTx, err := d.connection.BeginTx(context.Background(), &sql.TxOptions{})
+// Credit is an amount to credit to an account as part of a transfer
+type Credit struct {
+	To     Account
+	Amount int64
+}
+
+const creditQuery = "UPDATE users SET balance = balance + ? WHERE id = ?"
+
+// FanOutTransfer debits `from' once for the sum of `credits', and credits
+// every target account
+//
+// The transfer is atomic: if any credit targets a missing account, or if the
+// total exceeds the balance of `from' not held, nothing is applied. The total
+// debit is subject to the same limits as a withdrawal of that amount.
+//
+// If the database is busy, the transfer is retried like DoTransaction.
+func (d DB) FanOutTransfer(ctx context.Context, from Account, credits []Credit) (err error) {
+	record, err := d.guardAccount(from)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to build DB transaction")
 		return err
 	}
+	defer func() { record(err) }()
 
-	bup, err := dbTx.Prepare(balanceUpdateQuery)
+	total, err := checkTransfer(from, credits)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"failed to build prepared statement, SQL error: %s",
-			err,
-		))
+		return err
 	}
 
-	_, err = bup.Exec(acc, tx.getAmount(), acc)
+	return d.retryBusy(ctx, func() error {
+		return d.fanOutTransfer(ctx, from, credits, total)
+	})
+}
+
+func (d DB) fanOutTransfer(ctx context.Context, from Account, credits []Credit, total int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
-		log.Error().Err(err).Int("account_id", int(acc)).Msg("failed to update balance")
-		return dbTx.Rollback()
+		return internal(err, from, "failed to build DB transaction")
 	}
 
-	bup.Close()
+	balance, err := openAccountBalance(ctx, dbTx, from)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
 
-	txIns, err := dbTx.Prepare(transactionInsertQuery)
+	state, err := d.debitState(ctx, dbTx, from, balance)
 	if err != nil {
-		panic(fmt.Sprintf(
-			"failed to build prepared statement, SQL error: %s",
-			err,
-		))
+		dbTx.Rollback()
+		return err
 	}
 
-	_, err = txIns.Exec(acc, tx.getAmount())
+	err = d.cfg.checkDebit(from, total, state, d.cfg.Clock.Now())
 	if err != nil {
-		log.Error().Err(err).Int("account_id", int(acc)).Msg("failed to insert transaction")
-		return dbTx.Rollback()
+		dbTx.Rollback()
+		return err
 	}
 
-	txIns.Close()
+	moved := []events.Transaction{}
+	err = d.applyCredit(ctx, dbTx, from, transfer, -total, &moved)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
 
-	return dbTx.Commit()
+	for _, c := range credits {
+		toBalance, err := openAccountBalance(ctx, dbTx, c.To)
+		if err != nil {
+			dbTx.Rollback()
+			return err
+		}
+
+		_, err = addAmounts(toBalance, c.Amount)
+		if err != nil {
+			dbTx.Rollback()
+			return err
+		}
+
+		err = d.applyCredit(ctx, dbTx, c.To, transfer, c.Amount, &moved)
+		if err != nil {
+			dbTx.Rollback()
+			return err
+		}
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return internal(err, from, "failed to commit transfer")
+	}
+
+	d.Publish(moved)
+	return nil
+}
+
+// TransferEach credits every target account from `from' in a transaction of
+// its own, so a failing credit does not prevent the others from being applied
+//
+// Returns the errors of the credits in order, nil for the applied ones.
+func (d DB) TransferEach(ctx context.Context, from Account, credits []Credit) []error {
+	errs := make([]error, len(credits))
+	for i, c := range credits {
+		errs[i] = d.FanOutTransfer(ctx, from, []Credit{c})
+	}
+
+	return errs
+}
+
+// applyCredit changes the balance of `acc' by `amount' and records the
+// movement as a transaction of type `typ', within `dbTx'; the event of the
+// movement is appended to `moved', to be published once `dbTx' is committed
+func (d DB) applyCredit(ctx context.Context, dbTx *sql.Tx, acc Account, typ TransactionType, amount int64, moved *[]events.Transaction) error {
+	res, err := dbTx.ExecContext(ctx, creditQuery, amount, acc)
+	if err != nil {
+		return internal(err, acc, "failed to update balance")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return internal(err, acc, "failed to update balance")
+	}
+
+	if n == 0 {
+		return fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	now := d.cfg.Clock.Now()
+	res, err = dbTx.ExecContext(ctx, transactionInsertQuery, typ, amount, acc, now.Unix(), nil)
+	if err != nil {
+		return internal(err, acc, "failed to insert transaction")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return internal(err, acc, "failed to get transaction ID")
+	}
+
+	*moved = append(*moved, events.Transaction{
+		ID:        id,
+		Account:   int(acc),
+		Amount:    amount,
+		CreatedAt: time.Unix(now.Unix(), 0).UTC(),
+	})
+
+	return nil
+}
+
+// Publish publishes the events of the movements of a committed transaction
+func (d DB) Publish(moved []events.Transaction) {
+	for _, tx := range moved {
+		d.cfg.Events.Publish(tx)
+	}
 }
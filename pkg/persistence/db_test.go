@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock.Clock set by the tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// testConfig returns the configuration of the stores under test, on
+// `clk', without withdrawal limits
+func testConfig(clk *fakeClock) Config {
+	cfg := DefaultConfig()
+	cfg.MaxWithdrawal = 0
+	cfg.BreakerThreshold = 0
+	cfg.Clock = clk
+
+	return cfg
+}
+
+// newTestDB returns a database created by create_db.sql in a temporary
+// directory
+func newTestDB(t *testing.T, cfg Config) *DB {
+	t.Helper()
+
+	schema, err := ioutil.ReadFile(filepath.Join("..", "..", "create_db.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Path = filepath.Join(t.TempDir(), "db")
+	db, err := NewDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.connection.Close() })
+
+	_, err = db.connection.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
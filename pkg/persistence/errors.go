@@ -0,0 +1,185 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrNoAccount is returned when no account matches the request
+	ErrNoAccount = errors.New("no such account")
+	// ErrInvalidAccount is returned when operating on an account ID which
+	// cannot match any account, such as NoAccount
+	ErrInvalidAccount = errors.New("invalid account")
+	// ErrInsufficientFunds is returned when a withdrawal exceeds the balance
+	// of the account
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrInvalidTransaction is returned when a transaction is malformed, e.g.
+	// when its amount is not positive
+	ErrInvalidTransaction = errors.New("invalid transaction")
+	// ErrAccountClosed is returned when operating on a closed account
+	ErrAccountClosed = errors.New("account closed")
+	// ErrNonZeroBalance is returned when closing an account that still holds
+	// funds
+	ErrNonZeroBalance = errors.New("account balance is not zero")
+	// ErrDuplicateCard is returned when creating an account with a card number
+	// already assigned to another account
+	ErrDuplicateCard = errors.New("card number already in use")
+	// ErrBelowMinimumDeposit is returned when creating an account with an
+	// initial balance below the configured minimum
+	ErrBelowMinimumDeposit = errors.New("initial balance below minimum deposit")
+	// ErrBusy is returned when the database stayed locked by concurrent
+	// writers for all the attempts of an operation
+	ErrBusy = errors.New("database busy")
+	// ErrAmountOverflow is returned when an amount, or the balance resulting
+	// from a transaction, is too large to be represented
+	ErrAmountOverflow = errors.New("amount overflow")
+	// ErrWithdrawalTooSoon is returned when a withdrawal comes sooner than the
+	// configured cooldown after the previous one
+	ErrWithdrawalTooSoon = errors.New("withdrawal too soon after the previous one")
+	// ErrNoTransaction is returned when no transaction matches the request
+	ErrNoTransaction = errors.New("no such transaction")
+	// ErrQueryTimeout is returned when a database operation runs longer than
+	// the configured query timeout
+	ErrQueryTimeout = errors.New("database query timed out")
+	// ErrNoHold is returned when no unexpired hold matches the request
+	ErrNoHold = errors.New("no such hold")
+	// ErrCircuitOpen is returned without reaching the database after repeated
+	// database failures, until it is probed again
+	ErrCircuitOpen = errors.New("database unavailable")
+	// ErrInvalidCategory is returned when the category of a transaction is
+	// too long or not printable
+	ErrInvalidCategory = errors.New("invalid category")
+	// ErrAccountNotAllowed is returned when authenticating to an account
+	// outside of the configured allowlist
+	ErrAccountNotAllowed = errors.New("account not allowed")
+	// ErrHistoryPurged is returned when computing a balance from transactions
+	// purged by retention
+	ErrHistoryPurged = errors.New("transaction history purged")
+	// ErrWeakPIN is returned when setting a PIN of the configured list of
+	// weak PINs
+	ErrWeakPIN = errors.New("PIN too weak")
+	// ErrAboveMaxWithdrawal is returned when a withdrawal exceeds the maximum
+	// withdrawal of the account
+	ErrAboveMaxWithdrawal = errors.New("amount above maximum withdrawal")
+	// ErrDailyLimitExceeded is returned when a withdrawal would take the
+	// withdrawals of the account over the last 24 hours above its daily limit
+	ErrDailyLimitExceeded = errors.New("daily withdrawal limit exceeded")
+	// ErrOutsideBusinessHours is returned when a withdrawal above the
+	// threshold of the business hours is made outside of them
+	ErrOutsideBusinessHours = errors.New("withdrawal outside business hours")
+	// ErrInvalidLimits is returned when setting negative limits on an account
+	ErrInvalidLimits = errors.New("invalid limits")
+	// ErrNoTempPINAvailable is returned when no temporary PIN unused by
+	// other accounts could be generated
+	ErrNoTempPINAvailable = errors.New("no temporary PIN available")
+	// ErrPINInUse is returned when setting a PIN which already authenticates
+	// to an account, as logins are matched by PIN
+	ErrPINInUse = errors.New("PIN already in use")
+	// ErrInvalidAuditEntry is returned when recording an audit entry without
+	// an action, or with one too long
+	ErrInvalidAuditEntry = errors.New("invalid audit entry")
+)
+
+// WithdrawalTooSoonError is returned when a withdrawal is attempted during the
+// cooldown following the previous one
+//
+// It matches ErrWithdrawalTooSoon with errors.Is.
+type WithdrawalTooSoonError struct {
+	// RetryAfter is the remaining time before the account can withdraw again
+	RetryAfter time.Duration
+}
+
+func (e *WithdrawalTooSoonError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrWithdrawalTooSoon, e.RetryAfter)
+}
+
+func (e *WithdrawalTooSoonError) Is(target error) bool {
+	return target == ErrWithdrawalTooSoon
+}
+
+// HistoryPurgedError is returned when computing a balance at a time whose
+// transactions were purged by retention
+//
+// It matches ErrHistoryPurged with errors.Is.
+type HistoryPurgedError struct {
+	// Before is the time before which the transactions were purged
+	Before time.Time
+}
+
+func (e *HistoryPurgedError) Error() string {
+	return fmt.Sprintf("%s before %s", ErrHistoryPurged, e.Before.Format(time.RFC3339))
+}
+
+func (e *HistoryPurgedError) Is(target error) bool {
+	return target == ErrHistoryPurged
+}
+
+// ErrInternal is returned in place of the errors of the database driver, so
+// their details (SQL fragments, table names) do not leak to callers
+var ErrInternal = errors.New("internal database error")
+
+// internalError is a sanitized database error
+//
+// Its message only describes the failed operation; the driver error is kept as
+// its cause so the persistence layer can still inspect it (e.g. to retry
+// transactions on a busy database).
+type internalError struct {
+	op    string
+	cause error
+}
+
+func (e *internalError) Error() string {
+	return e.op + ": " + ErrInternal.Error()
+}
+
+func (e *internalError) Is(target error) bool {
+	return target == ErrInternal
+}
+
+func (e *internalError) Unwrap() error {
+	return e.cause
+}
+
+// internal logs the full details of the driver error `err', and returns a
+// sanitized error describing the failed operation `op'
+//
+// `acc' is logged along with the error unless negative. Operations cancelled
+// by the query timeout fail with ErrQueryTimeout instead, and those cancelled
+// by the caller with context.Canceled.
+func internal(err error, acc Account, op string) error {
+	if errors.Is(err, context.Canceled) {
+		evt := log.Debug().Err(err)
+		if acc.IsValid() {
+			evt = evt.Int("account_id", int(acc))
+		}
+		evt.Msg(op)
+
+		return fmt.Errorf("%s: %w", op, context.Canceled)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		evt := log.Warn().Err(err)
+		if acc.IsValid() {
+			evt = evt.Int("account_id", int(acc))
+		}
+		evt.Msg(op)
+
+		return fmt.Errorf("%s: %w", op, ErrQueryTimeout)
+	}
+
+	evt := log.Error().Err(err)
+	if acc.IsValid() {
+		evt = evt.Int("account_id", int(acc))
+	}
+	evt.Msg(op)
+
+	return &internalError{
+		op:    op,
+		cause: err,
+	}
+}
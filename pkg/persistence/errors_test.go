@@ -0,0 +1,100 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorsMatchSentinels(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 100)
+		closed := createAccount(t, s, "8264", 0)
+		err := s.CloseAccount(closed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name string
+			op   func() error
+			want error
+		}{
+			{"unknown account", func() error {
+				_, err := s.Balance(acc + 100)
+				return err
+			}, ErrNoAccount},
+			{"invalid account", func() error {
+				_, err := s.Balance(NoAccount)
+				return err
+			}, ErrInvalidAccount},
+			{"insufficient funds", func() error {
+				return withdraw(s, acc, 200)
+			}, ErrInsufficientFunds},
+			{"zero amount", func() error {
+				return withdraw(s, acc, 0)
+			}, ErrInvalidTransaction},
+			{"amount overflow", func() error {
+				_, err := s.DoTransaction(context.Background(), acc, Transaction{Type: Deposit, Amount: MaxAmount + 1})
+				return err
+			}, ErrAmountOverflow},
+			{"closed account", func() error {
+				_, err := s.DoTransaction(context.Background(), closed, Transaction{Type: Deposit, Amount: 10})
+				return err
+			}, ErrAccountClosed},
+			{"non-zero balance", func() error {
+				return s.CloseAccount(acc)
+			}, ErrNonZeroBalance},
+			{"duplicate card", func() error {
+				_, _, err := s.CreateAccount("7391", "4970104623000000", "", 0)
+				return err
+			}, ErrDuplicateCard},
+			{"weak PIN", func() error {
+				return s.ChangePIN(acc, "1111")
+			}, ErrWeakPIN},
+			{"PIN in use", func() error {
+				return s.ChangePIN(acc, "8264")
+			}, ErrPINInUse},
+			{"unknown transaction", func() error {
+				_, err := s.GetTransaction(1000)
+				return err
+			}, ErrNoTransaction},
+			{"unknown hold", func() error {
+				return s.CaptureHold(context.Background(), acc, 1000)
+			}, ErrNoHold},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				wantError(t, test.op(), test.want)
+			})
+		}
+	})
+}
+
+func TestWithdrawalTooSoonErrorIs(t *testing.T) {
+	err := error(&WithdrawalTooSoonError{RetryAfter: 10})
+	wantError(t, err, ErrWithdrawalTooSoon)
+
+	var tooSoon *WithdrawalTooSoonError
+	if !errors.As(err, &tooSoon) || tooSoon.RetryAfter != 10 {
+		t.Errorf("errors.As(%v) = %v", err, tooSoon)
+	}
+}
+
+func TestInternalErrorIsSanitized(t *testing.T) {
+	cause := errors.New(`near "FROM": syntax error`)
+	err := internal(cause, 1, "reading balance")
+
+	wantError(t, err, ErrInternal)
+	if !errors.Is(err, cause) {
+		t.Errorf("error %v does not wrap its cause", err)
+	}
+	if strings.Contains(err.Error(), "FROM") {
+		t.Errorf("error %q leaks the driver error", err)
+	}
+
+	wantError(t, internal(context.DeadlineExceeded, 1, "reading balance"), ErrQueryTimeout)
+	wantError(t, internal(context.Canceled, 1, "reading balance"), context.Canceled)
+}
@@ -0,0 +1,139 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Ping checks that the database can be reached
+func (d DB) Ping() (err error) {
+	record, err := d.guard()
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	err = d.connection.PingContext(ctx)
+	if err != nil {
+		return internal(err, NoAccount, "failed to ping database")
+	}
+
+	return nil
+}
+
+// Health is a detailed report of the state of the database
+type Health struct {
+	// OpenConnections is the number of connections to the database, in use
+	// or idle
+	OpenConnections int
+	InUse           int
+	Idle            int
+	// WaitCount is the number of times an operation waited for a
+	// connection, for a total of WaitDuration
+	WaitCount    int64
+	WaitDuration time.Duration
+
+	// LastSuccess is the time of the last operation which reached the
+	// database successfully, zero if none did yet
+	LastSuccess time.Time
+
+	// SchemaVersion is the user_version of the database, set by
+	// create_db.sql
+	SchemaVersion int
+}
+
+const schemaVersionQuery = "PRAGMA user_version"
+
+// HealthDetailed checks that the database can be reached, and reports the
+// state of its connection pool and schema
+func (d DB) HealthDetailed() (_ Health, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return Health{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	health := Health{}
+	err = d.connection.QueryRowContext(ctx, schemaVersionQuery).Scan(&health.SchemaVersion)
+	if err != nil {
+		return Health{}, internal(err, NoAccount, "failed to get schema version")
+	}
+
+	stats := d.connection.Stats()
+	health.OpenConnections = stats.OpenConnections
+	health.InUse = stats.InUse
+	health.Idle = stats.Idle
+	health.WaitCount = stats.WaitCount
+	health.WaitDuration = stats.WaitDuration
+	health.LastSuccess = d.breaker.lastSucceeded()
+
+	return health, nil
+}
+
+// ErrNotReady is returned when the database is still not ready once the
+// startup timeout elapses
+var ErrNotReady = errors.New("database not ready")
+
+// maxReadyBackoff bounds the delay between two checks of WaitReady
+const maxReadyBackoff = 5 * time.Second
+
+// WaitReady waits for the database to be ready to serve, with its schema
+// created, checking it with an exponential backoff starting at BusyBackoff
+//
+// It fails with ErrNotReady, wrapping the error of the last check, if the
+// database is not ready when `ctx' is done. Checks bypass the circuit
+// breaker, so a database slow to come up does not trip it.
+func (d DB) WaitReady(ctx context.Context) error {
+	backoff := d.cfg.BusyBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := d.checkReady(ctx)
+		if err == nil {
+			return nil
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("database not ready, retrying")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w after %d attempts: %v", ErrNotReady, attempt, err)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxReadyBackoff {
+			backoff = maxReadyBackoff
+		}
+	}
+}
+
+// checkReady checks that the database can be reached, and that its schema
+// was created by create_db.sql
+func (d DB) checkReady(ctx context.Context) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	version := 0
+	err := d.connection.QueryRowContext(ctx, schemaVersionQuery).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return errors.New("schema not created")
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/events"
+)
+
+// Hold is an amount reserved on an account for a withdrawal to be captured
+// later
+//
+// Held funds cannot be withdrawn or transferred until the hold is captured,
+// released, or expires.
+type Hold struct {
+	ID        int64
+	Account   Account
+	Amount    int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+const heldAmountQuery = "SELECT COALESCE(SUM(amount), 0) FROM holds WHERE user = ? AND expires_at > ?"
+
+// heldAmount returns the total of the unexpired holds on `acc' within `dbTx'
+func (d DB) heldAmount(ctx context.Context, dbTx *sql.Tx, acc Account) (int64, error) {
+	held := int64(0)
+	err := dbTx.QueryRowContext(ctx, heldAmountQuery, acc, d.cfg.Clock.Now().Unix()).Scan(&held)
+	if err != nil {
+		return -1, internal(err, acc, "failed to get held amount")
+	}
+
+	return held, nil
+}
+
+// AvailableBalance returns the balance of the open account `acc' which is not
+// held, and can be withdrawn or transferred
+func (d DB) AvailableBalance(acc Account) (_ int64, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, internal(err, acc, "failed to build DB transaction")
+	}
+	defer dbTx.Rollback()
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		return 0, err
+	}
+
+	held, err := d.heldAmount(ctx, dbTx, acc)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance - held, nil
+}
+
+const expiredHoldsDeleteQuery = "DELETE FROM holds WHERE expires_at <= ?"
+
+const holdInsertQuery = "INSERT INTO holds(amount, user, created_at, expires_at) VALUES(?, ?, ?, ?)"
+
+// PlaceHold reserves `amount' on `acc' until the hold is captured or
+// released, or until the configured hold lifetime elapses
+//
+// Holds are subject to the same checks as withdrawals: they fail with
+// ErrInsufficientFunds if the amount exceeds the balance not already held,
+// and with ErrWithdrawalTooSoon during the withdrawal cooldown.
+func (d DB) PlaceHold(ctx context.Context, acc Account, amount int64) (_ Hold, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer func() { record(err) }()
+
+	hold := Hold{}
+	err = d.retryBusy(ctx, func() error {
+		var err error
+		hold, err = d.placeHold(ctx, acc, amount)
+		return err
+	})
+
+	return hold, err
+}
+
+func (d DB) placeHold(ctx context.Context, acc Account, amount int64) (Hold, error) {
+	err := checkAmount(amount)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return Hold{}, internal(err, acc, "failed to build DB transaction")
+	}
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, err
+	}
+
+	state, err := d.debitState(ctx, dbTx, acc, balance)
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, err
+	}
+
+	now := d.cfg.Clock.Now()
+	err = d.cfg.checkDebit(acc, amount, state, now)
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, err
+	}
+
+	_, err = dbTx.ExecContext(ctx, expiredHoldsDeleteQuery, now.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, internal(err, acc, "failed to delete expired holds")
+	}
+
+	hold := Hold{
+		Account:   acc,
+		Amount:    amount,
+		CreatedAt: time.Unix(now.Unix(), 0).UTC(),
+		ExpiresAt: expiryAfter(now, d.cfg.HoldLifetime),
+	}
+
+	res, err := dbTx.ExecContext(ctx, holdInsertQuery, amount, acc, hold.CreatedAt.Unix(), hold.ExpiresAt.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, internal(err, acc, "failed to insert hold")
+	}
+
+	hold.ID, err = res.LastInsertId()
+	if err != nil {
+		dbTx.Rollback()
+		return Hold{}, internal(err, acc, "failed to get hold ID")
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return Hold{}, internal(err, acc, "failed to commit hold")
+	}
+
+	return hold, nil
+}
+
+const holdQuery = "SELECT amount FROM holds WHERE id = ? AND user = ? AND expires_at > ?"
+
+const holdDeleteQuery = "DELETE FROM holds WHERE id = ? AND user = ? AND expires_at > ?"
+
+// CaptureHold settles the hold `id' of `acc', recording the withdrawal of
+// its amount
+//
+// Fails with ErrNoHold if the account has no such unexpired hold.
+func (d DB) CaptureHold(ctx context.Context, acc Account, id int64) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	return d.retryBusy(ctx, func() error {
+		return d.captureHold(ctx, acc, id)
+	})
+}
+
+func (d DB) captureHold(ctx context.Context, acc Account, id int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return internal(err, acc, "failed to build DB transaction")
+	}
+
+	now := d.cfg.Clock.Now().Unix()
+
+	amount := int64(0)
+	err = dbTx.QueryRowContext(ctx, holdQuery, id, acc, now).Scan(&amount)
+	if err == sql.ErrNoRows {
+		dbTx.Rollback()
+		return fmt.Errorf("hold %d: %w", id, ErrNoHold)
+	}
+	if err != nil {
+		dbTx.Rollback()
+		return internal(err, acc, "failed to get hold")
+	}
+
+	_, err = dbTx.ExecContext(ctx, holdDeleteQuery, id, acc, now)
+	if err != nil {
+		dbTx.Rollback()
+		return internal(err, acc, "failed to delete hold")
+	}
+
+	balance, err := openAccountBalance(ctx, dbTx, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	if balance < amount {
+		dbTx.Rollback()
+		return fmt.Errorf("account %d: %w", acc, ErrInsufficientFunds)
+	}
+
+	moved := []events.Transaction{}
+	err = d.applyCredit(ctx, dbTx, acc, Withdrawal, -amount, &moved)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return internal(err, acc, "failed to commit hold capture")
+	}
+
+	d.Publish(moved)
+	return nil
+}
+
+// ReleaseHold cancels the hold `id' of `acc', making its amount available
+// again
+//
+// Fails with ErrNoHold if the account has no such unexpired hold.
+func (d DB) ReleaseHold(ctx context.Context, acc Account, id int64) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	return d.retryBusy(ctx, func() error {
+		return d.releaseHold(ctx, acc, id)
+	})
+}
+
+func (d DB) releaseHold(ctx context.Context, acc Account, id int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	res, err := d.connection.ExecContext(ctx, holdDeleteQuery, id, acc, d.cfg.Clock.Now().Unix())
+	if err != nil {
+		return internal(err, acc, "failed to release hold")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return internal(err, acc, "failed to release hold")
+	}
+
+	if n == 0 {
+		return fmt.Errorf("hold %d: %w", id, ErrNoHold)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+)
+
+// wantAvailable fails the test unless `acc' has `want' for balance not held
+func wantAvailable(t *testing.T, s testStore, acc Account, want int64) {
+	t.Helper()
+
+	available, err := s.AvailableBalance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available != want {
+		t.Errorf("available balance of account %d = %d, want %d", acc, available, want)
+	}
+}
+
+func TestCaptureHold(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		ctx := context.Background()
+		acc := createAccount(t, s, "4623", 500)
+
+		hold, err := s.PlaceHold(ctx, acc, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hold.ExpiresAt.Equal(clk.now.Add(testConfig(clk).HoldLifetime)) {
+			t.Errorf("hold expires at %s", hold.ExpiresAt)
+		}
+
+		wantBalance(t, s, acc, 500)
+		wantAvailable(t, s, acc, 300)
+
+		err = withdraw(s, acc, 400)
+		wantError(t, err, ErrInsufficientFunds)
+
+		_, err = s.PlaceHold(ctx, acc, 400)
+		wantError(t, err, ErrInsufficientFunds)
+
+		err = s.CaptureHold(ctx, acc, hold.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, acc, 300)
+		wantAvailable(t, s, acc, 300)
+
+		err = s.CaptureHold(ctx, acc, hold.ID)
+		wantError(t, err, ErrNoHold)
+	})
+}
+
+func TestReleaseHold(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		ctx := context.Background()
+		acc := createAccount(t, s, "4623", 500)
+		other := createAccount(t, s, "5082", 500)
+
+		hold, err := s.PlaceHold(ctx, acc, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.ReleaseHold(ctx, other, hold.ID)
+		wantError(t, err, ErrNoHold)
+
+		err = s.ReleaseHold(ctx, acc, hold.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, acc, 500)
+		wantAvailable(t, s, acc, 500)
+
+		err = s.CaptureHold(ctx, acc, hold.ID)
+		wantError(t, err, ErrNoHold)
+	})
+}
+
+func TestHoldExpires(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		ctx := context.Background()
+		acc := createAccount(t, s, "4623", 500)
+
+		hold, err := s.PlaceHold(ctx, acc, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clk.advance(testConfig(clk).HoldLifetime)
+
+		wantAvailable(t, s, acc, 500)
+
+		err = s.CaptureHold(ctx, acc, hold.ID)
+		wantError(t, err, ErrNoHold)
+
+		wantBalance(t, s, acc, 500)
+	})
+}
@@ -0,0 +1,95 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BusinessHours restricts the withdrawals above a threshold to a daily
+// window, e.g. from 09:00 to 17:00 in the time zone of the ATM
+type BusinessHours struct {
+	// Open and Close are the times of day the window opens and closes at,
+	// as offsets from midnight; the window spans midnight if Close is
+	// before Open
+	Open, Close time.Duration
+	// Location is the time zone of the window, UTC if nil
+	Location *time.Location
+	// Threshold is the amount above which withdrawals are only allowed
+	// within the window; no withdrawal is restricted if 0
+	Threshold int64
+}
+
+// ParseBusinessHours parses a window of business hours given as
+// "HH:MM-HH:MM", in the time zone named `timezone', e.g. "Europe/Paris"
+func ParseBusinessHours(window, timezone string, threshold int64) (BusinessHours, error) {
+	bounds := strings.SplitN(window, "-", 2)
+	if len(bounds) != 2 {
+		return BusinessHours{}, fmt.Errorf("business hours %q: expected HH:MM-HH:MM", window)
+	}
+
+	openAt, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return BusinessHours{}, fmt.Errorf("business hours %q: %w", window, err)
+	}
+
+	closeAt, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return BusinessHours{}, fmt.Errorf("business hours %q: %w", window, err)
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return BusinessHours{}, fmt.Errorf("business hours time zone: %w", err)
+	}
+
+	return BusinessHours{
+		Open:      openAt,
+		Close:     closeAt,
+		Location:  location,
+		Threshold: threshold,
+	}, nil
+}
+
+// parseTimeOfDay parses a time of day given as "HH:MM" as an offset from
+// midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// allows tells whether withdrawing `amount' is allowed at `now'
+func (b BusinessHours) allows(amount int64, now time.Time) bool {
+	if b.Threshold <= 0 || amount <= b.Threshold {
+		return true
+	}
+
+	location := b.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	local := now.In(location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+
+	if b.Open <= b.Close {
+		return offset >= b.Open && offset < b.Close
+	}
+
+	return offset >= b.Open || offset < b.Close
+}
+
+// checkBusinessHours fails with ErrOutsideBusinessHours if withdrawing
+// `amount' from `acc' at `now' is restricted to business hours
+func (cfg Config) checkBusinessHours(acc Account, amount int64, now time.Time) error {
+	if !cfg.BusinessHours.allows(amount, now) {
+		return fmt.Errorf("account %d: %w", acc, ErrOutsideBusinessHours)
+	}
+
+	return nil
+}
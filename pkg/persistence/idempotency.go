@@ -0,0 +1,133 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// IdempotentResponse is the response to a request made with an idempotency
+// key, replayed when the request is retried with the same key
+type IdempotentResponse struct {
+	// Fingerprint identifies the request the response was made to, so a key
+	// reused for another request can be told apart from a retry
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// Pending tells whether the response is a reservation of the key by a
+// request still being processed, rather than a recorded response
+func (resp IdempotentResponse) Pending() bool {
+	return resp.Status == 0
+}
+
+const expiredIdempotencyKeyDeleteQuery = "DELETE FROM idempotency_keys WHERE key = ? AND expires_at <= ?"
+
+const idempotencyKeyReserveQuery = "INSERT OR IGNORE INTO idempotency_keys(key, fingerprint, status, expires_at) VALUES(?, ?, 0, ?)"
+
+const idempotentResponseQuery = "SELECT fingerprint, status, content_type, body, expires_at FROM idempotency_keys WHERE key = ?"
+
+// ReserveIdempotencyKey reserves `key' for the request identified by
+// `fingerprint' until `expiresAt', unless it is already reserved or has an
+// unexpired response, which is returned with `reserved' false
+//
+// Reservations are atomic, so of concurrent requests with the same key only
+// one gets to process it; the others get its pending reservation.
+func (d DB) ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time) (resp IdempotentResponse, reserved bool, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = d.connection.ExecContext(ctx, expiredIdempotencyKeyDeleteQuery, key, d.cfg.Clock.Now().Unix())
+	if err != nil {
+		return IdempotentResponse{}, false, internal(err, NoAccount, "failed to delete expired idempotency key")
+	}
+
+	res, err := d.connection.ExecContext(ctx, idempotencyKeyReserveQuery, key, fingerprint, expiresAt.Unix())
+	if err != nil {
+		return IdempotentResponse{}, false, internal(err, NoAccount, "failed to reserve idempotency key")
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return IdempotentResponse{}, false, internal(err, NoAccount, "failed to reserve idempotency key")
+	}
+	if inserted == 1 {
+		return IdempotentResponse{}, true, nil
+	}
+
+	expires := int64(0)
+	err = d.connection.QueryRowContext(ctx, idempotentResponseQuery, key).
+		Scan(&resp.Fingerprint, &resp.Status, &resp.ContentType, &resp.Body, &expires)
+	if err == sql.ErrNoRows {
+		// Released since it could not be reserved: report it as pending, the
+		// client retrying later
+		return IdempotentResponse{Fingerprint: fingerprint}, false, nil
+	}
+	if err != nil {
+		return IdempotentResponse{}, false, internal(err, NoAccount, "failed to get idempotent response")
+	}
+
+	resp.ExpiresAt = time.Unix(expires, 0).UTC()
+	return resp, false, nil
+}
+
+const idempotencyKeyReleaseQuery = "DELETE FROM idempotency_keys WHERE key = ? AND status = 0"
+
+// ReleaseIdempotencyKey drops the reservation of `key', so the request can
+// be retried, when it ended without a response to replay
+func (d DB) ReleaseIdempotencyKey(key string) (err error) {
+	record, err := d.guard()
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = d.connection.ExecContext(ctx, idempotencyKeyReleaseQuery, key)
+	if err != nil {
+		return internal(err, NoAccount, "failed to release idempotency key")
+	}
+
+	return nil
+}
+
+const expiredIdempotencyKeysDeleteQuery = "DELETE FROM idempotency_keys WHERE expires_at <= ?"
+
+const idempotentResponseInsertQuery = "INSERT OR REPLACE INTO idempotency_keys(key, fingerprint, status, content_type, body, expires_at) VALUES(?, ?, ?, ?, ?, ?)"
+
+// StoreIdempotentResponse records `resp' for `key' until it expires, in
+// place of its reservation, and evicts the expired keys
+func (d DB) StoreIdempotentResponse(key string, resp IdempotentResponse) (err error) {
+	record, err := d.guard()
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = d.connection.ExecContext(ctx, expiredIdempotencyKeysDeleteQuery, d.cfg.Clock.Now().Unix())
+	if err != nil {
+		return internal(err, NoAccount, "failed to delete expired idempotency keys")
+	}
+
+	_, err = d.connection.ExecContext(ctx, idempotentResponseInsertQuery,
+		key, resp.Fingerprint, resp.Status, resp.ContentType, resp.Body, resp.ExpiresAt.Unix())
+	if err != nil {
+		return internal(err, NoAccount, "failed to store idempotent response")
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	db := newTestDB(t, testConfig(clk))
+	expiresAt := clk.now.Add(time.Hour)
+
+	_, reserved, err := db.ReserveIdempotencyKey("key", "withdraw 100", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Fatal("key not reserved")
+	}
+
+	resp, reserved, err := db.ReserveIdempotencyKey("key", "withdraw 100", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved || !resp.Pending() {
+		t.Fatalf("key reserved twice: %t, %+v", reserved, resp)
+	}
+
+	stored := IdempotentResponse{
+		Fingerprint: "withdraw 100",
+		Status:      201,
+		ContentType: "application/json",
+		Body:        []byte(`{"data":{}}`),
+		ExpiresAt:   expiresAt,
+	}
+	err = db.StoreIdempotentResponse("key", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stored response is not released
+	err = db.ReleaseIdempotencyKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, reserved, err = db.ReserveIdempotencyKey("key", "withdraw 100", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved || resp.Pending() || resp.Status != 201 || string(resp.Body) != string(stored.Body) {
+		t.Fatalf("stored response not replayed: %t, %+v", reserved, resp)
+	}
+
+	clk.advance(time.Hour)
+
+	_, reserved, err = db.ReserveIdempotencyKey("key", "withdraw 200", clk.now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("expired key not reserved")
+	}
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	db := newTestDB(t, testConfig(clk))
+	expiresAt := clk.now.Add(time.Hour)
+
+	_, reserved, err := db.ReserveIdempotencyKey("key", "withdraw 100", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Fatal("key not reserved")
+	}
+
+	err = db.ReleaseIdempotencyKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, reserved, err = db.ReserveIdempotencyKey("key", "withdraw 100", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("released key not reserved again")
+	}
+}
@@ -0,0 +1,287 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// dailyWindow is the period over which withdrawals count towards the daily
+// withdrawal limit, ending at the time of the withdrawal
+const dailyWindow = 24 * time.Hour
+
+// Limits are the withdrawal limits enforced on an account, 0 meaning no
+// limit
+type Limits struct {
+	// MaxWithdrawal is the maximum amount of a single withdrawal
+	MaxWithdrawal int64
+	// DailyWithdrawal is the maximum total of the withdrawals, transfers
+	// and holds over the last 24 hours
+	DailyWithdrawal int64
+	// WithdrawalCooldown is the minimum time between two withdrawals,
+	// transfers or holds
+	WithdrawalCooldown time.Duration
+}
+
+// LimitOverrides are the limits set for a specific account, nil ones falling
+// back to the configured defaults
+type LimitOverrides struct {
+	MaxWithdrawal      *int64
+	DailyWithdrawal    *int64
+	WithdrawalCooldown *time.Duration
+}
+
+// IsZero tells whether no limit is overridden
+func (o LimitOverrides) IsZero() bool {
+	return o.MaxWithdrawal == nil && o.DailyWithdrawal == nil && o.WithdrawalCooldown == nil
+}
+
+// apply returns `defaults' with the overridden limits replaced
+func (o LimitOverrides) apply(defaults Limits) Limits {
+	if o.MaxWithdrawal != nil {
+		defaults.MaxWithdrawal = *o.MaxWithdrawal
+	}
+	if o.DailyWithdrawal != nil {
+		defaults.DailyWithdrawal = *o.DailyWithdrawal
+	}
+	if o.WithdrawalCooldown != nil {
+		defaults.WithdrawalCooldown = *o.WithdrawalCooldown
+	}
+
+	return defaults
+}
+
+// check validates the overridden limits
+func (o LimitOverrides) check() error {
+	if (o.MaxWithdrawal != nil && *o.MaxWithdrawal < 0) ||
+		(o.DailyWithdrawal != nil && *o.DailyWithdrawal < 0) ||
+		(o.WithdrawalCooldown != nil && *o.WithdrawalCooldown < 0) {
+		return ErrInvalidLimits
+	}
+
+	return nil
+}
+
+// DefaultLimits returns the limits of the accounts without overrides
+func (cfg Config) DefaultLimits() Limits {
+	return Limits{
+		MaxWithdrawal:      cfg.MaxWithdrawal,
+		DailyWithdrawal:    cfg.DailyWithdrawalLimit,
+		WithdrawalCooldown: cfg.WithdrawalCooldown,
+	}
+}
+
+// checkWithdrawal fails if withdrawing `amount' from an account breaks
+// `limits', given the time of its last withdrawal and the total withdrawn and
+// held over the last 24 hours
+func (limits Limits) checkWithdrawal(acc Account, amount int64, last time.Time, withdrawn int64, now time.Time) error {
+	if limits.MaxWithdrawal > 0 && amount > limits.MaxWithdrawal {
+		return fmt.Errorf("account %d: %w", acc, ErrAboveMaxWithdrawal)
+	}
+
+	if limits.DailyWithdrawal > 0 && withdrawn+amount > limits.DailyWithdrawal {
+		return fmt.Errorf("account %d: %w", acc, ErrDailyLimitExceeded)
+	}
+
+	if limits.WithdrawalCooldown > 0 && !last.IsZero() {
+		next := last.Add(limits.WithdrawalCooldown)
+		if now.Before(next) {
+			return &WithdrawalTooSoonError{
+				RetryAfter: next.Sub(now),
+			}
+		}
+	}
+
+	return nil
+}
+
+const accountLimitsQuery = "SELECT max_withdrawal, daily_withdrawal, withdrawal_cooldown_ms FROM account_limits WHERE user = ?"
+
+// limitOverrides returns the limits set for `acc', none if it has no
+// overrides
+func limitOverrides(ctx context.Context, q querier, acc Account) (LimitOverrides, error) {
+	maxWithdrawal := sql.NullInt64{}
+	dailyWithdrawal := sql.NullInt64{}
+	cooldown := sql.NullInt64{}
+
+	err := q.QueryRowContext(ctx, accountLimitsQuery, acc).Scan(&maxWithdrawal, &dailyWithdrawal, &cooldown)
+	if err == sql.ErrNoRows {
+		return LimitOverrides{}, nil
+	}
+	if err != nil {
+		return LimitOverrides{}, internal(err, acc, "failed to get account limits")
+	}
+
+	overrides := LimitOverrides{}
+	if maxWithdrawal.Valid {
+		overrides.MaxWithdrawal = &maxWithdrawal.Int64
+	}
+	if dailyWithdrawal.Valid {
+		overrides.DailyWithdrawal = &dailyWithdrawal.Int64
+	}
+	if cooldown.Valid {
+		d := time.Duration(cooldown.Int64) * time.Millisecond
+		overrides.WithdrawalCooldown = &d
+	}
+
+	return overrides, nil
+}
+
+// AccountLimits returns the limits set for `acc', and the limits enforced on
+// it given the configured defaults
+//
+// Fails with ErrNoAccount if the account does not exist.
+func (d DB) AccountLimits(acc Account) (overrides LimitOverrides, effective Limits, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+
+	overrides, err = limitOverrides(ctx, d.connection, acc)
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+
+	return overrides, overrides.apply(d.cfg.DefaultLimits()), nil
+}
+
+// DefaultLimits returns the limits of the accounts without overrides
+func (d DB) DefaultLimits() Limits {
+	return d.cfg.DefaultLimits()
+}
+
+const accountLimitsUpsertQuery = `INSERT INTO account_limits(user, max_withdrawal, daily_withdrawal, withdrawal_cooldown_ms)
+	VALUES(?, ?, ?, ?)
+	ON CONFLICT(user) DO UPDATE SET max_withdrawal = excluded.max_withdrawal,
+		daily_withdrawal = excluded.daily_withdrawal, withdrawal_cooldown_ms = excluded.withdrawal_cooldown_ms`
+
+const accountLimitsDeleteQuery = "DELETE FROM account_limits WHERE user = ?"
+
+// SetAccountLimits replaces the limits set for `acc' with `overrides';
+// the account falls back to the defaults if none are overridden
+//
+// Fails with ErrNoAccount if the account does not exist, and with
+// ErrInvalidLimits if a limit is negative.
+func (d DB) SetAccountLimits(acc Account, overrides LimitOverrides) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	err = overrides.check()
+	if err != nil {
+		return fmt.Errorf("account %d: %w", acc, err)
+	}
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return err
+	}
+
+	if overrides.IsZero() {
+		_, err = d.connection.ExecContext(ctx, accountLimitsDeleteQuery, acc)
+		if err != nil {
+			return internal(err, acc, "failed to delete account limits")
+		}
+
+		return nil
+	}
+
+	cooldown := sql.NullInt64{}
+	if overrides.WithdrawalCooldown != nil {
+		cooldown = sql.NullInt64{Int64: overrides.WithdrawalCooldown.Milliseconds(), Valid: true}
+	}
+
+	_, err = d.connection.ExecContext(ctx, accountLimitsUpsertQuery, acc,
+		nullAmount(overrides.MaxWithdrawal), nullAmount(overrides.DailyWithdrawal), cooldown)
+	if err != nil {
+		return internal(err, acc, "failed to set account limits")
+	}
+
+	return nil
+}
+
+// nullAmount returns `amount' as a nullable column value
+func nullAmount(amount *int64) sql.NullInt64 {
+	if amount == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: *amount, Valid: true}
+}
+
+const recentDebitsQuery = "SELECT MAX(created_at), COALESCE(-SUM(amount), 0) FROM transactions WHERE user = ? AND (type = ? OR (type = ? AND amount < 0)) AND created_at > ?"
+
+const lastDebitQuery = "SELECT MAX(created_at) FROM transactions WHERE user = ? AND (type = ? OR (type = ? AND amount < 0))"
+
+const lastHoldQuery = "SELECT MAX(created_at) FROM holds WHERE user = ? AND expires_at > ?"
+
+// debitState reads the state of `acc', whose balance is `balance', within
+// `dbTx', for a withdrawal, a transfer or a hold to be checked with
+// Config.checkDebit
+//
+// Withdrawals and the debits of transfers count towards the limits, as do
+// unexpired holds: they are part of the daily total, and restart the
+// cooldown when placed. Negative adjustments, made by administrators, do not.
+func (d DB) debitState(ctx context.Context, dbTx *sql.Tx, acc Account, balance int64) (debitState, error) {
+	held, err := d.heldAmount(ctx, dbTx, acc)
+	if err != nil {
+		return debitState{}, err
+	}
+
+	overrides, err := limitOverrides(ctx, dbTx, acc)
+	if err != nil {
+		return debitState{}, err
+	}
+
+	now := d.cfg.Clock.Now()
+	last := sql.NullInt64{}
+	withdrawn := int64(0)
+	err = dbTx.QueryRowContext(ctx, recentDebitsQuery, acc, Withdrawal, transfer, now.Add(-dailyWindow).Unix()).Scan(&last, &withdrawn)
+	if err != nil {
+		return debitState{}, internal(err, acc, "failed to get recent withdrawals")
+	}
+
+	// The cooldown may be longer than the daily window
+	if !last.Valid && overrides.apply(d.cfg.DefaultLimits()).WithdrawalCooldown > dailyWindow {
+		err = dbTx.QueryRowContext(ctx, lastDebitQuery, acc, Withdrawal, transfer).Scan(&last)
+		if err != nil {
+			return debitState{}, internal(err, acc, "failed to get last withdrawal")
+		}
+	}
+
+	lastHold := sql.NullInt64{}
+	err = dbTx.QueryRowContext(ctx, lastHoldQuery, acc, now.Unix()).Scan(&lastHold)
+	if err != nil {
+		return debitState{}, internal(err, acc, "failed to get last hold")
+	}
+	if lastHold.Valid && (!last.Valid || lastHold.Int64 > last.Int64) {
+		last = lastHold
+	}
+
+	state := debitState{
+		balance:   balance,
+		held:      held,
+		overrides: overrides,
+		withdrawn: withdrawn,
+	}
+	if last.Valid {
+		state.last = time.Unix(last.Int64, 0)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,199 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxWithdrawal(t *testing.T) {
+	configure := func(cfg *Config) { cfg.MaxWithdrawal = 200 }
+	forEachStore(t, configure, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 500)
+
+		err := withdraw(s, acc, 300)
+		wantError(t, err, ErrAboveMaxWithdrawal)
+
+		err = withdraw(s, acc, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Overrides stricter than the default
+		max := int64(100)
+		err = s.SetAccountLimits(acc, LimitOverrides{MaxWithdrawal: &max})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 150)
+		wantError(t, err, ErrAboveMaxWithdrawal)
+
+		// And looser
+		max = 400
+		err = s.SetAccountLimits(acc, LimitOverrides{MaxWithdrawal: &max})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, acc, 0)
+	})
+}
+
+func TestDailyWithdrawalLimit(t *testing.T) {
+	configure := func(cfg *Config) { cfg.DailyWithdrawalLimit = 300 }
+	forEachStore(t, configure, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 1000)
+
+		err := withdraw(s, acc, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.PlaceHold(context.Background(), acc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Held funds count towards the limit
+		err = withdraw(s, acc, 50)
+		wantError(t, err, ErrDailyLimitExceeded)
+
+		clk.advance(dailyWindow)
+
+		daily := int64(100)
+		err = s.SetAccountLimits(acc, LimitOverrides{DailyWithdrawal: &daily})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 200)
+		wantError(t, err, ErrDailyLimitExceeded)
+
+		daily = 500
+		err = s.SetAccountLimits(acc, LimitOverrides{DailyWithdrawal: &daily})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWithdrawalCooldown(t *testing.T) {
+	configure := func(cfg *Config) { cfg.WithdrawalCooldown = time.Hour }
+	forEachStore(t, configure, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 500)
+
+		err := withdraw(s, acc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clk.advance(20 * time.Minute)
+
+		err = withdraw(s, acc, 100)
+		tooSoon := &WithdrawalTooSoonError{}
+		if !errors.As(err, &tooSoon) {
+			t.Fatalf("error = %v, want a WithdrawalTooSoonError", err)
+		}
+		if tooSoon.RetryAfter != 40*time.Minute {
+			t.Errorf("retry after %s, want 40m", tooSoon.RetryAfter)
+		}
+		wantError(t, err, ErrWithdrawalTooSoon)
+
+		none := time.Duration(0)
+		err = s.SetAccountLimits(acc, LimitOverrides{WithdrawalCooldown: &none})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLimitsCountTransfersAndHolds(t *testing.T) {
+	configure := func(cfg *Config) {
+		cfg.DailyWithdrawalLimit = 300
+		cfg.WithdrawalCooldown = time.Hour
+	}
+	forEachStore(t, configure, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 1000)
+		other := createAccount(t, s, "5082", 0)
+
+		// Adjustments, made by administrators, are not counted
+		_, err := s.DoTransaction(context.Background(), acc, Transaction{
+			Type:   Adjustment,
+			Amount: -200,
+			Reason: "duplicate deposit",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clk.advance(time.Hour)
+
+		err = s.FanOutTransfer(context.Background(), acc, []Credit{{other, 100}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Transfers restart the cooldown
+		clk.advance(30 * time.Minute)
+		err = withdraw(s, acc, 50)
+		wantError(t, err, ErrWithdrawalTooSoon)
+
+		// And count towards the daily limit
+		clk.advance(30 * time.Minute)
+		err = withdraw(s, acc, 150)
+		wantError(t, err, ErrDailyLimitExceeded)
+
+		hold, err := s.PlaceHold(context.Background(), acc, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Unexpired holds restart the cooldown as well
+		err = withdraw(s, acc, 50)
+		wantError(t, err, ErrWithdrawalTooSoon)
+
+		err = s.ReleaseHold(context.Background(), acc, hold.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = withdraw(s, acc, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, acc, 550)
+	})
+}
+
+func TestInvalidLimits(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 500)
+
+		max := int64(-1)
+		err := s.SetAccountLimits(acc, LimitOverrides{MaxWithdrawal: &max})
+		wantError(t, err, ErrInvalidLimits)
+	})
+}
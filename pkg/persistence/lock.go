@@ -0,0 +1,16 @@
+package persistence
+
+import "errors"
+
+// ErrDatabaseInUse is returned by LockDB when another instance holds the lock
+// on the database
+var ErrDatabaseInUse = errors.New("database in use by another instance")
+
+// LockDB acquires an advisory lock guarding the database at `path' against
+// concurrent use by several instances of the service
+//
+// The lock is held until the returned function is called, or the process
+// exits.
+func LockDB(path string) (func() error, error) {
+	return lockFile(path + ".lock")
+}
@@ -0,0 +1,29 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// lockFile creates `path' exclusively, and removes it on release
+//
+// Unlike flock, the lockfile is left behind if the process dies, and must then
+// be removed by hand.
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%s: %w", path, ErrDatabaseInUse)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		f.Close()
+		return os.Remove(path)
+	}, nil
+}
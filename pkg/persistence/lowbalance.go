@@ -0,0 +1,148 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const lowBalanceClearQuery = `DELETE FROM low_balances
+	WHERE user IN (SELECT id FROM users WHERE balance >= ? OR closed_at IS NOT NULL)`
+
+const lowBalanceStartQuery = `INSERT INTO low_balances(user, since)
+	SELECT id, ? FROM users WHERE balance < ? AND closed_at IS NULL
+	ON CONFLICT(user) DO NOTHING`
+
+const lowBalanceDueQuery = "SELECT user, since FROM low_balances WHERE flagged_at IS NULL AND since <= ?"
+
+const lowBalanceFlagQuery = "UPDATE low_balances SET flagged_at = ? WHERE flagged_at IS NULL AND since <= ?"
+
+// FlagLowBalances flags the open accounts whose balance has stayed below
+// MinActiveBalance for LowBalancePeriod, and returns how many were newly
+// flagged
+//
+// Accounts are tracked from the first check finding them below the minimum,
+// and are no longer tracked, nor flagged, once a check finds them back above
+// it, or closed. Nothing is flagged if MinActiveBalance is 0.
+func (d DB) FlagLowBalances(ctx context.Context) (_ int, err error) {
+	if d.cfg.MinActiveBalance <= 0 {
+		return 0, nil
+	}
+
+	record, err := d.guard()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	now := d.cfg.Clock.Now()
+	due := now.Add(-d.cfg.LowBalancePeriod)
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, internal(err, NoAccount, "failed to build DB transaction")
+	}
+
+	_, err = dbTx.ExecContext(ctx, lowBalanceClearQuery, d.cfg.MinActiveBalance)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to clear low balances")
+	}
+
+	_, err = dbTx.ExecContext(ctx, lowBalanceStartQuery, now.Unix(), d.cfg.MinActiveBalance)
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to track low balances")
+	}
+
+	rows, err := dbTx.QueryContext(ctx, lowBalanceDueQuery, due.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to query low balances")
+	}
+
+	flagged := map[Account]time.Time{}
+	for rows.Next() {
+		acc := NoAccount
+		since := int64(0)
+		err = rows.Scan(&acc, &since)
+		if err != nil {
+			rows.Close()
+			dbTx.Rollback()
+			return 0, internal(err, NoAccount, "failed to read low balance")
+		}
+		flagged[acc] = time.Unix(since, 0).UTC()
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to read low balances")
+	}
+
+	_, err = dbTx.ExecContext(ctx, lowBalanceFlagQuery, now.Unix(), due.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to flag low balances")
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return 0, internal(err, NoAccount, "failed to commit low balances")
+	}
+
+	for acc, since := range flagged {
+		log.Warn().Int("account_id", int(acc)).Time("below_minimum_since", since).
+			Int64("min_active_balance", d.cfg.MinActiveBalance).Msg("account flagged for low balance")
+	}
+
+	return len(flagged), nil
+}
+
+// FlagLowBalancesEvery runs FlagLowBalances every `interval', forever
+func (d DB) FlagLowBalancesEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		flagged, err := d.FlagLowBalances(context.Background())
+		if err != nil {
+			log.Error().Err(err).Msg("scheduled low balance check failed")
+			continue
+		}
+
+		log.Info().Int("flagged", flagged).Msg("low balance check done")
+	}
+}
+
+const lowBalanceFlagOfQuery = "SELECT flagged_at FROM low_balances WHERE user = ? AND flagged_at IS NOT NULL"
+
+// LowBalanceFlag returns when `acc' was flagged by FlagLowBalances for
+// keeping its balance below the minimum, zero if it is not flagged
+func (d DB) LowBalanceFlag(acc Account) (_ time.Time, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	flaggedAt := int64(0)
+	err = d.connection.QueryRowContext(ctx, lowBalanceFlagOfQuery, acc).Scan(&flaggedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, internal(err, acc, "failed to get low balance flag")
+	}
+
+	return time.Unix(flaggedAt, 0).UTC(), nil
+}
@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrMaintenanceRunning is returned when starting the maintenance of the
+// database while it is already running
+var ErrMaintenanceRunning = errors.New("database maintenance already running")
+
+// Maintenance reclaims the free pages of the database with VACUUM, and
+// refreshes the statistics of the query planner with ANALYZE
+//
+// It is not bounded by the query timeout, since VACUUM rewrites the whole
+// database, but stops when `ctx' is done. Fails with ErrMaintenanceRunning if
+// another maintenance is in progress.
+func (d DB) Maintenance(ctx context.Context) (err error) {
+	select {
+	case d.maintenance <- struct{}{}:
+	default:
+		return ErrMaintenanceRunning
+	}
+	defer func() { <-d.maintenance }()
+
+	record, err := d.guard()
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	_, err = d.connection.ExecContext(ctx, "VACUUM")
+	if err != nil {
+		return internal(err, NoAccount, "failed to vacuum database")
+	}
+
+	_, err = d.connection.ExecContext(ctx, "ANALYZE")
+	if err != nil {
+		return internal(err, NoAccount, "failed to analyze database")
+	}
+
+	return nil
+}
+
+// MaintainEvery runs Maintenance every `interval', forever
+func (d DB) MaintainEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		start := time.Now()
+		err := d.Maintenance(context.Background())
+		if err != nil {
+			log.Error().Err(err).Msg("scheduled database maintenance failed")
+			continue
+		}
+
+		log.Info().Dur("duration", time.Since(start)).Msg("database maintenance done")
+	}
+}
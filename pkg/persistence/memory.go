@@ -0,0 +1,1469 @@
+package persistence
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbajolet/atm_service/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+// Memory is a persistence layer keeping accounts, transactions and holds in
+// memory, behaving like DB
+//
+// It is meant to benchmark the service without the cost of SQLite, and
+// everything is lost when the process exits. Config.Path and the tunables of
+// the database connection (timeouts, busy retries, circuit breaker) are
+// ignored; Config.SimulatedLatency delays every operation instead.
+type Memory struct {
+	cfg Config
+
+	lock     sync.Mutex
+	accounts map[Account]*memoryAccount
+	// ids are the IDs of `accounts' in ascending order, for lookups by PIN
+	// or card number to match the same account as DB whatever the order of
+	// the map
+	ids          []Account
+	transactions []TransactionRecord
+	// amounts are the signed amounts of `transactions'
+	amounts []int64
+	// types are the recorded types of `transactions', telling transfers
+	// apart from deposits and withdrawals
+	types           []TransactionType
+	lastTransaction int64
+	openings        map[Account]memoryOpening
+	holds           map[int64]Hold
+	lastHold        int64
+	limits          map[Account]LimitOverrides
+	// adjustments are the reasons of the adjustments, by transaction ID
+	adjustments map[int64]string
+	lowBalances map[Account]memoryLowBalance
+	// audit are the entries of the audit log, oldest first
+	audit []AuditEntry
+}
+
+// memoryLowBalance tracks an account found below the minimum active balance
+// since `since', flagged at `flaggedAt' if it is not zero
+type memoryLowBalance struct {
+	since     time.Time
+	flaggedAt time.Time
+}
+
+// memoryOpening is the opening balance of an account, folding the
+// transactions purged before `asOf'
+type memoryOpening struct {
+	balance int64
+	asOf    time.Time
+}
+
+type memoryAccount struct {
+	pin              string
+	cardNumber       string
+	externalRef      string
+	balance          int64
+	closedAt         time.Time
+	tempPIN          string
+	tempPINExpiresAt time.Time
+}
+
+// NewMemory returns an empty in-memory persistence layer
+func NewMemory(cfg Config) *Memory {
+	return &Memory{
+		cfg:         cfg,
+		accounts:    map[Account]*memoryAccount{},
+		openings:    map[Account]memoryOpening{},
+		holds:       map[int64]Hold{},
+		limits:      map[Account]LimitOverrides{},
+		adjustments: map[int64]string{},
+		lowBalances: map[Account]memoryLowBalance{},
+	}
+}
+
+// simulateLatency waits for the configured simulated latency, or until `ctx'
+// is done
+func (m *Memory) simulateLatency(ctx context.Context) error {
+	if m.cfg.SimulatedLatency <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(m.cfg.SimulatedLatency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("simulated latency: %w", ctx.Err())
+	}
+}
+
+// openAccount returns `acc', failing with ErrAccountClosed if it is closed
+//
+// The lock must be held.
+func (m *Memory) openAccount(acc Account) (*memoryAccount, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return nil, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	if !account.closedAt.IsZero() {
+		return nil, fmt.Errorf("account %d: %w", acc, ErrAccountClosed)
+	}
+
+	return account, nil
+}
+
+// heldAmount returns the total of the unexpired holds on `acc'
+//
+// The lock must be held.
+func (m *Memory) heldAmount(acc Account) int64 {
+	now := m.cfg.Clock.Now()
+
+	held := int64(0)
+	for _, hold := range m.holds {
+		if hold.Account == acc && !isExpired(hold.ExpiresAt, now) {
+			held += hold.Amount
+		}
+	}
+
+	return held
+}
+
+// debitState returns the state of `acc', for a withdrawal or a hold to be
+// checked with Config.checkDebit, like DB.debitState
+//
+// The lock must be held, and `acc' must exist.
+func (m *Memory) debitState(acc Account) debitState {
+	state := debitState{
+		balance:   m.accounts[acc].balance,
+		held:      m.heldAmount(acc),
+		overrides: m.limits[acc],
+	}
+	now := m.cfg.Clock.Now()
+	since := now.Add(-dailyWindow).Unix()
+
+	// Transactions are recorded in order, so the scan can stop at the first
+	// debit older than the daily window
+	for i := len(m.transactions) - 1; i >= 0; i-- {
+		if m.transactions[i].Account != acc || !isDebit(m.types[i], m.amounts[i]) {
+			continue
+		}
+
+		if state.last.IsZero() {
+			state.last = m.transactions[i].CreatedAt
+		}
+		if m.transactions[i].CreatedAt.Unix() <= since {
+			break
+		}
+		state.withdrawn -= m.amounts[i]
+	}
+
+	for _, hold := range m.holds {
+		if hold.Account == acc && !isExpired(hold.ExpiresAt, now) && hold.CreatedAt.After(state.last) {
+			state.last = hold.CreatedAt
+		}
+	}
+
+	return state
+}
+
+// isDebit tells whether a transaction of type `typ' and `amount' counts
+// towards the limits, like the queries of DB.debitState
+func isDebit(typ TransactionType, amount int64) bool {
+	return typ == Withdrawal || (typ == transfer && amount < 0)
+}
+
+// record changes the balance of `acc' by `amount' and records the movement
+// as a transaction of type `typ'; the event of the movement is appended to
+// `moved'
+//
+// The lock must be held, and `acc' must exist.
+func (m *Memory) record(acc Account, typ TransactionType, amount int64, category string, moved *[]events.Transaction) int64 {
+	m.accounts[acc].balance += amount
+
+	m.lastTransaction++
+	rec := newTransactionRecord(m.lastTransaction, acc, typ, amount,
+		time.Unix(m.cfg.Clock.Now().Unix(), 0).UTC(), category)
+
+	m.transactions = append(m.transactions, rec)
+	m.amounts = append(m.amounts, amount)
+	m.types = append(m.types, typ)
+
+	*moved = append(*moved, events.Transaction{
+		ID:        rec.ID,
+		Account:   int(acc),
+		Amount:    amount,
+		Category:  category,
+		CreatedAt: rec.CreatedAt,
+	})
+
+	return rec.ID
+}
+
+// publish publishes the events of the movements of a completed operation
+func (m *Memory) publish(moved []events.Transaction) {
+	for _, tx := range moved {
+		m.cfg.Events.Publish(tx)
+	}
+}
+
+// Ping always succeeds, after the simulated latency
+func (m *Memory) Ping() error {
+	return m.simulateLatency(context.Background())
+}
+
+// HealthDetailed reports a healthy store; there is no connection pool nor
+// schema to report on
+func (m *Memory) HealthDetailed() (Health, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return Health{}, err
+	}
+
+	return Health{
+		LastSuccess: m.cfg.Clock.Now(),
+	}, nil
+}
+
+// Maintenance does nothing, there is no storage to maintain
+func (m *Memory) Maintenance(ctx context.Context) error {
+	return m.simulateLatency(ctx)
+}
+
+// Auth returns the Account linked to `pin', like DB.Auth
+func (m *Memory) Auth(pin string) (Account, bool, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	acc, temporary, err := m.matchPIN(pin)
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	if temporary {
+		account := m.accounts[acc]
+		account.tempPIN = ""
+		account.tempPINExpiresAt = time.Time{}
+	}
+
+	return acc, temporary, nil
+}
+
+// CheckPIN returns the Account linked to `pin', like DB.CheckPIN
+func (m *Memory) CheckPIN(pin string) (Account, bool, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.matchPIN(pin)
+}
+
+// matchPIN returns the account whose PIN, or else unexpired temporary PIN,
+// is `pin', if it can log in; `temporary' tells which one matched
+//
+// The lock must be held.
+func (m *Memory) matchPIN(pin string) (acc Account, temporary bool, err error) {
+	acc = NoAccount
+	for _, id := range m.ids {
+		if m.accounts[id].pin == pin {
+			acc = id
+			break
+		}
+	}
+
+	if !acc.IsValid() {
+		now := m.cfg.Clock.Now()
+		for _, id := range m.ids {
+			account := m.accounts[id]
+			if account.tempPIN == pin && !isExpired(account.tempPINExpiresAt, now) {
+				acc, temporary = id, true
+				break
+			}
+		}
+	}
+
+	if !acc.IsValid() {
+		return NoAccount, false, fmt.Errorf("auth: %w", ErrNoAccount)
+	}
+
+	err = m.cfg.checkLogin(acc, !m.accounts[acc].closedAt.IsZero())
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	return acc, temporary, nil
+}
+
+// AuthChallenge authenticates the holder of the card `cardNumber' with their
+// response to the login challenge `nonce', like DB.AuthChallenge
+func (m *Memory) AuthChallenge(cardNumber string, nonce, response []byte) (Account, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return NoAccount, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, acc := range m.ids {
+		account := m.accounts[acc]
+		if account.cardNumber != cardNumber {
+			continue
+		}
+
+		if !hmac.Equal(ChallengeResponse(account.pin, nonce), response) {
+			break
+		}
+
+		err = m.cfg.checkLogin(acc, !account.closedAt.IsZero())
+		if err != nil {
+			return NoAccount, err
+		}
+
+		return acc, nil
+	}
+
+	return NoAccount, fmt.Errorf("auth: %w", ErrNoAccount)
+}
+
+// ChangePIN replaces the PIN of `acc', like DB.ChangePIN
+func (m *Memory) ChangePIN(acc Account, pin string) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = m.cfg.checkNewPIN(pin)
+	if err != nil {
+		return fmt.Errorf("account %d: %w", acc, err)
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	if m.pinInUse(acc, pin, m.cfg.Clock.Now()) {
+		return fmt.Errorf("new PIN: %w", ErrPINInUse)
+	}
+
+	account.pin = pin
+	return nil
+}
+
+// IssueTempPIN generates a temporary PIN for `acc', like DB.IssueTempPIN
+func (m *Memory) IssueTempPIN(acc Account) (string, time.Time, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := m.cfg.Clock.Now()
+	expiresAt := expiryAfter(now, m.cfg.TempPINLifetime)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	pin, err := m.cfg.generateTempPIN(acc, func(candidate string) (bool, error) {
+		return m.pinInUse(acc, candidate, now), nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	account.tempPIN = pin
+	account.tempPINExpiresAt = expiresAt
+	return pin, expiresAt, nil
+}
+
+// pinInUse tells whether `pin' is the PIN of an account, or the unexpired
+// temporary PIN of an account other than `acc', at `now'
+//
+// The lock must be held.
+func (m *Memory) pinInUse(acc Account, pin string, now time.Time) bool {
+	for _, id := range m.ids {
+		account := m.accounts[id]
+		if account.pin == pin {
+			return true
+		}
+
+		if id != acc && account.tempPIN == pin && !isExpired(account.tempPINExpiresAt, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateAccount creates an account for the card, like DB.CreateAccount
+func (m *Memory) CreateAccount(pin, cardNumber, externalRef string, balance int64) (Account, bool, error) {
+	err := m.cfg.checkNewPIN(pin)
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	err = m.cfg.checkOpeningBalance(balance)
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return NoAccount, false, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, id := range m.ids {
+		if externalRef != "" && m.accounts[id].externalRef == externalRef {
+			return id, false, nil
+		}
+	}
+
+	for _, id := range m.ids {
+		if m.accounts[id].cardNumber == cardNumber {
+			return NoAccount, false, fmt.Errorf("card %s: %w", cardNumber, ErrDuplicateCard)
+		}
+	}
+
+	if m.pinInUse(NoAccount, pin, m.cfg.Clock.Now()) {
+		return NoAccount, false, fmt.Errorf("new PIN: %w", ErrPINInUse)
+	}
+
+	acc := Account(len(m.accounts) + 1)
+	m.accounts[acc] = &memoryAccount{
+		pin:         pin,
+		cardNumber:  cardNumber,
+		externalRef: externalRef,
+	}
+	m.ids = append(m.ids, acc)
+
+	moved := []events.Transaction{}
+	if balance > 0 {
+		m.record(acc, Deposit, balance, "", &moved)
+	}
+
+	m.publish(moved)
+	return acc, true, nil
+}
+
+// AccountInfo returns the state of the account, whether it is open or closed
+func (m *Memory) AccountInfo(acc Account) (AccountInfo, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return AccountInfo{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return AccountInfo{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.accountInfo(acc)
+}
+
+// accountInfo returns the state of `acc'
+//
+// The lock must be held.
+func (m *Memory) accountInfo(acc Account) (AccountInfo, error) {
+	info := AccountInfo{ID: acc}
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return info, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	info.Balance = account.balance
+	info.ClosedAt = account.closedAt
+	return info, nil
+}
+
+// AccountLimits returns the limits set for `acc', and the limits enforced
+// on it, like DB.AccountLimits
+func (m *Memory) AccountLimits(acc Account) (LimitOverrides, Limits, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.accountInfo(acc)
+	if err != nil {
+		return LimitOverrides{}, Limits{}, err
+	}
+
+	overrides := m.limits[acc]
+	return overrides, overrides.apply(m.cfg.DefaultLimits()), nil
+}
+
+// DefaultLimits returns the limits of the accounts without overrides
+func (m *Memory) DefaultLimits() Limits {
+	return m.cfg.DefaultLimits()
+}
+
+// SetAccountLimits replaces the limits set for `acc', like
+// DB.SetAccountLimits
+func (m *Memory) SetAccountLimits(acc Account, overrides LimitOverrides) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = overrides.check()
+	if err != nil {
+		return fmt.Errorf("account %d: %w", acc, err)
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.accountInfo(acc)
+	if err != nil {
+		return err
+	}
+
+	if overrides.IsZero() {
+		delete(m.limits, acc)
+		return nil
+	}
+
+	m.limits[acc] = overrides
+	return nil
+}
+
+// AccountStats computes the transaction count and last activity of the account
+func (m *Memory) AccountStats(acc Account) (AccountStats, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return AccountStats{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return AccountStats{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats := AccountStats{}
+	for _, rec := range m.transactions {
+		if rec.Account != acc {
+			continue
+		}
+
+		stats.TransactionCount++
+		if rec.CreatedAt.After(stats.LastActivity) {
+			stats.LastActivity = rec.CreatedAt
+		}
+	}
+
+	return stats, nil
+}
+
+// CloseAccount marks the account as closed, like DB.CloseAccount
+func (m *Memory) CloseAccount(acc Account) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	if account.balance != 0 {
+		return fmt.Errorf("account %d: %w", acc, ErrNonZeroBalance)
+	}
+
+	account.closedAt = time.Unix(m.cfg.Clock.Now().Unix(), 0).UTC()
+	return nil
+}
+
+// CloseAccountWithPayout transfers the whole balance of the account to
+// `payout', and marks it as closed, like DB.CloseAccountWithPayout
+func (m *Memory) CloseAccountWithPayout(acc, payout Account) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkAccount(payout)
+	if err != nil {
+		return 0, err
+	}
+
+	if payout == acc {
+		return 0, fmt.Errorf("payout to account %d: %w", payout, ErrInvalidTransaction)
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.heldAmount(acc) != 0 {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNonZeroBalance)
+	}
+
+	balance := account.balance
+	moved := []events.Transaction{}
+	if balance > 0 {
+		payoutAccount, err := m.openAccount(payout)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = addAmounts(payoutAccount.balance, balance)
+		if err != nil {
+			return 0, err
+		}
+
+		m.record(acc, transfer, -balance, "", &moved)
+		m.record(payout, transfer, balance, "", &moved)
+	}
+
+	account.closedAt = time.Unix(m.cfg.Clock.Now().Unix(), 0).UTC()
+
+	m.publish(moved)
+	return balance, nil
+}
+
+// ReopenAccount reopens a closed account
+func (m *Memory) ReopenAccount(acc Account) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	account.closedAt = time.Time{}
+	return nil
+}
+
+// Balance gets the current balance for the account
+func (m *Memory) Balance(acc Account) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	return account.balance, nil
+}
+
+// BalanceMany returns the balances of several accounts, like DB.BalanceMany
+func (m *Memory) BalanceMany(accs []Account) (map[Account]int64, error) {
+	balances := map[Account]int64{}
+	if len(accs) == 0 {
+		return balances, nil
+	}
+
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, acc := range accs {
+		if account, ok := m.accounts[acc]; ok {
+			balances[acc] = account.balance
+		}
+	}
+
+	return balances, nil
+}
+
+// BalanceAsOf computes the balance of the account at time `at', by replaying
+// its transactions up to then
+func (m *Memory) BalanceAsOf(acc Account, at time.Time) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.accounts[acc]; !ok {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	opening := m.openings[acc]
+	err = checkHistory(acc, at, opening.asOf)
+	if err != nil {
+		return 0, err
+	}
+
+	balance := opening.balance
+	for i, rec := range m.transactions {
+		if rec.Account == acc && rec.CreatedAt.Unix() <= at.Unix() {
+			balance += m.amounts[i]
+		}
+	}
+
+	return balance, nil
+}
+
+// AvailableBalance returns the balance of the open account `acc' which is not
+// held
+func (m *Memory) AvailableBalance(acc Account) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	return account.balance - m.heldAmount(acc), nil
+}
+
+// DoTransaction applies `tx' to the balance of `acc' and records it, like
+// DB.DoTransaction
+func (m *Memory) DoTransaction(ctx context.Context, acc Account, tx Transaction) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return -1, err
+	}
+
+	err = tx.check()
+	if err != nil {
+		return -1, err
+	}
+
+	err = m.simulateLatency(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return -1, err
+	}
+
+	amount, err := tx.getAmount()
+	if err != nil {
+		return -1, err
+	}
+
+	newBalance, err := addAmounts(account.balance, amount)
+	if err != nil {
+		return -1, err
+	}
+
+	if newBalance < 0 {
+		return -1, fmt.Errorf("account %d: %w", acc, ErrInsufficientFunds)
+	}
+
+	if tx.Type == Withdrawal {
+		err = m.cfg.checkDebit(acc, tx.Amount, m.debitState(acc), m.cfg.Clock.Now())
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	moved := []events.Transaction{}
+	id := m.record(acc, tx.Type, amount, tx.Category, &moved)
+	if tx.Type == Adjustment {
+		m.adjustments[id] = tx.Reason
+	}
+
+	m.publish(moved)
+	return id, nil
+}
+
+// FanOutTransfer debits `from' once for the sum of `credits', and credits
+// every target account, like DB.FanOutTransfer
+func (m *Memory) FanOutTransfer(ctx context.Context, from Account, credits []Credit) error {
+	err := checkAccount(from)
+	if err != nil {
+		return err
+	}
+
+	total, err := checkTransfer(from, credits)
+	if err != nil {
+		return err
+	}
+
+	err = m.simulateLatency(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.openAccount(from)
+	if err != nil {
+		return err
+	}
+
+	err = m.cfg.checkDebit(from, total, m.debitState(from), m.cfg.Clock.Now())
+	if err != nil {
+		return err
+	}
+
+	// Check all the credits before applying any, so the transfer is atomic
+	balances := map[Account]int64{}
+	for _, c := range credits {
+		to, err := m.openAccount(c.To)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := balances[c.To]; !ok {
+			balances[c.To] = to.balance
+		}
+
+		balances[c.To], err = addAmounts(balances[c.To], c.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	moved := []events.Transaction{}
+	m.record(from, transfer, -total, "", &moved)
+	for _, c := range credits {
+		m.record(c.To, transfer, c.Amount, "", &moved)
+	}
+
+	m.publish(moved)
+	return nil
+}
+
+// TransferEach credits every target account from `from' in a transaction of
+// its own, like DB.TransferEach
+func (m *Memory) TransferEach(ctx context.Context, from Account, credits []Credit) []error {
+	errs := make([]error, len(credits))
+	for i, c := range credits {
+		errs[i] = m.FanOutTransfer(ctx, from, []Credit{c})
+	}
+
+	return errs
+}
+
+// PlaceHold reserves `amount' on `acc', like DB.PlaceHold
+func (m *Memory) PlaceHold(ctx context.Context, acc Account, amount int64) (Hold, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	err = checkAmount(amount)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	err = m.simulateLatency(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.openAccount(acc)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	now := m.cfg.Clock.Now()
+	err = m.cfg.checkDebit(acc, amount, m.debitState(acc), now)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	for id, hold := range m.holds {
+		if isExpired(hold.ExpiresAt, now) {
+			delete(m.holds, id)
+		}
+	}
+
+	m.lastHold++
+	hold := Hold{
+		ID:        m.lastHold,
+		Account:   acc,
+		Amount:    amount,
+		CreatedAt: time.Unix(now.Unix(), 0).UTC(),
+		ExpiresAt: expiryAfter(now, m.cfg.HoldLifetime),
+	}
+	m.holds[hold.ID] = hold
+
+	return hold, nil
+}
+
+// unexpiredHold returns the hold `id' of `acc', failing with ErrNoHold if
+// the account has no such unexpired hold
+//
+// The lock must be held.
+func (m *Memory) unexpiredHold(acc Account, id int64) (Hold, error) {
+	hold, ok := m.holds[id]
+	if !ok || hold.Account != acc || isExpired(hold.ExpiresAt, m.cfg.Clock.Now()) {
+		return Hold{}, fmt.Errorf("hold %d: %w", id, ErrNoHold)
+	}
+
+	return hold, nil
+}
+
+// CaptureHold settles the hold `id' of `acc', like DB.CaptureHold
+func (m *Memory) CaptureHold(ctx context.Context, acc Account, id int64) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = m.simulateLatency(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hold, err := m.unexpiredHold(acc, id)
+	if err != nil {
+		return err
+	}
+
+	account, err := m.openAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	if account.balance < hold.Amount {
+		return fmt.Errorf("account %d: %w", acc, ErrInsufficientFunds)
+	}
+
+	delete(m.holds, id)
+
+	moved := []events.Transaction{}
+	m.record(acc, Withdrawal, -hold.Amount, "", &moved)
+
+	m.publish(moved)
+	return nil
+}
+
+// ReleaseHold cancels the hold `id' of `acc', like DB.ReleaseHold
+func (m *Memory) ReleaseHold(ctx context.Context, acc Account, id int64) error {
+	err := checkAccount(acc)
+	if err != nil {
+		return err
+	}
+
+	err = m.simulateLatency(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.unexpiredHold(acc, id)
+	if err != nil {
+		return err
+	}
+
+	delete(m.holds, id)
+	return nil
+}
+
+// GetTransaction returns the transaction recorded with `id'
+func (m *Memory) GetTransaction(id int64) (TransactionRecord, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return TransactionRecord{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	i := sort.Search(len(m.transactions), func(i int) bool {
+		return m.transactions[i].ID >= id
+	})
+	if i == len(m.transactions) || m.transactions[i].ID != id {
+		return TransactionRecord{}, fmt.Errorf("transaction %d: %w", id, ErrNoTransaction)
+	}
+
+	return m.transactions[i], nil
+}
+
+// Transactions returns the transactions of `acc' between `from' and `to',
+// like DB.Transactions
+func (m *Memory) Transactions(acc Account, from, to time.Time) ([]TransactionRecord, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.accounts[acc]; !ok {
+		return nil, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	fromUnix, toUnix := periodBounds(from, to)
+	records := []TransactionRecord{}
+	for _, rec := range m.transactions {
+		if rec.Account == acc && rec.CreatedAt.Unix() >= fromUnix && rec.CreatedAt.Unix() <= toUnix {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+// EachTransaction calls `fn' with the transactions of `acc' between `from'
+// and `to', like DB.EachTransaction
+//
+// The transactions are collected first, so `fn' runs without the lock held.
+func (m *Memory) EachTransaction(ctx context.Context, acc Account, from, to time.Time, fn func(TransactionRecord) error) error {
+	records, err := m.Transactions(acc, from, to)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RecentTransactions returns at most `limit' transactions of `acc', newest
+// first, skipping the `offset' newest ones
+func (m *Memory) RecentTransactions(acc Account, limit, offset int) ([]TransactionRecord, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.accounts[acc]; !ok {
+		return nil, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	records := []TransactionRecord{}
+	for i := len(m.transactions) - 1; i >= 0 && len(records) < limit; i-- {
+		if m.transactions[i].Account != acc {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		records = append(records, m.transactions[i])
+	}
+
+	return records, nil
+}
+
+// PurgeTransactions deletes the transactions recorded before `before',
+// folding them into opening balances, like DB.PurgeTransactions
+func (m *Memory) PurgeTransactions(before time.Time) (int64, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	asOf := time.Unix(before.Unix(), 0).UTC()
+	transactions := []TransactionRecord{}
+	amounts := []int64{}
+	types := []TransactionType{}
+	purged := int64(0)
+	for i, rec := range m.transactions {
+		if rec.CreatedAt.Unix() >= before.Unix() {
+			transactions = append(transactions, rec)
+			amounts = append(amounts, m.amounts[i])
+			types = append(types, m.types[i])
+			continue
+		}
+
+		opening := m.openings[rec.Account]
+		opening.balance += m.amounts[i]
+		if asOf.After(opening.asOf) {
+			opening.asOf = asOf
+		}
+		m.openings[rec.Account] = opening
+		delete(m.adjustments, rec.ID)
+		purged++
+	}
+
+	m.transactions = transactions
+	m.amounts = amounts
+	m.types = types
+	return purged, nil
+}
+
+// RecordAudit records the administrative action `entry' at the current time,
+// and returns the ID of its entry
+func (m *Memory) RecordAudit(entry AuditEntry) (int64, error) {
+	err := entry.check()
+	if err != nil {
+		return -1, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return -1, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.ID = int64(len(m.audit)) + 1
+	entry.CreatedAt = time.Unix(m.cfg.Clock.Now().Unix(), 0).UTC()
+	m.audit = append(m.audit, entry)
+
+	return entry.ID, nil
+}
+
+// ListAudit returns at most `limit' entries of the audit log selected by
+// `filter', newest first, skipping the `offset' newest ones
+func (m *Memory) ListAudit(filter AuditFilter, limit, offset int) ([]AuditEntry, error) {
+	err := m.simulateLatency(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		if !filter.matches(m.audit[i]) {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		entries = append(entries, m.audit[i])
+	}
+
+	return entries, nil
+}
+
+// BalanceAfter computes the balance of the account right after the
+// transaction `id'
+func (m *Memory) BalanceAfter(acc Account, id int64) (int64, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	account, ok := m.accounts[acc]
+	if !ok {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	balance := account.balance
+	for i := len(m.transactions) - 1; i >= 0 && m.transactions[i].ID > id; i-- {
+		if m.transactions[i].Account == acc {
+			balance -= m.amounts[i]
+		}
+	}
+
+	return balance, nil
+}
+
+// Summary totals the deposits and withdrawals of `acc' between `from' and
+// `to', like DB.Summary
+func (m *Memory) Summary(acc Account, from, to time.Time) (Summary, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return Summary{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sum := Summary{}
+	info, err := m.accountInfo(acc)
+	if err != nil {
+		return sum, err
+	}
+	sum.Balance = info.Balance
+
+	for _, t := range m.totalsByCategory(acc, from, to) {
+		sum.Deposits += t.Deposits
+		sum.Withdrawals += t.Withdrawals
+	}
+
+	return sum, nil
+}
+
+// SummaryByCategory totals the deposits and withdrawals of `acc' between
+// `from' and `to' for every category, like DB.SummaryByCategory
+func (m *Memory) SummaryByCategory(acc Account, from, to time.Time) ([]CategoryTotals, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err = m.accountInfo(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.totalsByCategory(acc, from, to), nil
+}
+
+// totalsByCategory totals the transactions of `acc' between `from' and `to'
+// for every category, ordered by category
+//
+// The lock must be held.
+func (m *Memory) totalsByCategory(acc Account, from, to time.Time) []CategoryTotals {
+	fromUnix, toUnix := periodBounds(from, to)
+
+	byCategory := map[string]*CategoryTotals{}
+	for _, rec := range m.transactions {
+		if rec.Account != acc || rec.CreatedAt.Unix() < fromUnix || rec.CreatedAt.Unix() > toUnix {
+			continue
+		}
+
+		t, ok := byCategory[rec.Category]
+		if !ok {
+			t = &CategoryTotals{Category: rec.Category}
+			byCategory[rec.Category] = t
+		}
+
+		if rec.Type == Deposit {
+			t.Deposits += rec.Amount
+		} else {
+			t.Withdrawals += rec.Amount
+		}
+	}
+
+	totals := make([]CategoryTotals, 0, len(byCategory))
+	for _, t := range byCategory {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].Category < totals[j].Category
+	})
+
+	return totals
+}
+
+// FlagLowBalances flags the open accounts whose balance has stayed below
+// the minimum for the configured period, like DB.FlagLowBalances
+func (m *Memory) FlagLowBalances(ctx context.Context) (int, error) {
+	if m.cfg.MinActiveBalance <= 0 {
+		return 0, nil
+	}
+
+	err := m.simulateLatency(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.cfg.Clock.Now()
+	due := now.Add(-m.cfg.LowBalancePeriod)
+	flagged := 0
+	for _, acc := range m.ids {
+		account := m.accounts[acc]
+		if account.balance >= m.cfg.MinActiveBalance || !account.closedAt.IsZero() {
+			delete(m.lowBalances, acc)
+			continue
+		}
+
+		low, ok := m.lowBalances[acc]
+		if !ok {
+			low.since = now
+		}
+		if low.flaggedAt.IsZero() && !low.since.After(due) {
+			low.flaggedAt = now
+			flagged++
+			log.Warn().Int("account_id", int(acc)).Time("below_minimum_since", low.since).
+				Int64("min_active_balance", m.cfg.MinActiveBalance).Msg("account flagged for low balance")
+		}
+		m.lowBalances[acc] = low
+	}
+
+	return flagged, nil
+}
+
+// LowBalanceFlag returns when `acc' was flagged for keeping its balance below
+// the minimum, like DB.LowBalanceFlag
+func (m *Memory) LowBalanceFlag(acc Account) (time.Time, error) {
+	err := checkAccount(acc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	err = m.simulateLatency(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.lowBalances[acc].flaggedAt, nil
+}
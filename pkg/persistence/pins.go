@@ -0,0 +1,255 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const tempPINQuery = "SELECT id, closed_at FROM users WHERE temp_pin = ? AND temp_pin_expires_at > ?"
+
+const tempPINClearQuery = "UPDATE users SET temp_pin = NULL, temp_pin_expires_at = NULL WHERE id = ? AND temp_pin = ?"
+
+// matchTempPIN returns the account whose unexpired temporary PIN is `pin',
+// if it can log in
+func (d DB) matchTempPIN(ctx context.Context, pin string) (Account, error) {
+	acc := NoAccount
+	closedAt := sql.NullInt64{}
+
+	err := d.connection.QueryRowContext(ctx, tempPINQuery, pin, d.cfg.Clock.Now().Unix()).Scan(&acc, &closedAt)
+	if err == sql.ErrNoRows {
+		return NoAccount, fmt.Errorf("auth: %w", ErrNoAccount)
+	}
+	if err != nil {
+		return NoAccount, internal(err, NoAccount, "failed to query temporary PIN")
+	}
+
+	err = d.cfg.checkLogin(acc, closedAt.Valid)
+	if err != nil {
+		return NoAccount, err
+	}
+
+	return acc, nil
+}
+
+// useTempPIN authenticates with the unexpired temporary PIN `pin', and
+// invalidates it
+func (d DB) useTempPIN(pin string) (Account, error) {
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	acc, err := d.matchTempPIN(ctx, pin)
+	if err != nil {
+		return NoAccount, err
+	}
+
+	res, err := d.connection.ExecContext(ctx, tempPINClearQuery, acc, pin)
+	if err != nil {
+		return NoAccount, internal(err, acc, "failed to invalidate temporary PIN")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return NoAccount, internal(err, acc, "failed to invalidate temporary PIN")
+	}
+
+	// The PIN was used concurrently
+	if n == 0 {
+		return NoAccount, fmt.Errorf("auth: %w", ErrNoAccount)
+	}
+
+	return acc, nil
+}
+
+const expiredTempPINsClearQuery = "UPDATE users SET temp_pin = NULL, temp_pin_expires_at = NULL WHERE temp_pin_expires_at <= ?"
+
+const pinInUseQuery = "SELECT COUNT(*) FROM users WHERE pin = ? OR (temp_pin = ? AND id != ?)"
+
+// checkPINUnused fails with ErrPINInUse if `pin' is the PIN of an account,
+// or the unexpired temporary PIN of an account other than `acc', within
+// `dbTx'
+func (d DB) checkPINUnused(ctx context.Context, dbTx *sql.Tx, acc Account, pin string) error {
+	// Expired temporary PINs are cleared so they do not count
+	_, err := dbTx.ExecContext(ctx, expiredTempPINsClearQuery, d.cfg.Clock.Now().Unix())
+	if err != nil {
+		return internal(err, acc, "failed to clear expired temporary PINs")
+	}
+
+	inUse := 0
+	err = dbTx.QueryRowContext(ctx, pinInUseQuery, pin, pin, acc).Scan(&inUse)
+	if err != nil {
+		return internal(err, acc, "failed to check PIN")
+	}
+
+	if inUse != 0 {
+		return fmt.Errorf("new PIN: %w", ErrPINInUse)
+	}
+
+	return nil
+}
+
+const tempPINSetQuery = "UPDATE users SET temp_pin = ?, temp_pin_expires_at = ? WHERE id = ? AND closed_at IS NULL"
+
+// IssueTempPIN generates a temporary PIN for `acc', replacing any previous
+// one, valid once until the returned expiration
+//
+// The temporary PIN is neither the PIN nor the unexpired temporary PIN of
+// another account, so it authenticates to `acc' only. Fails with
+// ErrNoAccount if the account does not exist or is closed, and with
+// ErrNoTempPINAvailable if no such PIN was found.
+func (d DB) IssueTempPIN(acc Account) (_ string, _ time.Time, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer func() { record(err) }()
+
+	now := d.cfg.Clock.Now()
+	expiresAt := expiryAfter(now, d.cfg.TempPINLifetime)
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return "", time.Time{}, internal(err, acc, "failed to build DB transaction")
+	}
+
+	// Expired temporary PINs are cleared so they can be issued again, the
+	// unique index on temp_pin covering expired ones too
+	_, err = dbTx.ExecContext(ctx, expiredTempPINsClearQuery, now.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return "", time.Time{}, internal(err, acc, "failed to clear expired temporary PINs")
+	}
+
+	pin, err := d.cfg.generateTempPIN(acc, func(candidate string) (bool, error) {
+		inUse := 0
+		err := dbTx.QueryRowContext(ctx, pinInUseQuery, candidate, candidate, acc).Scan(&inUse)
+		if err != nil {
+			return false, internal(err, acc, "failed to check temporary PIN")
+		}
+
+		return inUse != 0, nil
+	})
+	if err != nil {
+		dbTx.Rollback()
+		return "", time.Time{}, err
+	}
+
+	res, err := dbTx.ExecContext(ctx, tempPINSetQuery, pin, expiresAt.Unix(), acc)
+	if err != nil {
+		dbTx.Rollback()
+		return "", time.Time{}, internal(err, acc, "failed to set temporary PIN")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		dbTx.Rollback()
+		return "", time.Time{}, internal(err, acc, "failed to set temporary PIN")
+	}
+
+	if affected == 0 {
+		dbTx.Rollback()
+		return "", time.Time{}, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return "", time.Time{}, internal(err, acc, "failed to commit temporary PIN")
+	}
+
+	return pin, expiresAt, nil
+}
+
+const pinUpdateQuery = "UPDATE users SET pin = ? WHERE id = ?"
+
+// maxTempPINAttempts bounds the number of temporary PINs generated before
+// finding one unused by other accounts
+const maxTempPINAttempts = 100
+
+// newTempPIN generates a random PIN, which is not one of the configured weak
+// PINs
+func (cfg Config) newTempPIN() (string, error) {
+	pin := ""
+	for pin == "" || cfg.isWeakPIN(pin) {
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+
+		pin = fmt.Sprintf("%04d", n.Int64())
+	}
+
+	return pin, nil
+}
+
+// isWeakPIN tells if `pin' is one of the configured weak PINs
+func (cfg Config) isWeakPIN(pin string) bool {
+	for _, weak := range cfg.WeakPINs {
+		if pin == weak {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ChangePIN replaces the PIN of `acc'
+//
+// Fails with ErrWeakPIN if `pin' is one of the configured weak PINs, and
+// with ErrPINInUse if it is the PIN of an account, as logins are matched by
+// PIN.
+func (d DB) ChangePIN(acc Account, pin string) (err error) {
+	err = d.cfg.checkNewPIN(pin)
+	if err != nil {
+		return fmt.Errorf("account %d: %w", acc, err)
+	}
+
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return internal(err, acc, "failed to build DB transaction")
+	}
+
+	err = d.checkPINUnused(ctx, dbTx, acc, pin)
+	if err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	res, err := dbTx.ExecContext(ctx, pinUpdateQuery, pin, acc)
+	if err != nil {
+		dbTx.Rollback()
+		return internal(err, acc, "failed to change PIN")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		dbTx.Rollback()
+		return internal(err, acc, "failed to change PIN")
+	}
+
+	if n == 0 {
+		dbTx.Rollback()
+		return fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return internal(err, acc, "failed to commit PIN change")
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package persistence
+
+import (
+	"testing"
+)
+
+func TestChangePIN(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+
+		err := s.ChangePIN(acc, "1234")
+		wantError(t, err, ErrWeakPIN)
+
+		err = s.ChangePIN(acc, "5082")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = s.Auth("4623")
+		wantError(t, err, ErrNoAccount)
+
+		got, temporary, err := s.Auth("5082")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != acc || temporary {
+			t.Errorf("auth = %d, %t, want %d, false", got, temporary, acc)
+		}
+	})
+}
+
+func TestChangePINInUse(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "5082", 0)
+
+		tempPIN, _, err := s.IssueTempPIN(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pin := range []string{"5082", tempPIN, "4623"} {
+			err = s.ChangePIN(acc, pin)
+			wantError(t, err, ErrPINInUse)
+		}
+
+		// Both accounts still log in with their own PIN
+		for pin, want := range map[string]Account{"4623": acc, "5082": other} {
+			got, _, err := s.Auth(pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("auth with %s = %d, want %d", pin, got, want)
+			}
+		}
+
+		// Expired temporary PINs can be taken
+		clk.advance(testConfig(clk).TempPINLifetime)
+		err = s.ChangePIN(acc, tempPIN)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTempPIN(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+
+		pin, expiresAt, err := s.IssueTempPIN(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expiresAt.Equal(clk.now.Add(testConfig(clk).TempPINLifetime)) {
+			t.Errorf("temporary PIN expires at %s", expiresAt)
+		}
+
+		got, temporary, err := s.Auth(pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != acc || !temporary {
+			t.Errorf("auth = %d, %t, want %d, true", got, temporary, acc)
+		}
+
+		// Temporary PINs are valid once
+		_, _, err = s.Auth(pin)
+		wantError(t, err, ErrNoAccount)
+
+		pin, _, err = s.IssueTempPIN(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clk.advance(testConfig(clk).TempPINLifetime)
+
+		_, _, err = s.Auth(pin)
+		wantError(t, err, ErrNoAccount)
+	})
+}
+
+func TestCheckPIN(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+
+		pin, _, err := s.IssueTempPIN(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			pin       string
+			temporary bool
+		}{
+			{"4623", false},
+			{pin, true},
+			// Temporary PINs are not used up by checks
+			{pin, true},
+		}
+
+		for _, test := range tests {
+			got, temporary, err := s.CheckPIN(test.pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != acc || temporary != test.temporary {
+				t.Errorf("check of %s = %d, %t, want %d, %t", test.pin, got, temporary, acc, test.temporary)
+			}
+		}
+
+		_, _, err = s.CheckPIN("8264")
+		wantError(t, err, ErrNoAccount)
+
+		_, _, err = s.Auth(pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = s.CheckPIN(pin)
+		wantError(t, err, ErrNoAccount)
+	})
+}
+
+func TestTempPINIsUnique(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "5082", 0)
+
+		taken, _, err := s.IssueTempPIN(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 50; i++ {
+			pin, _, err := s.IssueTempPIN(other)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pin == taken || pin == "4623" || pin == "5082" {
+				t.Fatalf("temporary PIN %s already in use", pin)
+			}
+		}
+
+		got, temporary, err := s.Auth(taken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != acc || !temporary {
+			t.Errorf("auth = %d, %t, want %d, true", got, temporary, acc)
+		}
+	})
+}
+
+func TestTempPINIndexIsUnique(t *testing.T) {
+	db := newTestDB(t, testConfig(&fakeClock{}))
+	acc := createAccount(t, db, "4623", 0)
+	other := createAccount(t, db, "5082", 0)
+
+	pin, _, err := db.IssueTempPIN(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.connection.Exec(tempPINSetQuery, pin, 0, other)
+	if err == nil {
+		t.Errorf("temporary PIN %s set on two accounts", pin)
+	}
+}
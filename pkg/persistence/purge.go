@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const openingBalanceFoldQuery = `INSERT INTO opening_balances(user, balance, as_of)
+	SELECT user, SUM(amount), ? FROM transactions WHERE created_at < ? GROUP BY user
+	ON CONFLICT(user) DO UPDATE SET balance = balance + excluded.balance, as_of = MAX(as_of, excluded.as_of)`
+
+const transactionsPurgeQuery = "DELETE FROM transactions WHERE created_at < ?"
+
+const adjustmentsPurgeQuery = "DELETE FROM adjustments WHERE transaction_id IN (SELECT id FROM transactions WHERE created_at < ?)"
+
+// PurgeTransactions deletes the transactions recorded before `before', and
+// returns how many were deleted
+//
+// The amounts of the deleted transactions are folded into the opening
+// balance of their account in the same database transaction, so balances
+// computed from the history, like BalanceAsOf, stay correct from `before' on.
+// The reasons of the deleted adjustments are deleted along with them.
+func (d DB) PurgeTransactions(before time.Time) (_ int64, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	dbTx, err := d.connection.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, internal(err, NoAccount, "failed to build DB transaction")
+	}
+
+	_, err = dbTx.ExecContext(ctx, openingBalanceFoldQuery, before.Unix(), before.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to record opening balances")
+	}
+
+	_, err = dbTx.ExecContext(ctx, adjustmentsPurgeQuery, before.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to purge adjustments")
+	}
+
+	res, err := dbTx.ExecContext(ctx, transactionsPurgeQuery, before.Unix())
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to purge transactions")
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		dbTx.Rollback()
+		return 0, internal(err, NoAccount, "failed to purge transactions")
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return 0, internal(err, NoAccount, "failed to commit purge")
+	}
+
+	return purged, nil
+}
+
+const openingBalanceQuery = "SELECT balance, as_of FROM opening_balances WHERE user = ?"
+
+// openingBalance returns the opening balance of `acc', folding its purged
+// transactions, and the time it is as of; zero if none were purged
+func openingBalance(ctx context.Context, q querier, acc Account) (int64, time.Time, error) {
+	balance := int64(0)
+	asOf := int64(0)
+
+	err := q.QueryRowContext(ctx, openingBalanceQuery, acc).Scan(&balance, &asOf)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, internal(err, acc, "failed to get opening balance")
+	}
+
+	return balance, time.Unix(asOf, 0).UTC(), nil
+}
+
+// checkHistory fails with a HistoryPurgedError if the transactions of `acc'
+// at `at' were purged, given its opening balance is as of `asOf'
+func checkHistory(acc Account, at, asOf time.Time) error {
+	if at.Unix() < asOf.Unix() {
+		return fmt.Errorf("account %d: %w", acc, &HistoryPurgedError{Before: asOf})
+	}
+
+	return nil
+}
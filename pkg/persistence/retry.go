@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// isBusy returns whether `err' is a transient SQLite locking error
+func isBusy(err error) bool {
+	sqliteErr := sqlite3.Error{}
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// retryBusy calls `op' until it succeeds or fails with a non-transient error
+//
+// Attempts are spaced by an exponential backoff starting at the configured
+// BusyBackoff. If every attempt fails because the database is busy, ErrBusy is
+// returned; if `ctx' is done while waiting, its error is returned.
+func (d DB) retryBusy(ctx context.Context, op func() error) error {
+	backoff := d.cfg.BusyBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !isBusy(err) {
+			return err
+		}
+
+		if attempt >= d.cfg.BusyAttempts {
+			return fmt.Errorf("%d attempts: %w", attempt, ErrBusy)
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("database busy, retrying")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+)
+
+// The business rules below are shared by DB and Memory: each backend reads
+// the state of the accounts involved, from the database or from memory, and
+// has it checked here, so both enforce the same rules.
+
+// debitState is the state of an account a withdrawal, or a hold, is checked
+// against
+type debitState struct {
+	// balance is the balance of the account
+	balance int64
+	// held is the total of its unexpired holds
+	held int64
+	// overrides are the limits set for the account
+	overrides LimitOverrides
+	// last is the time of its last withdrawal, transfer or unexpired hold,
+	// zero if there is none
+	last time.Time
+	// withdrawn is the total of its withdrawals and transfers over the
+	// daily window
+	withdrawn int64
+}
+
+// checkDebit fails if withdrawing, or holding, `amount' from `acc' at `now'
+// is not allowed given its `state': with ErrInsufficientFunds if the amount
+// exceeds the balance not held, then if it breaks the business hours or the
+// limits of the account
+func (cfg Config) checkDebit(acc Account, amount int64, state debitState, now time.Time) error {
+	if state.balance-state.held < amount {
+		return fmt.Errorf("account %d: %w", acc, ErrInsufficientFunds)
+	}
+
+	err := cfg.checkBusinessHours(acc, amount, now)
+	if err != nil {
+		return err
+	}
+
+	limits := state.overrides.apply(cfg.DefaultLimits())
+	return limits.checkWithdrawal(acc, amount, state.last, state.withdrawn+state.held, now)
+}
+
+// checkTransfer validates the credits of a transfer from `from', which
+// cannot credit the account it debits, and returns their total
+func checkTransfer(from Account, credits []Credit) (int64, error) {
+	for _, c := range credits {
+		if c.To == from {
+			return 0, fmt.Errorf("credit to account %d: %w", c.To, ErrInvalidTransaction)
+		}
+	}
+
+	return CreditsTotal(credits)
+}
+
+// checkLogin fails if `acc', matched by its credentials, cannot log in:
+// with ErrAccountClosed if it is `closed', and with ErrAccountNotAllowed if
+// it is not part of the configured allowlist
+func (cfg Config) checkLogin(acc Account, closed bool) error {
+	if closed {
+		return fmt.Errorf("account %d: %w", acc, ErrAccountClosed)
+	}
+
+	if !cfg.accountAllowed(acc) {
+		return fmt.Errorf("account %d: %w", acc, ErrAccountNotAllowed)
+	}
+
+	return nil
+}
+
+// checkNewPIN fails with ErrWeakPIN if `pin', set on an account, is one of
+// the configured weak PINs
+func (cfg Config) checkNewPIN(pin string) error {
+	if cfg.isWeakPIN(pin) {
+		return ErrWeakPIN
+	}
+
+	return nil
+}
+
+// generateTempPIN generates a temporary PIN for `acc' which `inUse' reports
+// unused by other accounts, failing with ErrNoTempPINAvailable if none was
+// found within maxTempPINAttempts
+func (cfg Config) generateTempPIN(acc Account, inUse func(pin string) (bool, error)) (string, error) {
+	for attempt := 0; attempt < maxTempPINAttempts; attempt++ {
+		candidate, err := cfg.newTempPIN()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate temporary PIN: %w", err)
+		}
+
+		used, err := inUse(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !used {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("account %d: %w", acc, ErrNoTempPINAvailable)
+}
+
+// expiryAfter returns the time something created at `now' expires after
+// `lifetime', truncated to the second like the times stored in the database
+func expiryAfter(now time.Time, lifetime time.Duration) time.Time {
+	return time.Unix(now.Add(lifetime).Unix(), 0).UTC()
+}
+
+// isExpired tells whether something expiring at `expiry' has expired at
+// `now', to the second like the database
+func isExpired(expiry, now time.Time) bool {
+	return expiry.Unix() <= now.Unix()
+}
@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckDebit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	cfg := testConfig(&fakeClock{now: now})
+	cfg.MaxWithdrawal = 500
+	cfg.DailyWithdrawalLimit = 1000
+	cfg.WithdrawalCooldown = time.Hour
+
+	daily := int64(2000)
+
+	tests := []struct {
+		name   string
+		amount int64
+		state  debitState
+		want   error
+	}{
+		{"allowed", 100, debitState{balance: 200}, nil},
+		{"whole balance", 200, debitState{balance: 200}, nil},
+		{"above balance", 300, debitState{balance: 200}, ErrInsufficientFunds},
+		{"held funds", 100, debitState{balance: 200, held: 150}, ErrInsufficientFunds},
+		{"above maximum", 600, debitState{balance: 1000}, ErrAboveMaxWithdrawal},
+		{"daily limit", 300, debitState{balance: 1000, withdrawn: 800}, ErrDailyLimitExceeded},
+		{"daily limit with holds", 300, debitState{balance: 1000, held: 300, withdrawn: 500}, ErrDailyLimitExceeded},
+		{"daily limit overridden", 300, debitState{balance: 1000, withdrawn: 800,
+			overrides: LimitOverrides{DailyWithdrawal: &daily}}, nil},
+		{"cooldown", 100, debitState{balance: 1000, last: now.Add(-time.Minute)}, ErrWithdrawalTooSoon},
+		{"after cooldown", 100, debitState{balance: 1000, last: now.Add(-time.Hour)}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := cfg.checkDebit(1, test.amount, test.state, now)
+			if test.want == nil {
+				if err != nil {
+					t.Errorf("error = %v, want nil", err)
+				}
+				return
+			}
+
+			wantError(t, err, test.want)
+		})
+	}
+}
+
+func TestCheckTransfer(t *testing.T) {
+	total, err := checkTransfer(1, []Credit{{To: 2, Amount: 50}, {To: 3, Amount: 25}})
+	if err != nil || total != 75 {
+		t.Errorf("total = %d, %v, want 75", total, err)
+	}
+
+	_, err = checkTransfer(1, []Credit{{To: 2, Amount: 50}, {To: 1, Amount: 25}})
+	wantError(t, err, ErrInvalidTransaction)
+}
+
+func TestAuthMatchesLowestAccount(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		accs := []Account{}
+		for i := 0; i < 10; i++ {
+			acc := createAccount(t, s, fmt.Sprintf("%04d", 4620+i), 0)
+			accs = append(accs, acc)
+		}
+
+		// Accounts sharing a PIN, as seeded by older versions, always match
+		// the same one
+		for _, acc := range accs {
+			setPIN(t, s, acc, "7391")
+		}
+
+		for i := 0; i < 20; i++ {
+			acc, _, err := s.Auth("7391")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acc != accs[0] {
+				t.Fatalf("auth matched account %d, want %d", acc, accs[0])
+			}
+		}
+	})
+}
+
+func TestAuthRefusedKeepsTempPIN(t *testing.T) {
+	forEachStore(t, func(cfg *Config) {
+		cfg.AllowedAccounts = []int{1}
+	}, func(t *testing.T, s testStore, clk *fakeClock) {
+		createAccount(t, s, "4623", 0)
+		other := createAccount(t, s, "8264", 0)
+
+		pin, _, err := s.IssueTempPIN(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Accounts outside of the allowlist are refused before their
+		// temporary PIN is used up
+		for i := 0; i < 2; i++ {
+			_, _, err = s.Auth(pin)
+			wantError(t, err, ErrAccountNotAllowed)
+		}
+	})
+}
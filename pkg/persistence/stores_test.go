@@ -0,0 +1,136 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testStore is the behaviour shared by DB and Memory under test
+type testStore interface {
+	Auth(pin string) (Account, bool, error)
+	CheckPIN(pin string) (Account, bool, error)
+	ChangePIN(acc Account, pin string) error
+	IssueTempPIN(acc Account) (string, time.Time, error)
+	CreateAccount(pin, cardNumber, externalRef string, balance int64) (Account, bool, error)
+	SetAccountLimits(acc Account, overrides LimitOverrides) error
+	CloseAccount(acc Account) error
+	Balance(acc Account) (int64, error)
+	AvailableBalance(acc Account) (int64, error)
+	DoTransaction(ctx context.Context, acc Account, tx Transaction) (int64, error)
+	FanOutTransfer(ctx context.Context, from Account, credits []Credit) error
+	TransferEach(ctx context.Context, from Account, credits []Credit) []error
+	PlaceHold(ctx context.Context, acc Account, amount int64) (Hold, error)
+	CaptureHold(ctx context.Context, acc Account, id int64) error
+	ReleaseHold(ctx context.Context, acc Account, id int64) error
+	GetTransaction(id int64) (TransactionRecord, error)
+	Transactions(acc Account, from, to time.Time) ([]TransactionRecord, error)
+	RecordAudit(entry AuditEntry) (int64, error)
+	ListAudit(filter AuditFilter, limit, offset int) ([]AuditEntry, error)
+}
+
+var (
+	_ testStore = (*DB)(nil)
+	_ testStore = (*Memory)(nil)
+)
+
+// forEachStore runs `test' on a fresh DB, then on a fresh Memory, both on
+// the configuration returned by testConfig changed by `configure', if any
+func forEachStore(t *testing.T, configure func(*Config), test func(t *testing.T, s testStore, clk *fakeClock)) {
+	stores := []struct {
+		name string
+		open func(t *testing.T, cfg Config) testStore
+	}{
+		{"db", func(t *testing.T, cfg Config) testStore { return newTestDB(t, cfg) }},
+		{"memory", func(t *testing.T, cfg Config) testStore { return NewMemory(cfg) }},
+	}
+
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			clk := &fakeClock{now: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+			cfg := testConfig(clk)
+			if configure != nil {
+				configure(&cfg)
+			}
+
+			test(t, store.open(t, cfg), clk)
+		})
+	}
+}
+
+// createAccount creates an account with `pin' and an opening `balance'
+func createAccount(t *testing.T, s testStore, pin string, balance int64) Account {
+	t.Helper()
+
+	acc, _, err := s.CreateAccount(pin, fmt.Sprintf("497010%s000000", pin), "", balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return acc
+}
+
+// wantBalance fails the test unless `acc' has `want' for balance
+func wantBalance(t *testing.T, s testStore, acc Account, want int64) {
+	t.Helper()
+
+	balance, err := s.Balance(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != want {
+		t.Errorf("balance of account %d = %d, want %d", acc, balance, want)
+	}
+}
+
+// wantError fails the test unless `err' matches `target' with errors.Is
+func wantError(t *testing.T, err, target error) {
+	t.Helper()
+
+	if !errors.Is(err, target) {
+		t.Errorf("error = %v, want %v", err, target)
+	}
+}
+
+func withdraw(s testStore, acc Account, amount int64) error {
+	_, err := s.DoTransaction(context.Background(), acc, Transaction{Type: Withdrawal, Amount: amount})
+	return err
+}
+
+// setPIN sets the PIN of `acc' in the storage of `s', bypassing the checks
+// of ChangePIN, e.g. to seed accounts sharing a PIN
+func setPIN(t *testing.T, s testStore, acc Account, pin string) {
+	t.Helper()
+
+	switch s := s.(type) {
+	case *DB:
+		_, err := s.connection.Exec(pinUpdateQuery, pin, acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *Memory:
+		s.accounts[acc].pin = pin
+	default:
+		t.Fatalf("cannot set the PIN of a %T", s)
+	}
+}
+
+// setBalance sets the balance of `acc' in the storage of `s', bypassing the
+// checks of the transactions, e.g. to seed balances close to the limits
+func setBalance(t *testing.T, s testStore, acc Account, balance int64) {
+	t.Helper()
+
+	switch s := s.(type) {
+	case *DB:
+		_, err := s.connection.Exec("UPDATE users SET balance = ? WHERE id = ?", balance, acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *Memory:
+		s.accounts[acc].balance = balance
+	default:
+		t.Fatalf("cannot set the balance of a %T", s)
+	}
+}
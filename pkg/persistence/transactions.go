@@ -0,0 +1,365 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TransactionRecord is a transaction, as recorded in the database
+type TransactionRecord struct {
+	ID      int64
+	Account Account
+	Type    TransactionType
+	// Amount is the absolute value of the movement, its direction is given
+	// by Type; it is signed for adjustments, like Transaction.Amount
+	Amount    int64
+	CreatedAt time.Time
+	// Category is empty for uncategorized transactions
+	Category string
+}
+
+const transactionQuery = "SELECT id, user, type, amount, created_at, category FROM transactions WHERE id = ?"
+
+// GetTransaction returns the transaction recorded with `id'
+//
+// Credits received through transfers are reported as deposits, and debits as
+// withdrawals; adjustments are reported as such. Fails with ErrNoTransaction if there is no such transaction.
+func (d DB) GetTransaction(id int64) (_ TransactionRecord, err error) {
+	record, err := d.guard()
+	if err != nil {
+		return TransactionRecord{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	rec, err := scanTransaction(d.connection.QueryRowContext(ctx, transactionQuery, id))
+	if err == sql.ErrNoRows {
+		return rec, fmt.Errorf("transaction %d: %w", id, ErrNoTransaction)
+	}
+	if err != nil {
+		return rec, internal(err, NoAccount, "failed to get transaction")
+	}
+
+	return rec, nil
+}
+
+const transactionsQuery = "SELECT id, user, type, amount, created_at, category FROM transactions WHERE user = ? AND created_at >= ? AND created_at <= ? ORDER BY id"
+
+// Transactions returns the transactions of `acc' between `from' and `to',
+// both included, oldest first
+//
+// A zero `from' or `to' leaves the period unbounded on that side.
+func (d DB) Transactions(acc Account, from, to time.Time) ([]TransactionRecord, error) {
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	records := []TransactionRecord{}
+	err := d.EachTransaction(ctx, acc, from, to, func(rec TransactionRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// EachTransaction calls `fn' with the transactions of `acc' between `from'
+// and `to', both included, oldest first, as they are read, so large
+// histories can be streamed
+//
+// Reading is bounded by `ctx' rather than the query timeout, and stops at the
+// first error of `fn', which is returned.
+func (d DB) EachTransaction(ctx context.Context, acc Account, from, to time.Time, fn func(TransactionRecord) error) (err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return err
+	}
+	defer func() { record(err) }()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return err
+	}
+
+	fromUnix, toUnix := periodBounds(from, to)
+	rows, err := d.connection.QueryContext(ctx, transactionsQuery, acc, fromUnix, toUnix)
+	if err != nil {
+		return internal(err, acc, "failed to query transactions")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanTransaction(rows)
+		if err != nil {
+			return internal(err, acc, "failed to read transaction")
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return internal(err, acc, "failed to read transactions")
+	}
+
+	return nil
+}
+
+const recentTransactionsQuery = "SELECT id, user, type, amount, created_at, category FROM transactions WHERE user = ? ORDER BY id DESC LIMIT ? OFFSET ?"
+
+// RecentTransactions returns at most `limit' transactions of `acc', newest
+// first, skipping the `offset' newest ones
+func (d DB) RecentTransactions(acc Account, limit, offset int) (_ []TransactionRecord, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.connection.QueryContext(ctx, recentTransactionsQuery, acc, limit, offset)
+	if err != nil {
+		return nil, internal(err, acc, "failed to query transactions")
+	}
+	defer rows.Close()
+
+	records := []TransactionRecord{}
+	for rows.Next() {
+		rec, err := scanTransaction(rows)
+		if err != nil {
+			return nil, internal(err, acc, "failed to read transaction")
+		}
+		records = append(records, rec)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, internal(err, acc, "failed to read transactions")
+	}
+
+	return records, nil
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTransaction reads a transaction selected as id, user, type, amount,
+// created_at, category
+func scanTransaction(row scanner) (TransactionRecord, error) {
+	id := int64(0)
+	acc := NoAccount
+	typ := Error
+	amount := int64(0)
+	createdAt := int64(0)
+	category := sql.NullString{}
+
+	err := row.Scan(&id, &acc, &typ, &amount, &createdAt, &category)
+	if err != nil {
+		return TransactionRecord{}, err
+	}
+
+	return newTransactionRecord(id, acc, typ, amount, time.Unix(createdAt, 0).UTC(), category.String), nil
+}
+
+// newTransactionRecord returns the record of the transaction `id' recorded
+// with type `typ' and the signed `amount'
+//
+// Transfers are reported as deposits or withdrawals depending on their
+// direction.
+func newTransactionRecord(id int64, acc Account, typ TransactionType, amount int64, createdAt time.Time, category string) TransactionRecord {
+	rec := TransactionRecord{
+		ID:        id,
+		Account:   acc,
+		Type:      typ,
+		Amount:    amount,
+		CreatedAt: createdAt,
+		Category:  category,
+	}
+
+	if typ == transfer {
+		rec.Type = Deposit
+		if amount < 0 {
+			rec.Type = Withdrawal
+		}
+	}
+
+	if rec.Type == Withdrawal {
+		rec.Amount = -amount
+	}
+
+	return rec
+}
+
+// periodBounds returns the Unix bounds of the period from `from' to `to', a
+// zero time leaving the period unbounded on its side
+func periodBounds(from, to time.Time) (int64, int64) {
+	fromUnix := int64(0)
+	if !from.IsZero() {
+		fromUnix = from.Unix()
+	}
+
+	toUnix := int64(math.MaxInt64)
+	if !to.IsZero() {
+		toUnix = to.Unix()
+	}
+
+	return fromUnix, toUnix
+}
+
+// Summary aggregates the transactions of an account over a period
+type Summary struct {
+	Deposits    int64
+	Withdrawals int64
+	// Balance is the current balance of the account, regardless of the
+	// period
+	Balance int64
+}
+
+// Net returns the change of the balance over the period
+func (s Summary) Net() int64 {
+	return s.Deposits - s.Withdrawals
+}
+
+const summaryQuery = `SELECT
+	COALESCE(SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END), 0),
+	COALESCE(SUM(CASE WHEN amount < 0 THEN -amount ELSE 0 END), 0)
+FROM transactions WHERE user = ? AND created_at >= ? AND created_at <= ?`
+
+// Summary totals the deposits and withdrawals of `acc' between `from' and
+// `to', both included
+//
+// A zero `from' or `to' leaves the period unbounded on that side. Credits and
+// debits from transfers count as deposits and withdrawals.
+func (d DB) Summary(acc Account, from, to time.Time) (_ Summary, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	sum := Summary{}
+
+	info, err := accountState(ctx, d.connection, acc)
+	if err != nil {
+		return sum, err
+	}
+	sum.Balance = info.Balance
+
+	fromUnix, toUnix := periodBounds(from, to)
+	err = d.connection.QueryRowContext(ctx, summaryQuery, acc, fromUnix, toUnix).Scan(&sum.Deposits, &sum.Withdrawals)
+	if err != nil {
+		return sum, internal(err, acc, "failed to summarize transactions")
+	}
+
+	return sum, nil
+}
+
+const balanceAfterQuery = `SELECT balance - COALESCE(
+	(SELECT SUM(amount) FROM transactions WHERE user = users.id AND id > ?), 0
+) FROM users WHERE id = ?`
+
+// BalanceAfter computes the balance of the account right after the
+// transaction `id', by undoing the later transactions from its current
+// balance
+func (d DB) BalanceAfter(acc Account, id int64) (_ int64, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	balance := int64(0)
+	err = d.connection.QueryRowContext(ctx, balanceAfterQuery, id, acc).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("account %d: %w", acc, ErrNoAccount)
+	}
+	if err != nil {
+		return 0, internal(err, acc, "failed to compute balance after transaction")
+	}
+
+	return balance, nil
+}
+
+// CategoryTotals are the totals of the transactions of a category
+type CategoryTotals struct {
+	// Category is empty for uncategorized transactions
+	Category    string
+	Deposits    int64
+	Withdrawals int64
+}
+
+const summaryByCategoryQuery = `SELECT
+	COALESCE(category, ''),
+	COALESCE(SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END), 0),
+	COALESCE(SUM(CASE WHEN amount < 0 THEN -amount ELSE 0 END), 0)
+FROM transactions WHERE user = ? AND created_at >= ? AND created_at <= ?
+GROUP BY COALESCE(category, '') ORDER BY 1`
+
+// SummaryByCategory totals the deposits and withdrawals of `acc' between
+// `from' and `to' for every category, like Summary
+//
+// Categories without transactions over the period are not returned.
+func (d DB) SummaryByCategory(acc Account, from, to time.Time) (_ []CategoryTotals, err error) {
+	record, err := d.guardAccount(acc)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { record(err) }()
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+
+	_, err = accountState(ctx, d.connection, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	fromUnix, toUnix := periodBounds(from, to)
+	rows, err := d.connection.QueryContext(ctx, summaryByCategoryQuery, acc, fromUnix, toUnix)
+	if err != nil {
+		return nil, internal(err, acc, "failed to summarize transactions by category")
+	}
+	defer rows.Close()
+
+	totals := []CategoryTotals{}
+	for rows.Next() {
+		t := CategoryTotals{}
+		err = rows.Scan(&t.Category, &t.Deposits, &t.Withdrawals)
+		if err != nil {
+			return nil, internal(err, acc, "failed to read category totals")
+		}
+		totals = append(totals, t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, internal(err, acc, "failed to read category totals")
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,170 @@
+package persistence
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestAccountQueriesUseIndex checks that the queries on the transactions of
+// an account search them through the transactions_user_created_at index,
+// rather than scanning the whole table
+func TestAccountQueriesUseIndex(t *testing.T) {
+	db := newTestDB(t, testConfig(&fakeClock{}))
+
+	queries := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"transactions", transactionsQuery, []interface{}{1, 0, 100}},
+		{"recent transactions", recentTransactionsQuery, []interface{}{1, 10, 0}},
+		{"summary", summaryQuery, []interface{}{1, 0, 100}},
+		{"summary by category", summaryByCategoryQuery, []interface{}{1, 0, 100}},
+		{"balance as of", balanceAsOfQuery, []interface{}{1, 100}},
+		{"account stats", accountStatsQuery, []interface{}{1}},
+		{"recent debits", recentDebitsQuery, []interface{}{1, Withdrawal, transfer, 100}},
+		{"last debit", lastDebitQuery, []interface{}{1, Withdrawal, transfer}},
+	}
+
+	for _, q := range queries {
+		t.Run(q.name, func(t *testing.T) {
+			rows, err := db.connection.Query("EXPLAIN QUERY PLAN "+q.query, q.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			plan := []string{}
+			for rows.Next() {
+				var id, parent, notUsed int
+				detail := ""
+				err = rows.Scan(&id, &parent, &notUsed, &detail)
+				if err != nil {
+					t.Fatal(err)
+				}
+				plan = append(plan, detail)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			found := false
+			for _, step := range plan {
+				if strings.HasPrefix(step, "SCAN transactions") {
+					t.Errorf("full scan of transactions: %q", plan)
+				}
+				if strings.Contains(step, "INDEX transactions_user_created_at") {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("transactions_user_created_at not used: %q", plan)
+			}
+		})
+	}
+}
+
+func TestAdjustment(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		ctx := context.Background()
+		acc := createAccount(t, s, "4623", 500)
+
+		amounts := []int64{-200, 50}
+		for _, amount := range amounts {
+			id, err := s.DoTransaction(ctx, acc, Transaction{
+				Type:   Adjustment,
+				Amount: amount,
+				Reason: "failed settlement",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec, err := s.GetTransaction(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Type != Adjustment || rec.Amount != amount {
+				t.Errorf("adjustment recorded as %v of %d, want %v of %d", rec.Type, rec.Amount, Adjustment, amount)
+			}
+		}
+
+		wantBalance(t, s, acc, 350)
+
+		_, err := s.DoTransaction(ctx, acc, Transaction{Type: Adjustment, Amount: 100})
+		wantError(t, err, ErrInvalidTransaction)
+
+		_, err = s.DoTransaction(ctx, acc, Transaction{
+			Type:   Adjustment,
+			Amount: -1000,
+			Reason: "failed settlement",
+		})
+		wantError(t, err, ErrInsufficientFunds)
+
+		wantBalance(t, s, acc, 350)
+	})
+}
+
+func TestAdjustmentReasonRecorded(t *testing.T) {
+	db := newTestDB(t, testConfig(&fakeClock{}))
+	acc := createAccount(t, db, "4623", 500)
+
+	id, err := db.DoTransaction(context.Background(), acc, Transaction{
+		Type:   Adjustment,
+		Amount: -200,
+		Reason: "failed settlement",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reason string
+	err = db.connection.QueryRow("SELECT reason FROM adjustments WHERE transaction_id = ?", id).Scan(&reason)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "failed settlement" {
+		t.Errorf("reason = %q, want %q", reason, "failed settlement")
+	}
+}
+
+func TestGetAmount(t *testing.T) {
+	tests := []struct {
+		tx   Transaction
+		want int64
+		err  error
+	}{
+		{Transaction{Type: Deposit, Amount: 100}, 100, nil},
+		{Transaction{Type: Withdrawal, Amount: 100}, -100, nil},
+		{Transaction{Type: Adjustment, Amount: 100}, 100, nil},
+		{Transaction{Type: Adjustment, Amount: -100}, -100, nil},
+		{Transaction{}, 0, ErrInvalidTransaction},
+		{Transaction{Type: transfer + 1, Amount: 100}, 0, ErrInvalidTransaction},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tx.Type.String(), func(t *testing.T) {
+			amount, err := test.tx.getAmount()
+			if test.err != nil {
+				wantError(t, err, test.err)
+				return
+			}
+
+			if err != nil || amount != test.want {
+				t.Errorf("amount = %d, %v, want %d", amount, err, test.want)
+			}
+		})
+	}
+}
+
+func TestZeroTransactionRefused(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		acc := createAccount(t, s, "4623", 500)
+
+		_, err := s.DoTransaction(context.Background(), acc, Transaction{})
+		wantError(t, err, ErrInvalidTransaction)
+
+		wantBalance(t, s, acc, 500)
+	})
+}
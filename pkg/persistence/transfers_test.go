@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFanOutTransfer(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 500)
+		to1 := createAccount(t, s, "5082", 0)
+		to2 := createAccount(t, s, "7391", 0)
+
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{to1, 100}, {to2, 150}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, from, 250)
+		wantBalance(t, s, to1, 100)
+		wantBalance(t, s, to2, 150)
+	})
+}
+
+func TestFanOutTransferIsAtomic(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 500)
+		to := createAccount(t, s, "5082", 0)
+
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{to, 100}, {Account(42), 100}})
+		wantError(t, err, ErrNoAccount)
+
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, 400}, {to, 200}})
+		wantError(t, err, ErrInsufficientFunds)
+
+		wantBalance(t, s, from, 500)
+		wantBalance(t, s, to, 0)
+	})
+}
+
+func TestFanOutTransferInvalidCredits(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 500)
+		to := createAccount(t, s, "5082", 0)
+
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{from, 100}})
+		wantError(t, err, ErrInvalidTransaction)
+
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, -100}})
+		wantError(t, err, ErrInvalidTransaction)
+
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, MaxAmount + 1}})
+		wantError(t, err, ErrAmountOverflow)
+
+		wantBalance(t, s, from, 500)
+	})
+}
+
+func TestTransfersAreRecorded(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 500)
+		to := createAccount(t, s, "5082", 0)
+
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{to, 100}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checks := []struct {
+			acc  Account
+			typ  TransactionType
+			want int
+		}{
+			// The opening deposit, then the transfer
+			{from, Withdrawal, 2},
+			{to, Deposit, 1},
+		}
+		for _, c := range checks {
+			txs, err := s.Transactions(c.acc, clk.now.Add(-time.Hour), clk.now.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txs) != c.want {
+				t.Fatalf("account %d has %d transactions, want %d", c.acc, len(txs), c.want)
+			}
+
+			last := txs[len(txs)-1]
+			if last.Type != c.typ || last.Amount != 100 {
+				t.Errorf("transfer recorded on account %d as %v of %d", c.acc, last.Type, last.Amount)
+			}
+		}
+	})
+}
+
+func TestFanOutTransferLimits(t *testing.T) {
+	forEachStore(t, func(cfg *Config) {
+		cfg.MaxWithdrawal = 200
+		cfg.DailyWithdrawalLimit = 300
+		cfg.WithdrawalCooldown = time.Hour
+	}, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 1000)
+		to := createAccount(t, s, "5082", 0)
+
+		// The total of the credits is checked, not every credit
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{to, 150}, {to, 100}})
+		wantError(t, err, ErrAboveMaxWithdrawal)
+
+		err = withdraw(s, from, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, 50}})
+		wantError(t, err, ErrWithdrawalTooSoon)
+
+		clk.advance(time.Hour)
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, 150}})
+		wantError(t, err, ErrDailyLimitExceeded)
+
+		errs := s.TransferEach(context.Background(), from, []Credit{{to, 250}, {to, 100}})
+		wantError(t, errs[0], ErrAboveMaxWithdrawal)
+		if errs[1] != nil {
+			t.Errorf("error of the credit within limits = %v", errs[1])
+		}
+
+		wantBalance(t, s, from, 700)
+		wantBalance(t, s, to, 100)
+	})
+}
+
+func TestFanOutTransferBusinessHours(t *testing.T) {
+	forEachStore(t, func(cfg *Config) {
+		cfg.BusinessHours = BusinessHours{Open: 9 * time.Hour, Close: 17 * time.Hour, Threshold: 100}
+	}, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 1000)
+		to := createAccount(t, s, "5082", 0)
+
+		clk.advance(8 * time.Hour)
+		err := s.FanOutTransfer(context.Background(), from, []Credit{{to, 150}})
+		wantError(t, err, ErrOutsideBusinessHours)
+
+		err = s.FanOutTransfer(context.Background(), from, []Credit{{to, 50}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantBalance(t, s, from, 950)
+	})
+}
+
+func TestTransferEach(t *testing.T) {
+	forEachStore(t, nil, func(t *testing.T, s testStore, clk *fakeClock) {
+		from := createAccount(t, s, "4623", 500)
+		to := createAccount(t, s, "5082", 0)
+
+		errs := s.TransferEach(context.Background(), from, []Credit{{to, 100}, {Account(42), 100}, {to, 1000}, {to, 50}})
+		if len(errs) != 4 {
+			t.Fatalf("got %d errors, want 4", len(errs))
+		}
+		if errs[0] != nil || errs[3] != nil {
+			t.Errorf("errors of applied credits = %v, %v", errs[0], errs[3])
+		}
+		wantError(t, errs[1], ErrNoAccount)
+		wantError(t, errs[2], ErrInsufficientFunds)
+
+		wantBalance(t, s, from, 350)
+		wantBalance(t, s, to, 150)
+	})
+}
+
+func TestCreditsTotal(t *testing.T) {
+	tests := []struct {
+		name    string
+		credits []Credit
+		want    int64
+		err     error
+	}{
+		{"sum", []Credit{{1, 100}, {2, 50}}, 150, nil},
+		{"none", nil, 0, nil},
+		{"zero", []Credit{{1, 100}, {2, 0}}, 0, ErrInvalidTransaction},
+		{"negative", []Credit{{1, -100}}, 0, ErrInvalidTransaction},
+		{"too large", []Credit{{1, 100}, {2, MaxAmount + 1}}, 0, ErrAmountOverflow},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			total, err := CreditsTotal(test.credits)
+			if test.err != nil {
+				wantError(t, err, test.err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != test.want {
+				t.Errorf("total = %d, want %d", total, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Package receipt signs transaction receipts, so customers can prove them
+// later
+package receipt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Receipt is the proof of a transaction given to the customer
+type Receipt struct {
+	TransactionID int64     `json:"transaction_id"`
+	Account       int       `json:"account"`
+	Type          string    `json:"type"`
+	Amount        int64     `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+	BalanceAfter  int64     `json:"balance_after"`
+}
+
+// payload returns the bytes signed for `r', its JSON encoding
+func (r Receipt) payload() []byte {
+	r.CreatedAt = r.CreatedAt.UTC()
+
+	// Encoding a struct of plain fields cannot fail
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of `r' with `secret'
+func Sign(secret []byte, r Receipt) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(r.payload())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns whether `signature' was computed by Sign for `r' with
+// `secret'
+func Verify(secret []byte, r Receipt, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(r.payload())
+	return hmac.Equal(sig, mac.Sum(nil))
+}
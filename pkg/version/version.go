@@ -0,0 +1,15 @@
+// Package version holds the build information of the service
+//
+// The variables are meant to be set at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/lbajolet/atm_service/pkg/version.Version=v1.0.0"
+package version
+
+var (
+	// Version is the version of the service
+	Version = "dev"
+	// Commit is the VCS revision the service was built from
+	Commit = "unknown"
+	// BuildDate is the date the service was built at
+	BuildDate = "unknown"
+)